@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requireAdmin 管理接口认证：请求需携带 Authorization: Bearer <admin_token>
+// 未配置 admin_token 时管理接口不可用
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().AdminToken
+		if token == "" {
+			writeOpenAIError(w, http.StatusForbidden, "permission_error", "管理接口未启用（未配置 ADMIN_TOKEN）")
+			return
+		}
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			log.Printf("管理接口认证失败: %s %s，来源 %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeOpenAIError(w, http.StatusUnauthorized, "authentication_error", "管理接口认证失败")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// auditMu 串行写入审计日志
+var auditMu sync.Mutex
+
+// auditLog 记录管理操作：写入 audit_log_file（每行一个JSON），同时输出到日志。details中不能包含Key明文
+func auditLog(r *http.Request, action, target string, details map[string]interface{}) {
+	entry := map[string]interface{}{
+		"time":   time.Now().Format(time.RFC3339),
+		"remote": r.RemoteAddr,
+		"action": action,
+		"target": target,
+	}
+	if len(details) > 0 {
+		entry["details"] = details
+	}
+	line, _ := json.Marshal(entry)
+	log.Printf("审计: %s", line)
+
+	path := currentConfig().AuditLogFile
+	if path == "" {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("写入审计日志失败: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// writeJSON 返回JSON响应
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminKeyView 管理接口返回的Key信息，不包含Key明文和摘要
+func adminKeyView(k managedKey) map[string]interface{} {
+	status := "active"
+	switch {
+	case k.RevokedAt != nil:
+		status = "revoked"
+	case k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt):
+		status = "expired"
+	}
+	today, month := clientStore.UsageSummary(k.ID)
+	return map[string]interface{}{
+		"id":           k.ID,
+		"name":         k.Name,
+		"key_prefix":   k.KeyPrefix,
+		"source":       "admin",
+		"status":       status,
+		"tenant":       k.Tenant,
+		"scopes":       k.KeyScopes,
+		"quota":        k.Quota,
+		"budget":       k.Budget,
+		"created_at":   k.CreatedAt,
+		"expires_at":   k.ExpiresAt,
+		"revoked_at":   k.RevokedAt,
+		"last_used_at": k.LastUsedAt,
+		"usage":        map[string]usageCounter{"today": today, "month": month},
+	}
+}
+
+// configKeyView 配置文件中的Key信息（只读）
+func configKeyView(ck ClientKeyConfig) map[string]interface{} {
+	name := ck.Name
+	if name == "" {
+		name = maskAPIKey(ck.Key)
+	}
+	today, month := clientStore.UsageSummary("config:" + name)
+	return map[string]interface{}{
+		"id":     "config:" + name,
+		"name":   name,
+		"source": "config",
+		"status": "active",
+		"tenant": ck.Tenant,
+		"scopes": ck.KeyScopes,
+		"quota":  ck.Quota,
+		"budget": ck.Budget,
+		"usage":  map[string]usageCounter{"today": today, "month": month},
+	}
+}
+
+// handleAdminKeys 管理客户端Key
+//
+//	GET  /admin/keys              列出所有Key（包括配置文件中的Key）
+//	POST /admin/keys              创建Key，响应中包含Key明文（只返回这一次）
+//	GET  /admin/keys/{id}         查看Key及最近的按天用量
+//	PATCH /admin/keys/{id}        修改名称、租户、允许的模型、配额、有效期
+//	POST /admin/keys/{id}/rotate  轮换Key，旧Key立即失效
+//	POST /admin/keys/{id}/revoke  吊销Key
+func handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		keys := []map[string]interface{}{}
+		for _, ck := range currentConfig().ClientKeys {
+			keys = append(keys, configKeyView(ck))
+		}
+		for _, k := range clientStore.Keys() {
+			keys = append(keys, adminKeyView(k))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+
+	case id == "" && r.Method == http.MethodPost:
+		var u keyUpdate
+		if !decodeAdminBody(w, r, &u) || !checkKeyTenant(w, u) {
+			return
+		}
+		k, secret, err := clientStore.CreateKey(u)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		auditLog(r, "key.create", k.ID, map[string]interface{}{"name": k.Name, "tenant": k.Tenant, "quota": k.Quota, "budget": k.Budget, "scopes": k.KeyScopes, "expires_at": k.ExpiresAt})
+		view := adminKeyView(k)
+		view["key"] = secret
+		writeJSON(w, http.StatusCreated, view)
+
+	case strings.HasPrefix(id, "config:"):
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "配置文件中的Key只能通过修改配置文件管理")
+
+	case action == "" && r.Method == http.MethodGet:
+		k, ok := clientStore.Key(id)
+		if !ok {
+			writeAdminError(w, errKeyNotFound)
+			return
+		}
+		view := adminKeyView(k)
+		view["daily_usage"] = clientStore.DailyUsage(id, 31)
+		writeJSON(w, http.StatusOK, view)
+
+	case action == "" && r.Method == http.MethodPatch:
+		var u keyUpdate
+		if !decodeAdminBody(w, r, &u) || !checkKeyTenant(w, u) {
+			return
+		}
+		k, err := clientStore.UpdateKey(id, u)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		auditLog(r, "key.update", id, map[string]interface{}{"name": k.Name, "tenant": k.Tenant, "quota": k.Quota, "budget": k.Budget, "scopes": k.KeyScopes, "expires_at": k.ExpiresAt})
+		writeJSON(w, http.StatusOK, adminKeyView(k))
+
+	case action == "rotate" && r.Method == http.MethodPost:
+		k, secret, err := clientStore.RotateKey(id)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		auditLog(r, "key.rotate", id, map[string]interface{}{"key_prefix": k.KeyPrefix})
+		view := adminKeyView(k)
+		view["key"] = secret
+		writeJSON(w, http.StatusOK, view)
+
+	case action == "revoke" && r.Method == http.MethodPost:
+		k, err := clientStore.RevokeKey(id)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		auditLog(r, "key.revoke", id, nil)
+		writeJSON(w, http.StatusOK, adminKeyView(k))
+
+	default:
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "未知的管理接口: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// handleAdminTenants 管理租户
+//
+//	GET    /admin/tenants         列出所有租户（API Key打码显示）
+//	PUT    /admin/tenants/{name}  创建或替换租户
+//	DELETE /admin/tenants/{name}  删除租户
+func handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tenants"), "/")
+	cfg := currentConfig()
+	_, inConfig := cfg.Tenants[name]
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		tenants := map[string]interface{}{}
+		for n, t := range clientStore.Tenants() {
+			tenants[n] = adminTenantView(n, t, "admin")
+		}
+		for n, t := range cfg.Tenants {
+			tenants[n] = adminTenantView(n, t, "config")
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tenants": tenants})
+
+	case name == "":
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "未知的管理接口: "+r.Method+" "+r.URL.Path)
+
+	case inConfig:
+		writeOpenAIError(w, http.StatusConflict, "invalid_request_error", "配置文件中的租户只能通过修改配置文件管理")
+
+	case r.Method == http.MethodPut:
+		var t TenantConfig
+		if !decodeAdminBody(w, r, &t) {
+			return
+		}
+		if t.APIKey != "" && t.AppID == "" {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "使用自己的 api_key 时必须设置默认应用 app_id")
+			return
+		}
+		if t.Budget.Daily < 0 || t.Budget.Monthly < 0 {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "budget 不能为负数")
+			return
+		}
+		created, err := clientStore.PutTenant(name, t)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		auditLog(r, "tenant.put", name, map[string]interface{}{"created": created, "workspace": t.Workspace, "app_id": t.AppID, "allowed_apps": t.AllowedApps, "budget": t.Budget, "api_key_changed": t.APIKey != ""})
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, adminTenantView(name, t, "admin"))
+
+	case r.Method == http.MethodDelete:
+		if err := clientStore.DeleteTenant(name); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		auditLog(r, "tenant.delete", name, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "未知的管理接口: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// adminTenantView 管理接口返回的租户信息，API Key打码显示
+func adminTenantView(name string, t TenantConfig, source string) map[string]interface{} {
+	today, month := clientStore.UsageSummary(tenantUsageID(name))
+	view := map[string]interface{}{
+		"source":       source,
+		"workspace":    t.Workspace,
+		"app_id":       t.AppID,
+		"apps":         t.Apps,
+		"allowed_apps": t.AllowedApps,
+		"parameters":   t.Parameters,
+		"budget":       t.Budget,
+		"usage":        map[string]usageCounter{"today": today, "month": month},
+	}
+	if t.APIKey != "" {
+		view["api_key"] = maskAPIKey(t.APIKey)
+	}
+	return view
+}
+
+// decodeAdminBody 解析管理接口的JSON请求体，失败时返回400
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "请求格式错误: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// checkKeyTenant 检查Key所属的租户是否存在
+func checkKeyTenant(w http.ResponseWriter, u keyUpdate) bool {
+	if u.Tenant == nil || *u.Tenant == "" {
+		return true
+	}
+	if _, ok := lookupTenant(currentConfig(), *u.Tenant); !ok {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "租户不存在: "+*u.Tenant)
+		return false
+	}
+	return true
+}
+
+// writeAdminError 把存储操作的错误转换为HTTP响应
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errKeyNotFound), errors.Is(err, errTenantNotFound):
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", err.Error())
+	case errors.Is(err, errStoreWrite):
+		log.Printf("%v", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "写入存储文件失败")
+	default:
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+	}
+}
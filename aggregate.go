@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// handleAggregatedResponseNative 非流式请求通过上游流式接口获取并聚合为完整的OpenAI响应
+// 使用空闲超时代替总超时：只要上游持续输出就不会被中断，卡住时能尽早发现
+func handleAggregatedResponseNative(client *http.Client, req *http.Request, w http.ResponseWriter, model string) {
+	parent := req.Context()
+	wd, ctx := newStreamWatchdogFromConfig(parent)
+	defer wd.Stop()
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("聚合请求失败: %v", err)
+		statusCode, errType, message, _ := classifyStreamError(parent, wd, err)
+		if errType == "" {
+			return
+		}
+		if statusCode == http.StatusBadGateway {
+			message = "无法连接到阿里云百炼API: " + err.Error()
+		}
+		writeOpenAIError(w, statusCode, errType, message)
+		return
+	}
+	defer resp.Body.Close()
+
+	// 错误响应按非流式的方式转换
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(upstreamErrorToOpenAI(body, resp.StatusCode))
+		return
+	}
+
+	recordStreamStarted()
+	var final AliyunNativeResponse
+	var events int
+	var upstreamError *AliyunNativeResponse
+	err = readNativeStream(&watchdogReader{r: resp.Body, wd: wd}, func(nativeResp AliyunNativeResponse) bool {
+		events++
+		if nativeResp.Code != "" {
+			upstreamError = &nativeResp
+			return false
+		}
+		// 原生API每个事件携带的是累计全文，保留最后一个即可
+		if final.RequestID == "" {
+			final.RequestID = nativeResp.RequestID
+		}
+		final.Output.Text = nativeResp.Output.Text
+		final.Output.SessionID = nativeResp.Output.SessionID
+		reportSession(parent, nativeResp.Output.SessionID)
+		reportProgress(parent, nativeResp)
+		if len(nativeResp.Usage.Models) > 0 {
+			final.Usage = nativeResp.Usage
+			reportUsage(parent, nativeResp)
+		}
+		finishReason := nativeResp.Output.FinishReason
+		if finishReason != "" && finishReason != "null" {
+			final.Output.FinishReason = finishReason
+			return false
+		}
+		return true
+	})
+
+	if upstreamError != nil {
+		log.Printf("上游流式响应返回错误: %s %s", upstreamError.Code, upstreamError.Message)
+		recordStreamTruncated(truncateUpstreamError)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(openAIErrorJSON("api_error", upstreamError.Code, upstreamError.Message))
+		return
+	}
+
+	// 上游没有给出finish_reason就结束时按截断处理（502），不能把不完整的回答当作正常结束返回
+	if err != nil || final.Output.FinishReason == "" || wd.Reason() != nil {
+		statusCode, errType, message, reason := classifyStreamError(parent, wd, err)
+		log.Printf("聚合上游流式响应中断: %s, %v, 已接收事件数: %d", reason, err, events)
+		recordStreamTruncated(reason)
+		if errType != "" {
+			writeOpenAIError(w, statusCode, errType, message)
+		}
+		return
+	}
+
+	finalBody, err := json.Marshal(final)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "响应格式转换失败")
+		return
+	}
+	convertedBody := convertNativeResponseToOpenAI(finalBody, model)
+	if len(convertedBody) == 0 {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "响应格式转换失败")
+		return
+	}
+
+	reportAnswer(parent, final)
+	recordStreamCompleted()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(convertedBody)
+
+	log.Printf("聚合流式响应完成，事件数: %d", events)
+}
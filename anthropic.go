@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AnthropicRequest Anthropic Messages API 请求格式
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     *int               `json:"max_tokens"`
+	System        anthropicContent   `json:"system"`
+	Messages      []AnthropicMessage `json:"messages"`
+	StopSequences []string           `json:"stop_sequences"`
+	Temperature   *float64           `json:"temperature"`
+	TopP          *float64           `json:"top_p"`
+	Stream        bool               `json:"stream"`
+	Tools         []AnthropicTool    `json:"tools"`
+	Metadata      struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata"`
+}
+
+// AnthropicMessage Anthropic格式的消息，content可以是字符串或内容块数组
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content anthropicContent `json:"content"`
+}
+
+// AnthropicTool Anthropic格式的工具定义
+type AnthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+// anthropicBlock 内容块，只使用文本相关的字段
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text"`
+	Name      string           `json:"name"`        // tool_use
+	Input     json.RawMessage  `json:"input"`       // tool_use
+	ToolUseID string           `json:"tool_use_id"` // tool_result
+	Content   anthropicContent `json:"content"`     // tool_result
+}
+
+// anthropicContent 字符串或内容块数组
+type anthropicContent []anthropicBlock
+
+func (c *anthropicContent) UnmarshalJSON(data []byte) error {
+	// null 等同于省略该字段，不能当作空字符串
+	if string(data) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = anthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return fmt.Errorf("content 必须是字符串或内容块数组")
+	}
+	*c = blocks
+	return nil
+}
+
+// Text 把内容块转换为纯文本：百炼应用只接受文本，工具调用和工具结果以文本形式保留在上下文中
+func (c anthropicContent) Text() (string, error) {
+	parts := make([]string, 0, len(c))
+	for _, block := range c {
+		switch block.Type {
+		case "text":
+			parts = append(parts, block.Text)
+		case "tool_use":
+			parts = append(parts, fmt.Sprintf("[调用工具 %s: %s]", block.Name, block.Input))
+		case "tool_result":
+			result, err := block.Content.Text()
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, fmt.Sprintf("[工具结果 %s: %s]", block.ToolUseID, result))
+		default:
+			return "", fmt.Errorf("不支持的内容块类型 %q", block.Type)
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// toOpenAI 转换为OpenAI格式的请求，之后与 /v1/chat/completions 走相同的转发流程
+// stop_sequences 不传给上游，由 anthropicTranslator 截断：上游遇到停止词时与正常结束一样返回 stop，
+// 无法区分两者，也不返回匹配到的停止词
+func (req AnthropicRequest) toOpenAI() (OpenAIRequest, error) {
+	openAIReq := OpenAIRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stream:      req.Stream,
+		User:        req.Metadata.UserID,
+	}
+	if len(req.System) > 0 {
+		system, err := req.System.Text()
+		if err != nil {
+			return OpenAIRequest{}, fmt.Errorf("system: %v", err)
+		}
+		openAIReq.Messages = append(openAIReq.Messages, Message{Role: "system", Content: system})
+	}
+	for i, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return OpenAIRequest{}, fmt.Errorf("messages[%d].role 只能是 user 或 assistant", i)
+		}
+		content, err := msg.Content.Text()
+		if err != nil {
+			return OpenAIRequest{}, fmt.Errorf("messages[%d]: %v", i, err)
+		}
+		openAIReq.Messages = append(openAIReq.Messages, Message{Role: msg.Role, Content: content})
+	}
+	// 工具定义按OpenAI的functions格式传递（兼容模式下转发给上游，原生API不支持客户端工具）
+	for _, tool := range req.Tools {
+		openAIReq.Functions = append(openAIReq.Functions, map[string]interface{}{
+			"name":        tool.Name,
+			"description": tool.Description,
+			"parameters":  tool.InputSchema,
+		})
+	}
+	return openAIReq, nil
+}
+
+// handleAnthropicMessages 处理Anthropic Messages API请求（/v1/messages）
+func handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	t := &anthropicTranslator{}
+	var req AnthropicRequest
+	if !decodeJSONBody(w, r, t, &req) {
+		return
+	}
+	if len(req.Messages) == 0 {
+		rejectTranslated(w, t, "messages字段不能为空")
+		return
+	}
+	if req.MaxTokens == nil {
+		rejectTranslated(w, t, "max_tokens字段不能为空")
+		return
+	}
+	// 百炼应用的原生API没有客户端工具参数，静默丢弃会让模型当作没有工具来回答，直接拒绝
+	if len(req.Tools) > 0 && currentConfig().UseNative {
+		log.Printf("拒绝请求: 百炼应用原生API不支持客户端工具（%d 个）", len(req.Tools))
+		rejectTranslated(w, t, "原生API模式不支持 tools，请在百炼应用中配置工具，或使用兼容模式")
+		return
+	}
+	openAIReq, err := req.toOpenAI()
+	if err != nil {
+		rejectTranslated(w, t, err.Error())
+		return
+	}
+	t.model = req.Model
+	for _, seq := range req.StopSequences {
+		if seq != "" {
+			t.stopSequences = append(t.stopSequences, seq)
+		}
+	}
+	serveTranslated(w, r, openAIReq, t)
+}
+
+// anthropicTranslator 把OpenAI格式的响应转换为Anthropic Messages格式
+type anthropicTranslator struct {
+	model   string
+	started bool // 已发送 message_start
+	failed  bool // 流中途出错，不再发送结束事件
+
+	stopSequences []string // 请求的 stop_sequences
+	held          string   // 流式输出末尾可能是停止词开头的部分，确定不是停止词后再发送
+	stopSequence  string   // 匹配到的停止词，之后的输出不再发送
+}
+
+// findStopSequence 返回text中最早出现的停止词的位置和停止词，没有时返回-1
+func findStopSequence(text string, stopSequences []string) (int, string) {
+	index, matched := -1, ""
+	for _, seq := range stopSequences {
+		if i := strings.Index(text, seq); i >= 0 && (index < 0 || i < index || (i == index && len(seq) < len(matched))) {
+			index, matched = i, seq
+		}
+	}
+	return index, matched
+}
+
+// filterText 按停止词截断流式输出的文本，返回可以发送给客户端的部分
+func (t *anthropicTranslator) filterText(content string) string {
+	if t.stopSequence != "" {
+		return ""
+	}
+	if len(t.stopSequences) == 0 {
+		return content
+	}
+	text := t.held + content
+	if i, seq := findStopSequence(text, t.stopSequences); i >= 0 {
+		t.stopSequence = seq
+		t.held = ""
+		return text[:i]
+	}
+	// 保留末尾可能是某个停止词开头的最长部分
+	keep := 0
+	for _, seq := range t.stopSequences {
+		for n := min(len(seq)-1, len(text)); n > keep; n-- {
+			if strings.HasPrefix(seq, text[len(text)-n:]) {
+				keep = n
+				break
+			}
+		}
+	}
+	t.held = text[len(text)-keep:]
+	return text[:len(text)-keep]
+}
+
+// stopReason 转换结束原因，匹配到停止词时为 stop_sequence
+func (t *anthropicTranslator) stopReason(finishReason string) (string, interface{}) {
+	if t.stopSequence != "" {
+		return "stop_sequence", t.stopSequence
+	}
+	return anthropicStopReason(finishReason), nil
+}
+
+// anthropicStopReason 把OpenAI的finish_reason转换为Anthropic的stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicErrorType 按状态码确定Anthropic的错误类型
+func anthropicErrorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusUnprocessableEntity:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// anthropicMessageID 生成Anthropic格式的消息ID
+func anthropicMessageID(id string) string {
+	if id == "" {
+		return "msg_" + newRandomID()
+	}
+	return "msg_" + id
+}
+
+func (t *anthropicTranslator) ContentType(stream bool) string {
+	if stream {
+		return "text/event-stream"
+	}
+	return "application/json"
+}
+
+func (t *anthropicTranslator) Response(resp OpenAIResponse) []byte {
+	choice := resp.Choices[0]
+	content := choice.Message.Content
+	if i, seq := findStopSequence(content, t.stopSequences); i >= 0 {
+		content = content[:i]
+		t.stopSequence = seq
+	}
+	stopReason, stopSequence := t.stopReason(choice.FinishReason)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":            anthropicMessageID(resp.ID),
+		"type":          "message",
+		"role":          "assistant",
+		"model":         t.model,
+		"content":       []map[string]interface{}{{"type": "text", "text": content}},
+		"stop_reason":   stopReason,
+		"stop_sequence": stopSequence,
+		"usage": map[string]int{
+			"input_tokens":  resp.Usage.PromptTokens,
+			"output_tokens": resp.Usage.CompletionTokens,
+		},
+	})
+	return body
+}
+
+func (t *anthropicTranslator) Error(statusCode int, errResp OpenAIErrorResponse) (int, []byte) {
+	return statusCode, anthropicErrorJSON(anthropicErrorType(statusCode), errResp.Error.Message)
+}
+
+// anthropicErrorJSON 构建Anthropic格式的错误
+func anthropicErrorJSON(errType, message string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+	return body
+}
+
+// anthropicEvent 构建一个Anthropic格式的SSE事件
+func anthropicEvent(name string, data interface{}) []byte {
+	payload, _ := json.Marshal(data)
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, payload))
+}
+
+func (t *anthropicTranslator) Chunk(chunk openAIChunk) []byte {
+	if t.failed || len(chunk.Choices) == 0 {
+		return nil
+	}
+	var out []byte
+	if !t.started {
+		t.started = true
+		out = append(out, anthropicEvent("message_start", map[string]interface{}{
+			"type": "message_start",
+			"message": map[string]interface{}{
+				"id":            anthropicMessageID(chunk.ID),
+				"type":          "message",
+				"role":          "assistant",
+				"model":         t.model,
+				"content":       []interface{}{},
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"usage":         map[string]int{"input_tokens": 0, "output_tokens": 0},
+			},
+		})...)
+		out = append(out, anthropicEvent("content_block_start", map[string]interface{}{
+			"type":          "content_block_start",
+			"index":         0,
+			"content_block": map[string]string{"type": "text", "text": ""},
+		})...)
+	}
+
+	choice := chunk.Choices[0]
+	text := t.filterText(choice.Delta.Content)
+	if choice.FinishReason != nil && *choice.FinishReason != "error" {
+		// 结束时末尾保留的部分不是停止词，一起发送
+		text += t.held
+		t.held = ""
+	}
+	if text != "" {
+		out = append(out, anthropicEvent("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": text},
+		})...)
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "error" {
+		stopReason, stopSequence := t.stopReason(*choice.FinishReason)
+		usage := map[string]int{"output_tokens": 0}
+		if chunk.Usage != nil {
+			usage = map[string]int{"input_tokens": chunk.Usage.PromptTokens, "output_tokens": chunk.Usage.CompletionTokens}
+		}
+		out = append(out, anthropicEvent("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 0})...)
+		out = append(out, anthropicEvent("message_delta", map[string]interface{}{
+			"type":  "message_delta",
+			"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": stopSequence},
+			"usage": usage,
+		})...)
+		out = append(out, anthropicEvent("message_stop", map[string]string{"type": "message_stop"})...)
+	}
+	return out
+}
+
+func (t *anthropicTranslator) StreamError(errResp OpenAIErrorResponse) []byte {
+	t.failed = true
+	return anthropicEvent("error", json.RawMessage(anthropicErrorJSON("api_error", errResp.Error.Message)))
+}
+
+func (t *anthropicTranslator) StreamDone() []byte {
+	return nil
+}
+
+func (t *anthropicTranslator) Heartbeat() []byte {
+	return anthropicEvent("ping", map[string]string{"type": "ping"})
+}
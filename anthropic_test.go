@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicToOpenAI(t *testing.T) {
+	body := `{
+		"model": "support-bot", "max_tokens": 256, "temperature": 0.2, "stream": true,
+		"system": [{"type": "text", "text": "你是客服助手"}],
+		"stop_sequences": ["###"],
+		"metadata": {"user_id": "u-1"},
+		"messages": [
+			{"role": "user", "content": "查一下订单"},
+			{"role": "assistant", "content": [{"type": "tool_use", "name": "lookup", "input": {"id": 42}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "t1", "content": "已发货"}, {"type": "text", "text": "谢谢"}]}
+		],
+		"tools": [{"name": "lookup", "description": "查询订单", "input_schema": {"type": "object"}}]
+	}`
+	var req AnthropicRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	openAIReq, err := req.toOpenAI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if openAIReq.Model != "support-bot" || *openAIReq.MaxTokens != 256 || *openAIReq.Temperature != 0.2 || !openAIReq.Stream || openAIReq.User != "u-1" {
+		t.Errorf("请求参数 %+v", openAIReq)
+	}
+	// stop_sequences 由translator处理，不传给上游
+	if len(openAIReq.Stop) != 0 {
+		t.Errorf("stop 应为空，得到 %q", openAIReq.Stop)
+	}
+	want := []Message{
+		{Role: "system", Content: "你是客服助手"},
+		{Role: "user", Content: "查一下订单"},
+		{Role: "assistant", Content: `[调用工具 lookup: {"id": 42}]`},
+		{Role: "user", Content: "[工具结果 t1: 已发货]\n谢谢"},
+	}
+	if len(openAIReq.Messages) != len(want) {
+		t.Fatalf("得到 %d 条消息，期望 %d 条", len(openAIReq.Messages), len(want))
+	}
+	for i := range want {
+		if openAIReq.Messages[i] != want[i] {
+			t.Errorf("messages[%d] = %+v，期望 %+v", i, openAIReq.Messages[i], want[i])
+		}
+	}
+	if len(openAIReq.Functions) != 1 {
+		t.Errorf("functions %v", openAIReq.Functions)
+	}
+}
+
+func TestAnthropicToOpenAIErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"system角色的消息", `{"messages":[{"role":"system","content":"hi"}]}`, "messages[0].role 只能是 user 或 assistant"},
+		{"图片内容块", `{"messages":[{"role":"user","content":[{"type":"image"}]}]}`, `messages[0]: 不支持的内容块类型 "image"`},
+		{"system中的图片", `{"system":[{"type":"image"}],"messages":[{"role":"user","content":"hi"}]}`, "system: "},
+	}
+	for _, tt := range tests {
+		var req AnthropicRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := req.toOpenAI(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: 得到 %v，期望包含 %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestAnthropicStopReason(t *testing.T) {
+	tests := map[string]string{
+		"stop":          "end_turn",
+		"length":        "max_tokens",
+		"tool_calls":    "tool_use",
+		"function_call": "tool_use",
+		"":              "end_turn",
+	}
+	for finishReason, want := range tests {
+		if got := anthropicStopReason(finishReason); got != want {
+			t.Errorf("anthropicStopReason(%q) = %q，期望 %q", finishReason, got, want)
+		}
+	}
+}
+
+func TestAnthropicErrorType(t *testing.T) {
+	tests := map[int]string{
+		http.StatusBadRequest:            "invalid_request_error",
+		http.StatusUnauthorized:          "authentication_error",
+		http.StatusForbidden:             "permission_error",
+		http.StatusNotFound:              "not_found_error",
+		http.StatusRequestEntityTooLarge: "request_too_large",
+		http.StatusTooManyRequests:       "rate_limit_error",
+		http.StatusServiceUnavailable:    "overloaded_error",
+		http.StatusBadGateway:            "api_error",
+	}
+	for status, want := range tests {
+		if got := anthropicErrorType(status); got != want {
+			t.Errorf("anthropicErrorType(%d) = %q，期望 %q", status, got, want)
+		}
+	}
+}
+
+func TestAnthropicResponse(t *testing.T) {
+	tests := []struct {
+		name             string
+		stopSequences    []string
+		content          string
+		finishReason     string
+		wantText         string
+		wantStopReason   string
+		wantStopSequence interface{}
+	}{
+		{"正常结束", nil, "你好！", "stop", "你好！", "end_turn", nil},
+		{"达到max_tokens", nil, "你好", "length", "你好", "max_tokens", nil},
+		{"停止词", []string{"###", "END"}, "答案是42。END多余的内容###", "stop", "答案是42。", "stop_sequence", "END"},
+		{"没有出现停止词", []string{"###"}, "你好！", "stop", "你好！", "end_turn", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &anthropicTranslator{model: "claude-compatible", stopSequences: tt.stopSequences}
+			rec := translateResponse(t, tr, http.StatusOK, chatResponse(tt.content, tt.finishReason))
+			resp := decodeJSON(t, rec.Body.String())
+			content := resp["content"].([]interface{})[0].(map[string]interface{})
+			if content["text"] != tt.wantText || resp["stop_reason"] != tt.wantStopReason || resp["stop_sequence"] != tt.wantStopSequence {
+				t.Errorf("text=%q stop_reason=%v stop_sequence=%v", content["text"], resp["stop_reason"], resp["stop_sequence"])
+			}
+			if resp["id"] != "msg_req-1" || resp["model"] != "claude-compatible" || resp["type"] != "message" {
+				t.Errorf("响应 %v", resp)
+			}
+			usage := resp["usage"].(map[string]interface{})
+			if usage["input_tokens"] != 12.0 || usage["output_tokens"] != 5.0 {
+				t.Errorf("usage %v", usage)
+			}
+		})
+	}
+}
+
+func TestAnthropicErrorResponse(t *testing.T) {
+	rec := translateResponse(t, &anthropicTranslator{}, http.StatusTooManyRequests, `{"error":{"message":"slow down","type":"rate_limit_error"}}`)
+	resp := decodeJSON(t, rec.Body.String())
+	errObj := resp["error"].(map[string]interface{})
+	if rec.Code != http.StatusTooManyRequests || resp["type"] != "error" || errObj["type"] != "rate_limit_error" || errObj["message"] != "slow down" {
+		t.Errorf("得到 %d %s", rec.Code, rec.Body)
+	}
+}
+
+// anthropicStreamEvent 转换后的一个SSE事件
+type anthropicStreamEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+// parseAnthropicStream 解析转换后的SSE输出
+func parseAnthropicStream(t *testing.T, out string) []anthropicStreamEvent {
+	t.Helper()
+	var events []anthropicStreamEvent
+	for _, block := range strings.Split(strings.TrimSpace(out), "\n\n") {
+		name, data, _ := strings.Cut(block, "\ndata: ")
+		events = append(events, anthropicStreamEvent{strings.TrimPrefix(name, "event: "), decodeJSON(t, data)})
+	}
+	return events
+}
+
+// streamText 拼接所有 text_delta
+func streamText(events []anthropicStreamEvent) string {
+	var b strings.Builder
+	for _, event := range events {
+		if event.name == "content_block_delta" {
+			b.WriteString(event.data["delta"].(map[string]interface{})["text"].(string))
+		}
+	}
+	return b.String()
+}
+
+func TestAnthropicStream(t *testing.T) {
+	usage := &Usage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17}
+	out := translateStream(t, &anthropicTranslator{model: "claude-compatible"},
+		chunkEvent("你", "", nil),
+		": heartbeat\n\n",
+		chunkEvent("好", "", nil),
+		chunkEvent("", "stop", usage),
+		"data: [DONE]\n\n",
+	)
+	events := parseAnthropicStream(t, out)
+	var names []string
+	for _, event := range events {
+		names = append(names, event.name)
+	}
+	want := "message_start,content_block_start,content_block_delta,ping,content_block_delta,content_block_stop,message_delta,message_stop"
+	if strings.Join(names, ",") != want {
+		t.Fatalf("事件 %s\n期望 %s", strings.Join(names, ","), want)
+	}
+	if got := streamText(events); got != "你好" {
+		t.Errorf("文本 %q", got)
+	}
+	delta := events[6].data
+	if delta["delta"].(map[string]interface{})["stop_reason"] != "end_turn" || delta["usage"].(map[string]interface{})["output_tokens"] != 5.0 {
+		t.Errorf("message_delta %v", delta)
+	}
+}
+
+func TestAnthropicStreamStopSequence(t *testing.T) {
+	tests := []struct {
+		name             string
+		chunks           []string
+		wantText         string
+		wantStopReason   string
+		wantStopSequence interface{}
+	}{
+		{"停止词跨chunk", []string{"答案是42", "。EN", "D后面的内容", "还有更多"}, "答案是42。", "stop_sequence", "END"},
+		{"停止词在一个chunk中", []string{"第一行\n###第二行"}, "第一行\n", "stop_sequence", "###"},
+		{"像停止词开头但不是", []string{"EN", "GLISH"}, "ENGLISH", "end_turn", nil},
+		{"结束时末尾像停止词开头", []string{"结尾是E"}, "结尾是E", "end_turn", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input []string
+			for _, chunk := range tt.chunks {
+				input = append(input, chunkEvent(chunk, "", nil))
+			}
+			input = append(input, chunkEvent("", "stop", &Usage{CompletionTokens: 9}), "data: [DONE]\n\n")
+			tr := &anthropicTranslator{stopSequences: []string{"END", "###"}}
+			events := parseAnthropicStream(t, translateStream(t, tr, input...))
+			if got := streamText(events); got != tt.wantText {
+				t.Errorf("文本 %q，期望 %q", got, tt.wantText)
+			}
+			var delta map[string]interface{}
+			for _, event := range events {
+				if event.name == "message_delta" {
+					delta = event.data["delta"].(map[string]interface{})
+				}
+			}
+			if delta["stop_reason"] != tt.wantStopReason || delta["stop_sequence"] != tt.wantStopSequence {
+				t.Errorf("message_delta %v", delta)
+			}
+		})
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	out := translateStream(t, &anthropicTranslator{},
+		chunkEvent("部分", "", nil),
+		`data: {"error":{"message":"上游中断","type":"api_error"}}`+"\n\n",
+		"data: [DONE]\n\n",
+	)
+	events := parseAnthropicStream(t, out)
+	last := events[len(events)-1]
+	if last.name != "error" || last.data["error"].(map[string]interface{})["message"] != "上游中断" {
+		t.Errorf("最后一个事件 %s %v", last.name, last.data)
+	}
+	for _, event := range events {
+		if event.name == "message_stop" {
+			t.Error("出错后不应发送 message_stop")
+		}
+	}
+}
+
+func TestFindStopSequence(t *testing.T) {
+	tests := []struct {
+		text      string
+		stops     []string
+		wantIndex int
+		wantSeq   string
+	}{
+		{"abc", nil, -1, ""},
+		{"abc###def", []string{"###"}, 3, "###"},
+		{"xENDy###", []string{"###", "END"}, 1, "END"},
+		{"abcd", []string{"bcd", "bc"}, 1, "bc"},
+	}
+	for _, tt := range tests {
+		if i, seq := findStopSequence(tt.text, tt.stops); i != tt.wantIndex || seq != tt.wantSeq {
+			t.Errorf("findStopSequence(%q, %q) = %d %q，期望 %d %q", tt.text, tt.stops, i, seq, tt.wantIndex, tt.wantSeq)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen 熔断器处于打开状态，请求被快速拒绝
+var errCircuitOpen = errors.New("上游服务暂时不可用（熔断中）")
+
+// circuitBreaker 上游熔断器
+// 连续失败（连接错误或5xx）达到阈值后打开，冷却期内直接拒绝请求；
+// 冷却期结束后放行一个试探请求，成功则关闭，失败则重新打开。阈值为0表示不启用
+type circuitBreaker struct {
+	mu            sync.Mutex
+	threshold     int
+	cooldown      time.Duration
+	failures      int
+	openUntil     time.Time
+	halfOpenTrial bool // 半开状态下是否已有试探请求在进行
+}
+
+// upstreamBreaker 全局上游熔断器
+var upstreamBreaker = &circuitBreaker{}
+
+// Configure 设置熔断阈值和冷却时间
+func (cb *circuitBreaker) Configure(threshold int, cooldown time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.threshold = threshold
+	cb.cooldown = cooldown
+}
+
+// Allow 判断是否允许请求通过
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.threshold <= 0 || cb.failures < cb.threshold {
+		return true
+	}
+	if time.Now().Before(cb.openUntil) || cb.halfOpenTrial {
+		return false
+	}
+	cb.halfOpenTrial = true
+	return true
+}
+
+// Record 记录一次请求结果
+func (cb *circuitBreaker) Record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.halfOpenTrial = false
+	if success {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.threshold > 0 && cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// Release 请求没有产生有效结果（如客户端取消）时释放试探名额，不影响计数
+func (cb *circuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.halfOpenTrial = false
+}
+
+// State 返回熔断器状态：disabled / closed / open / half_open
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch {
+	case cb.threshold <= 0:
+		return "disabled"
+	case cb.failures < cb.threshold:
+		return "closed"
+	case time.Now().Before(cb.openUntil):
+		return "open"
+	default:
+		return "half_open"
+	}
+}
+
+// breakerTransport 在Transport层统计上游请求结果的熔断包装
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.Allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && clientCanceled(req.Context()):
+		// 客户端取消不代表上游故障
+		t.breaker.Release()
+	case err != nil:
+		t.breaker.Record(false)
+	default:
+		t.breaker.Record(resp.StatusCode < 500)
+	}
+	return resp, err
+}
+
+// clientCanceled 判断请求是否因客户端断开或服务器关闭而取消
+// 看门狗以超时原因作为cause取消上下文，这类取消说明上游响应过慢，应计为失败
+func clientCanceled(ctx context.Context) bool {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	cause := context.Cause(ctx)
+	return errors.Is(cause, context.Canceled) || errors.Is(cause, errServerShutdown)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// PriceConfig 模型价格（每千token），币种由使用方自行约定，与预算保持一致即可
+type PriceConfig struct {
+	Input       float64 `yaml:"input"`        // 输入每千token的价格
+	Output      float64 `yaml:"output"`       // 输出每千token的价格
+	Image       float64 `yaml:"image"`        // 图片生成模型每张图片的价格
+	AudioSecond float64 `yaml:"audio_second"` // 语音识别模型每秒音频的价格
+}
+
+// SpendBudget 费用预算，0表示不限制
+type SpendBudget struct {
+	Daily   float64 `yaml:"daily" json:"daily,omitempty"`     // 每日预算
+	Monthly float64 `yaml:"monthly" json:"monthly,omitempty"` // 每月预算
+}
+
+// tenantUsageID 租户用量在存储中的标识
+func tenantUsageID(name string) string {
+	return "tenant:" + name
+}
+
+// budgetTarget 需要检查预算的对象（客户端Key或租户）
+type budgetTarget struct {
+	kind    string // 响应头中的类型：api_key / tenant
+	label   string // 错误信息中的名称
+	name    string
+	usageID string
+	budget  SpendBudget
+}
+
+// checkBudgets 检查客户端Key和租户的费用预算
+// 已用完预算时返回原因（拒绝请求）；达到 budget_warn_percent 时返回提醒，通过响应头告知客户端
+func checkBudgets(cfg *Config, ck *clientKey, tenant string) (exceeded string, warnings []string) {
+	var targets []budgetTarget
+	if ck != nil {
+		targets = append(targets, budgetTarget{"api_key", "API Key", ck.Name, ck.ID, ck.Budget})
+	}
+	if t, ok := lookupTenant(cfg, tenant); ok && tenant != "" {
+		targets = append(targets, budgetTarget{"tenant", "租户", tenant, tenantUsageID(tenant), t.Budget})
+	}
+
+	for _, target := range targets {
+		if target.budget == (SpendBudget{}) {
+			continue
+		}
+		today, month := clientStore.UsageSummary(target.usageID)
+		periods := []struct {
+			name   string
+			label  string
+			spent  float64
+			budget float64
+		}{
+			{"daily", "每日", today.Cost, target.budget.Daily},
+			{"monthly", "每月", month.Cost, target.budget.Monthly},
+		}
+		for _, p := range periods {
+			switch {
+			case p.budget <= 0:
+			case p.spent >= p.budget:
+				return fmt.Sprintf("%s %s 已达到%s费用预算（%.2f）", target.label, target.name, p.label, p.budget), nil
+			case cfg.BudgetWarnPercent > 0 && p.spent >= p.budget*float64(cfg.BudgetWarnPercent)/100:
+				warnings = append(warnings, fmt.Sprintf("%s=%s; period=%s; spent=%.4f; budget=%.2f",
+					target.kind, target.name, p.name, p.spent, p.budget))
+			}
+		}
+	}
+	return "", warnings
+}
+
+// meterRequest 检查费用预算后处理请求，请求结束后把用量和估算的费用计入客户端Key和租户
+func meterRequest(w http.ResponseWriter, r *http.Request, cfg *Config, ck *clientKey, tenant string, next http.HandlerFunc) {
+	exceeded, warnings := checkBudgets(cfg, ck, tenant)
+	if exceeded != "" && !isTaskPoll(r) {
+		log.Printf("费用预算不足: %s", exceeded)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write(openAIErrorJSON("insufficient_quota", "budget_exceeded", exceeded))
+		return
+	}
+	for _, warning := range warnings {
+		w.Header().Add("X-Budget-Warning", warning)
+	}
+
+	r, usage := withRequestUsage(r)
+	rec := &statusRecorder{ResponseWriter: w}
+	next(rec, r)
+
+	// 被拒绝或失败的请求和任务查询不计入请求次数，但已产生的token和费用仍然计入
+	input, output := usage.Tokens()
+	counter := usageCounter{InputTokens: int64(input), OutputTokens: int64(output), Cost: usage.Cost(cfg.Prices)}
+	if rec.Status() < http.StatusBadRequest && !isTaskPoll(r) {
+		counter.Requests = 1
+	}
+	if counter == (usageCounter{}) {
+		return
+	}
+	if ck != nil {
+		clientStore.RecordUsage(ck.ID, counter)
+	}
+	if tenant != "" {
+		clientStore.RecordUsage(tenantUsageID(tenant), counter)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedAnswer 一次完整的回答，缓存后可以按非流式或流式重放
+type cachedAnswer struct {
+	RequestID    string
+	Text         string
+	FinishReason string
+	InputTokens  int
+	OutputTokens int
+	Models       []modelTokens // 上游返回的各模型用量，合并的请求按它计费
+}
+
+// answerCapture 记录请求最终得到的完整回答，由各处理函数在上游正常结束时更新
+type answerCapture struct {
+	mu     sync.Mutex
+	answer *cachedAnswer
+	flight *flight // 合并了相同请求时，流式输出的进度同时转发给订阅者
+}
+
+// answerCaptureKey 请求上下文中保存回答记录的键
+type answerCaptureKey struct{}
+
+// withAnswerCapture 在请求上下文中创建回答记录，f不为nil时当前请求负责为合并的请求调用上游
+func withAnswerCapture(r *http.Request, f *flight) (*http.Request, *answerCapture) {
+	capture := &answerCapture{flight: f}
+	return r.WithContext(context.WithValue(r.Context(), answerCaptureKey{}, capture)), capture
+}
+
+// requestAnswerCapture 返回请求上下文中的回答记录，没有时返回nil
+func requestAnswerCapture(ctx context.Context) *answerCapture {
+	capture, _ := ctx.Value(answerCaptureKey{}).(*answerCapture)
+	return capture
+}
+
+// reportAnswer 记录上游返回的完整回答（原生API的文本是累计值，传入最后一个事件即可）
+func reportAnswer(ctx context.Context, nativeResp AliyunNativeResponse) {
+	capture := requestAnswerCapture(ctx)
+	if capture == nil {
+		return
+	}
+	answer := &cachedAnswer{
+		RequestID:    nativeResp.RequestID,
+		Text:         nativeResp.Output.Text,
+		FinishReason: nativeResp.Output.FinishReason,
+	}
+	if answer.FinishReason == "" || answer.FinishReason == "null" {
+		answer.FinishReason = "stop"
+	}
+	for _, m := range nativeResp.Usage.Models {
+		answer.InputTokens += m.InputTokens
+		answer.OutputTokens += m.OutputTokens
+		answer.Models = append(answer.Models, modelTokens{ModelID: m.ModelID, InputTokens: m.InputTokens, OutputTokens: m.OutputTokens})
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	capture.answer = answer
+}
+
+// Answer 返回记录的回答，上游没有正常结束时返回nil
+func (c *answerCapture) Answer() *cachedAnswer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.answer
+}
+
+// cacheEntry 缓存中的一条回答
+type cacheEntry struct {
+	key      string
+	answer   cachedAnswer
+	storedAt time.Time
+	expires  time.Time
+	size     int
+}
+
+// lruCache 按最近使用淘汰的回答缓存，同时限制条数和总大小
+type lruCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // 队首为最近使用
+	bytes   int
+}
+
+// responseCache 全局响应缓存
+var responseCache = &lruCache{entries: make(map[string]*list.Element), order: list.New()}
+
+// Get 查找未过期的回答，返回回答和已缓存的时长
+func (c *lruCache) Get(key string) (cachedAnswer, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return cachedAnswer{}, 0, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(elem)
+		return cachedAnswer{}, 0, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.answer, time.Since(entry.storedAt), true
+}
+
+// Put 保存回答，超出条数或大小限制时淘汰最久未使用的回答
+func (c *lruCache) Put(key string, answer cachedAnswer, ttl time.Duration, maxEntries, maxBytes int) {
+	size := len(key) + len(answer.RequestID) + len(answer.Text) + len(answer.FinishReason) + 64
+	if maxBytes > 0 && size > maxBytes {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+	entry := &cacheEntry{key: key, answer: answer, storedAt: now, expires: now.Add(ttl), size: size}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += size
+	for c.order.Len() > 0 && ((maxEntries > 0 && c.order.Len() > maxEntries) || (maxBytes > 0 && c.bytes > maxBytes)) {
+		c.removeLocked(c.order.Back())
+		cacheMetrics.Add("evictions", 1)
+	}
+}
+
+func (c *lruCache) removeLocked(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// Len 返回缓存的条数
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// deterministicRequest 判断请求是否是确定性的（temperature为0），只有这样的请求才会被缓存
+// temperature可能来自客户端（float64）或租户默认参数（YAML中的整数）；
+// 带session_id的请求依赖上游保存的对话历史，不是确定性的
+func deterministicRequest(nativeReq AliyunNativeRequest) bool {
+	if _, ok := nativeReq.Input["session_id"]; ok {
+		return false
+	}
+	switch t := nativeReq.Parameters["temperature"].(type) {
+	case float64:
+		return t == 0
+	case int:
+		return t == 0
+	}
+	return false
+}
+
+// requestCacheKey 根据租户、上游应用和转换后的请求内容计算缓存键
+// 原生请求的input和parameters已经是规范化的结果（JSON序列化时map按键排序），与是否流式无关
+func requestCacheKey(tenant string, route upstreamRoute, nativeReq AliyunNativeRequest) string {
+	normalized, _ := json.Marshal(struct {
+		Tenant     string                 `json:"tenant"`
+		AppID      string                 `json:"app_id"`
+		Workspace  string                 `json:"workspace"`
+		Input      map[string]interface{} `json:"input"`
+		Parameters map[string]interface{} `json:"parameters"`
+	}{tenant, route.AppID, route.Workspace, nativeReq.Input, nativeReq.Parameters})
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheDirectives 根据客户端的 Cache-Control 请求头决定是否读取和写入缓存
+// no-cache：不使用缓存的回答，但保存新的回答；no-store：既不读取也不保存
+func cacheDirectives(r *http.Request) (lookup, store bool) {
+	lookup, store = true, true
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			lookup = false
+		case "no-store":
+			lookup, store = false, false
+		}
+	}
+	return lookup, store
+}
+
+// storeAnswer 请求结束后保存上游正常返回的回答
+func storeAnswer(key string, capture *answerCapture) {
+	answer := capture.Answer()
+	if answer == nil {
+		return
+	}
+	cfg := currentConfig()
+	responseCache.Put(key, *answer, time.Duration(cfg.ResponseCacheTTL)*time.Second, cfg.ResponseCacheMaxEntries, cfg.ResponseCacheMaxMB*1024*1024)
+	cacheMetrics.Add("stores", 1)
+}
+
+// usage 回答的token用量（OpenAI格式）
+func (a cachedAnswer) usage() Usage {
+	return Usage{
+		PromptTokens:     a.InputTokens,
+		CompletionTokens: a.OutputTokens,
+		TotalTokens:      a.InputTokens + a.OutputTokens,
+	}
+}
+
+// writeCachedAnswer 返回缓存的回答，客户端请求流式输出时以SSE重放
+// 命中缓存时没有调用上游，不计入客户端Key的token用量和费用
+func writeCachedAnswer(w http.ResponseWriter, answer cachedAnswer, model string, stream bool, age time.Duration) {
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if !stream {
+		writeAnswer(w, answer, model)
+		return
+	}
+
+	sw := newSSEWriter(w)
+	defer sw.Close()
+	created := time.Now().Unix()
+	if answer.Text != "" {
+		if err := sw.WriteData(answerChunk(answer.RequestID, model, created, map[string]interface{}{"content": answer.Text}, nil)); err != nil {
+			log.Printf("写入响应失败: %v", err)
+			return
+		}
+	}
+	finalChunk := answerChunkMap(answer.RequestID, model, created, map[string]interface{}{}, answer.FinishReason)
+	finalChunk["usage"] = answer.usage()
+	finalJSON, _ := json.Marshal(finalChunk)
+	sw.WriteData(finalJSON)
+	sw.Write([]byte("data: [DONE]\n\n"))
+}
+
+// writeAnswer 以非流式的OpenAI格式返回完整回答
+func writeAnswer(w http.ResponseWriter, answer cachedAnswer, model string) {
+	body, _ := json.Marshal(OpenAIResponse{
+		ID:      answer.RequestID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []Choice{{
+			Index:        0,
+			Message:      Message{Role: "assistant", Content: answer.Text},
+			FinishReason: answer.FinishReason,
+		}},
+		Usage: answer.usage(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// answerChunkMap 构建OpenAI格式的流式chunk
+func answerChunkMap(id, model string, created int64, delta map[string]interface{}, finishReason interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []map[string]interface{}{
+			{"index": 0, "delta": delta, "finish_reason": finishReason},
+		},
+	}
+}
+
+// answerChunk 构建OpenAI格式的流式chunk并序列化
+func answerChunk(id, model string, created int64, delta map[string]interface{}, finishReason interface{}) []byte {
+	chunk, _ := json.Marshal(answerChunkMap(id, model, created, delta, finishReason))
+	return chunk
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeterministicRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		req  AliyunNativeRequest
+		want bool
+	}{
+		{"客户端temperature为0", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi"}, Parameters: map[string]interface{}{"temperature": 0.0}}, true},
+		{"租户默认参数中的整数0", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi"}, Parameters: map[string]interface{}{"temperature": 0}}, true},
+		{"temperature不为0", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi"}, Parameters: map[string]interface{}{"temperature": 0.7}}, false},
+		{"整数1", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi"}, Parameters: map[string]interface{}{"temperature": 1}}, false},
+		{"没有temperature", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi"}}, false},
+		{"temperature为字符串", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi"}, Parameters: map[string]interface{}{"temperature": "0"}}, false},
+		{"带session_id", AliyunNativeRequest{Input: map[string]interface{}{"prompt": "hi", "session_id": "s1"}, Parameters: map[string]interface{}{"temperature": 0.0}}, false},
+	}
+	for _, tt := range tests {
+		if got := deterministicRequest(tt.req); got != tt.want {
+			t.Errorf("%s: 得到 %v，期望 %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequestCacheKey(t *testing.T) {
+	route := upstreamRoute{AppID: "app-1", APIKey: "sk-a", Workspace: "ws-1"}
+	base := func() AliyunNativeRequest {
+		return AliyunNativeRequest{
+			Input:      map[string]interface{}{"prompt": "你好", "messages": []interface{}{map[string]interface{}{"role": "user", "content": "你好"}}},
+			Parameters: map[string]interface{}{"temperature": 0.0, "max_tokens": 100.0},
+		}
+	}
+	key := requestCacheKey("acme", route, base())
+	if len(key) != 64 {
+		t.Fatalf("缓存键 %q 不是sha256十六进制", key)
+	}
+
+	// 参数的插入顺序、是否流式、上游Key不影响缓存键
+	reordered := AliyunNativeRequest{
+		Input:      map[string]interface{}{"messages": base().Input["messages"], "prompt": "你好"},
+		Parameters: map[string]interface{}{"max_tokens": 100.0, "temperature": 0.0},
+		Debug:      map[string]interface{}{"trace": true},
+	}
+	otherKey := route
+	otherKey.APIKey = "sk-b"
+	if got := requestCacheKey("acme", otherKey, reordered); got != key {
+		t.Errorf("相同的请求得到不同的缓存键")
+	}
+
+	tests := []struct {
+		name   string
+		tenant string
+		route  upstreamRoute
+		mutate func(req *AliyunNativeRequest)
+	}{
+		{"不同租户", "other", route, func(req *AliyunNativeRequest) {}},
+		{"不同应用", "acme", upstreamRoute{AppID: "app-2", Workspace: "ws-1"}, func(req *AliyunNativeRequest) {}},
+		{"不同业务空间", "acme", upstreamRoute{AppID: "app-1", Workspace: "ws-2"}, func(req *AliyunNativeRequest) {}},
+		{"不同输入", "acme", route, func(req *AliyunNativeRequest) { req.Input["prompt"] = "再见" }},
+		{"不同参数", "acme", route, func(req *AliyunNativeRequest) { req.Parameters["max_tokens"] = 200.0 }},
+	}
+	for _, tt := range tests {
+		req := base()
+		tt.mutate(&req)
+		if got := requestCacheKey(tt.tenant, tt.route, req); got == key {
+			t.Errorf("%s: 缓存键不应相同", tt.name)
+		}
+	}
+}
+
+func TestCacheDirectives(t *testing.T) {
+	tests := []struct {
+		header      string
+		lookup, put bool
+	}{
+		{"", true, true},
+		{"no-cache", false, true},
+		{"No-Store", false, false},
+		{"max-age=0, no-cache", false, true},
+		{"no-cache, no-store", false, false},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		r.Header.Set("Cache-Control", tt.header)
+		if lookup, put := cacheDirectives(r); lookup != tt.lookup || put != tt.put {
+			t.Errorf("Cache-Control %q: 得到 %v/%v，期望 %v/%v", tt.header, lookup, put, tt.lookup, tt.put)
+		}
+	}
+}
+
+func newTestCache() *lruCache {
+	return &lruCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newTestCache()
+	c.Put("a", cachedAnswer{Text: "A"}, time.Minute, 2, 0)
+	c.Put("b", cachedAnswer{Text: "B"}, time.Minute, 2, 0)
+	c.Get("a") // a变为最近使用
+	c.Put("c", cachedAnswer{Text: "C"}, time.Minute, 2, 0)
+	if _, _, ok := c.Get("b"); ok {
+		t.Error("最久未使用的b应被淘汰")
+	}
+	for _, key := range []string{"a", "c"} {
+		if answer, _, ok := c.Get(key); !ok || answer.Text != strings.ToUpper(key) {
+			t.Errorf("%s 应在缓存中", key)
+		}
+	}
+
+	// 按总大小淘汰，超过上限的单条回答不缓存
+	c = newTestCache()
+	c.Put("a", cachedAnswer{Text: strings.Repeat("x", 100)}, time.Minute, 0, 400)
+	c.Put("b", cachedAnswer{Text: strings.Repeat("y", 100)}, time.Minute, 0, 400)
+	c.Put("c", cachedAnswer{Text: strings.Repeat("z", 200)}, time.Minute, 0, 400)
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("超出大小上限时a应被淘汰")
+	}
+	c.Put("huge", cachedAnswer{Text: strings.Repeat("h", 1000)}, time.Minute, 0, 400)
+	if _, _, ok := c.Get("huge"); ok {
+		t.Error("超过大小上限的回答不应缓存")
+	}
+	if c.bytes > 400 {
+		t.Errorf("缓存大小 %d 超过上限", c.bytes)
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := newTestCache()
+	c.Put("a", cachedAnswer{Text: "A"}, -time.Second, 0, 0)
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("过期的回答不应返回")
+	}
+	if c.Len() != 0 {
+		t.Errorf("过期的回答应被移除，剩余 %d 条", c.Len())
+	}
+
+	// 重复保存同一个键时替换旧的回答
+	c.Put("a", cachedAnswer{Text: "old"}, time.Minute, 0, 0)
+	c.Put("a", cachedAnswer{Text: "new"}, time.Minute, 0, 0)
+	if answer, _, _ := c.Get("a"); answer.Text != "new" || c.Len() != 1 {
+		t.Errorf("得到 %q（%d 条），期望只有新的回答", answer.Text, c.Len())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxFlightErrorBytes 上游调用失败时保存的错误响应的最大字节数
+const maxFlightErrorBytes = 64 * 1024
+
+// flightFailure 上游调用在输出任何内容之前失败时的错误响应，原样返回给所有订阅者
+type flightFailure struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// flight 一个正在进行的上游请求，相同的请求到达时订阅它的结果而不是再调用一次上游
+// 上游调用在后台进行，使用不属于任何客户端的上下文，所有订阅者都离开后才取消
+type flight struct {
+	mu        sync.Mutex
+	key       string
+	requestID string
+	text      string         // 到目前为止的累计文本
+	answer    *cachedAnswer  // 上游正常结束后的完整回答
+	failure   *flightFailure // 上游调用失败时的错误响应
+	done      bool
+	changed   chan struct{} // 每次更新时关闭并替换，用于通知订阅者
+
+	ctx     context.Context    // 上游调用的上下文
+	cancel  context.CancelFunc // 所有订阅者离开时取消上游调用
+	waiters int                // 订阅者数量，由flightGroup的锁保护
+}
+
+// flightGroup 按请求键记录正在进行的上游请求
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// inflight 全局的进行中请求表
+var inflight = &flightGroup{flights: make(map[string]*flight)}
+
+// Join 订阅相同请求的flight，没有时创建新的flight，返回值表示是否由当前请求负责发起上游调用
+// 上游调用的上下文保留parent中的值（客户端Key、租户等），但不随parent取消；
+// 用量由每个订阅者按收到的回答各自计入，上游调用本身不计入发起者的用量
+func (g *flightGroup) Join(key string, parent context.Context) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		return f, false
+	}
+	ctx := context.WithValue(context.WithoutCancel(parent), requestUsageKey{}, (*requestUsage)(nil))
+	ctx, cancel := context.WithCancel(ctx)
+	f := &flight{key: key, changed: make(chan struct{}), ctx: ctx, cancel: cancel, waiters: 1}
+	g.flights[key] = f
+	return f, true
+}
+
+// Leave 订阅者离开，最后一个订阅者离开时取消还在进行的上游调用
+// 被取消的flight立即移出表，之后到达的相同请求会重新发起调用
+func (g *flightGroup) Leave(f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	if g.flights[f.key] == f {
+		delete(g.flights, f.key)
+	}
+	f.cancel()
+}
+
+// Finish 上游请求结束，answer为nil表示请求失败或被截断
+func (g *flightGroup) Finish(f *flight, answer *cachedAnswer, failure *flightFailure) {
+	g.mu.Lock()
+	if g.flights[f.key] == f {
+		delete(g.flights, f.key)
+	}
+	g.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answer = answer
+	f.failure = failure
+	if answer != nil {
+		f.requestID = answer.RequestID
+		f.text = answer.Text
+	}
+	f.done = true
+	close(f.changed)
+}
+
+// runFlight 在后台发起上游调用，输出只用于驱动flight，客户端的响应由各订阅者的 Follow 写出
+func runFlight(f *flight, store bool, forward func(w http.ResponseWriter, r *http.Request), r *http.Request) {
+	defer f.cancel()
+	fr, capture := withAnswerCapture(r.WithContext(f.ctx), f)
+	rec := &flightRecorder{header: http.Header{}}
+	forward(rec, fr)
+	// 先写入缓存再结束flight，之后到达的相同请求能直接命中缓存
+	if store {
+		storeAnswer(f.key, capture)
+	}
+	inflight.Finish(f, capture.Answer(), rec.failure())
+}
+
+// flightRecorder 后台上游调用的ResponseWriter，只保留失败时的错误响应
+type flightRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *flightRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *flightRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *flightRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= http.StatusBadRequest && rec.body.Len() < maxFlightErrorBytes {
+		rec.body.Write(b[:min(len(b), maxFlightErrorBytes-rec.body.Len())])
+	}
+	return len(b), nil
+}
+
+// failure 返回上游调用的错误响应，成功（包括流中途截断）时返回nil
+func (rec *flightRecorder) failure() *flightFailure {
+	if rec.status < http.StatusBadRequest {
+		return nil
+	}
+	return &flightFailure{status: rec.status, contentType: rec.header.Get("Content-Type"), body: rec.body.Bytes()}
+}
+
+// publish 更新累计文本并通知订阅者
+func (f *flight) publish(requestID, text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done || len(text) <= len(f.text) {
+		return
+	}
+	if requestID != "" {
+		f.requestID = requestID
+	}
+	f.text = text
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// snapshot 返回当前状态和下一次更新的通知通道
+func (f *flight) snapshot() (requestID, text string, answer *cachedAnswer, failure *flightFailure, done bool, changed <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requestID, f.text, f.answer, f.failure, f.done, f.changed
+}
+
+// reportProgress 记录流式输出到目前为止的累计文本，转发给订阅了同一请求的其他客户端
+func reportProgress(ctx context.Context, nativeResp AliyunNativeResponse) {
+	if capture := requestAnswerCapture(ctx); capture != nil && capture.flight != nil {
+		capture.flight.publish(nativeResp.RequestID, nativeResp.Output.Text)
+	}
+}
+
+// reportFlightAnswer 把共享调用的回答计入当前客户端的用量，合并的请求同样受配额和预算约束
+func reportFlightAnswer(ctx context.Context, answer *cachedAnswer) {
+	if len(answer.Models) > 0 {
+		reportTokens(ctx, answer.Models...)
+		return
+	}
+	reportTokens(ctx, modelTokens{InputTokens: answer.InputTokens, OutputTokens: answer.OutputTokens})
+}
+
+// Follow 等待flight的结果并返回给客户端，流式请求实时转发上游的输出
+// 发起上游调用的请求也通过 Follow 返回结果；leader为false时响应带有 X-Coalesced 头
+func (f *flight) Follow(w http.ResponseWriter, r *http.Request, model string, stream, leader bool) {
+	defer inflight.Leave(f)
+	if !leader {
+		coalesceMetrics.Add("followers", 1)
+		log.Printf("合并到进行中的相同请求")
+		w.Header().Set("X-Coalesced", "true")
+	}
+	created := time.Now().Unix()
+
+	if !stream {
+		for {
+			_, _, answer, failure, done, changed := f.snapshot()
+			if done {
+				switch {
+				case answer != nil:
+					reportFlightAnswer(r.Context(), answer)
+					writeAnswer(w, *answer, model)
+				case failure != nil:
+					w.Header().Set("Content-Type", failure.contentType)
+					w.WriteHeader(failure.status)
+					w.Write(failure.body)
+				default:
+					writeOpenAIError(w, http.StatusBadGateway, "api_error", "合并的上游请求失败")
+				}
+				return
+			}
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	// 与直接调用上游的流式请求一样：空闲时发送心跳，并受首包和空闲超时约束
+	sw := newSSEWriter(w)
+	defer sw.Close()
+	sw.StartHeartbeat(time.Duration(currentConfig().StreamHeartbeatInterval) * time.Second)
+	wd, ctx := newStreamWatchdogFromConfig(r.Context())
+	defer wd.Stop()
+
+	var sent string
+	for {
+		requestID, text, answer, failure, done, changed := f.snapshot()
+		if len(text) > len(sent) {
+			wd.Reset()
+			if err := sw.WriteData(answerChunk(requestID, model, created, map[string]interface{}{"content": text[len(sent):]}, nil)); err != nil {
+				log.Printf("写入响应失败: %v", err)
+				return
+			}
+			sent = text
+		}
+		if done {
+			if answer == nil {
+				if failure != nil {
+					failStream(sw, failure.status, failure.body, requestID, model, created)
+				} else {
+					failStream(sw, http.StatusBadGateway, openAIErrorJSON("api_error", "", "合并的上游请求失败"), requestID, model, created)
+				}
+				return
+			}
+			reportFlightAnswer(r.Context(), answer)
+			finalChunk := answerChunkMap(requestID, model, created, map[string]interface{}{}, answer.FinishReason)
+			finalChunk["usage"] = answer.usage()
+			finalJSON, _ := json.Marshal(finalChunk)
+			sw.WriteData(finalJSON)
+			sw.Write([]byte("data: [DONE]\n\n"))
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			statusCode, errType, message, reason := classifyStreamError(r.Context(), wd, ctx.Err())
+			log.Printf("合并的流式请求中断: %s", reason)
+			recordStreamTruncated(reason)
+			if errType != "" {
+				failStream(sw, statusCode, openAIErrorJSON(errType, "", message), requestID, model, created)
+			}
+			return
+		}
+	}
+}
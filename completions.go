@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CompletionRequest OpenAI旧版文本补全（/v1/completions）请求格式
+type CompletionRequest struct {
+	Model            string           `json:"model"`
+	Prompt           completionPrompt `json:"prompt"`
+	Suffix           string           `json:"suffix"`
+	MaxTokens        *int             `json:"max_tokens"`
+	Temperature      *float64         `json:"temperature"`
+	TopP             *float64         `json:"top_p"`
+	PresencePenalty  *float64         `json:"presence_penalty"`
+	FrequencyPenalty *float64         `json:"frequency_penalty"`
+	Stop             completionStop   `json:"stop"`
+	Stream           bool             `json:"stream"`
+	Echo             bool             `json:"echo"`
+	N                *int             `json:"n"`
+	BestOf           *int             `json:"best_of"`
+	Logprobs         *int             `json:"logprobs"`
+	User             string           `json:"user"`
+}
+
+// completionPrompt 字符串，或只包含一个字符串的数组
+type completionPrompt string
+
+func (p *completionPrompt) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*p = completionPrompt(text)
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return fmt.Errorf("prompt 必须是字符串，不支持token数组")
+	}
+	if len(texts) != 1 {
+		return fmt.Errorf("prompt 数组只支持一个元素，收到 %d 个", len(texts))
+	}
+	*p = completionPrompt(texts[0])
+	return nil
+}
+
+// completionStop 字符串或字符串数组
+type completionStop []string
+
+func (s *completionStop) UnmarshalJSON(data []byte) error {
+	// null 等同于省略该字段，不能当作空字符串
+	if string(data) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*s = completionStop{text}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return fmt.Errorf("stop 必须是字符串或字符串数组")
+	}
+	*s = texts
+	return nil
+}
+
+// toOpenAI 转换为OpenAI格式的请求：prompt作为唯一的user消息，上游收到的是 input.prompt
+func (req CompletionRequest) toOpenAI() (OpenAIRequest, error) {
+	switch {
+	case req.Suffix != "":
+		return OpenAIRequest{}, fmt.Errorf("百炼应用不支持 suffix（插入补全）")
+	case req.N != nil && *req.N > 1:
+		return OpenAIRequest{}, fmt.Errorf("n 只支持 1")
+	case req.BestOf != nil && *req.BestOf > 1:
+		return OpenAIRequest{}, fmt.Errorf("best_of 只支持 1")
+	case req.Logprobs != nil && *req.Logprobs > 0:
+		return OpenAIRequest{}, fmt.Errorf("百炼应用不返回 logprobs")
+	}
+	return OpenAIRequest{
+		Model:            req.Model,
+		Messages:         []Message{{Role: "user", Content: string(req.Prompt)}},
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		MaxTokens:        req.MaxTokens,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Stop:             req.Stop,
+		Stream:           req.Stream,
+		User:             req.User,
+	}, nil
+}
+
+// handleCompletions 处理OpenAI旧版文本补全请求（/v1/completions）
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	t := &completionTranslator{created: time.Now().Unix()}
+	var req CompletionRequest
+	if !decodeJSONBody(w, r, t, &req) {
+		return
+	}
+	if req.Prompt == "" {
+		rejectTranslated(w, t, "prompt字段不能为空")
+		return
+	}
+	openAIReq, err := req.toOpenAI()
+	if err != nil {
+		rejectTranslated(w, t, err.Error())
+		return
+	}
+	if req.Echo {
+		t.echo = string(req.Prompt)
+	}
+	serveTranslated(w, r, openAIReq, t)
+}
+
+// completionTranslator 把Chat Completions格式的响应转换为 text_completion 格式
+// 错误响应本身就是OpenAI格式，原样返回
+type completionTranslator struct {
+	created int64
+	echo    string // echo=true 时在输出前加上的prompt
+	echoed  bool
+}
+
+// completion 构建一个 text_completion 对象
+func (t *completionTranslator) completion(id, model, text string, finishReason interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      id,
+		"object":  "text_completion",
+		"created": t.created,
+		"model":   model,
+		"choices": []map[string]interface{}{
+			{
+				"text":          text,
+				"index":         0,
+				"logprobs":      nil,
+				"finish_reason": finishReason,
+			},
+		},
+	}
+}
+
+func (t *completionTranslator) ContentType(stream bool) string {
+	if stream {
+		return "text/event-stream"
+	}
+	return "application/json"
+}
+
+func (t *completionTranslator) Response(resp OpenAIResponse) []byte {
+	choice := resp.Choices[0]
+	completion := t.completion(resp.ID, resp.Model, t.echo+choice.Message.Content, choice.FinishReason)
+	completion["usage"] = resp.Usage
+	body, _ := json.Marshal(completion)
+	return body
+}
+
+func (t *completionTranslator) Error(statusCode int, errResp OpenAIErrorResponse) (int, []byte) {
+	body, _ := json.Marshal(errResp)
+	return statusCode, body
+}
+
+func (t *completionTranslator) Chunk(chunk openAIChunk) []byte {
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+	text := choice.Delta.Content
+	if !t.echoed {
+		t.echoed = true
+		text = t.echo + text
+	}
+	if text == "" && choice.FinishReason == nil {
+		return nil
+	}
+	var finishReason interface{}
+	if choice.FinishReason != nil {
+		finishReason = *choice.FinishReason
+	}
+	completion := t.completion(chunk.ID, chunk.Model, text, finishReason)
+	if chunk.Usage != nil {
+		completion["usage"] = chunk.Usage
+	}
+	data, _ := json.Marshal(completion)
+	return []byte(fmt.Sprintf("data: %s\n\n", data))
+}
+
+func (t *completionTranslator) StreamError(errResp OpenAIErrorResponse) []byte {
+	data, _ := json.Marshal(errResp)
+	return []byte(fmt.Sprintf("data: %s\n\n", data))
+}
+
+func (t *completionTranslator) StreamDone() []byte {
+	return []byte("data: [DONE]\n\n")
+}
+
+func (t *completionTranslator) Heartbeat() []byte {
+	return []byte(": ping\n\n")
+}
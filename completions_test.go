@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompletionRequestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantPrompt string
+		wantStop   []string
+		wantErr    string
+	}{
+		{"字符串", `{"prompt":"你好","stop":"\n"}`, "你好", []string{"\n"}, ""},
+		{"数组", `{"prompt":["你好"],"stop":["。","！"]}`, "你好", []string{"。", "！"}, ""},
+		{"null", `{"prompt":null,"stop":null}`, "", nil, ""},
+		{"多个prompt", `{"prompt":["a","b"]}`, "", nil, "prompt 数组只支持一个元素，收到 2 个"},
+		{"token数组", `{"prompt":[1,2,3]}`, "", nil, "prompt 必须是字符串"},
+		{"stop类型错误", `{"prompt":"hi","stop":42}`, "", nil, "stop 必须是字符串或字符串数组"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req CompletionRequest
+			err := json.Unmarshal([]byte(tt.body), &req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("得到 %v，期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(req.Prompt) != tt.wantPrompt || mustJSON(req.Stop) != mustJSON(completionStop(tt.wantStop)) {
+				t.Errorf("prompt=%q stop=%q", req.Prompt, req.Stop)
+			}
+		})
+	}
+}
+
+func TestCompletionToOpenAI(t *testing.T) {
+	var req CompletionRequest
+	if err := json.Unmarshal([]byte(`{"model":"qwen","prompt":"写一首诗","max_tokens":32,"stop":"。","n":1,"best_of":1,"logprobs":0,"user":"u-1"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	openAIReq, err := req.toOpenAI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(openAIReq.Messages) != 1 || openAIReq.Messages[0] != (Message{Role: "user", Content: "写一首诗"}) {
+		t.Errorf("messages %+v", openAIReq.Messages)
+	}
+	if openAIReq.Model != "qwen" || *openAIReq.MaxTokens != 32 || len(openAIReq.Stop) != 1 || openAIReq.User != "u-1" {
+		t.Errorf("请求参数 %+v", openAIReq)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"suffix", `{"prompt":"a","suffix":"b"}`, "不支持 suffix"},
+		{"n大于1", `{"prompt":"a","n":2}`, "n 只支持 1"},
+		{"best_of大于1", `{"prompt":"a","best_of":3}`, "best_of 只支持 1"},
+		{"logprobs", `{"prompt":"a","logprobs":5}`, "不返回 logprobs"},
+	}
+	for _, tt := range tests {
+		var req CompletionRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := req.toOpenAI(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: 得到 %v，期望包含 %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHandleCompletionsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"没有prompt", `{"model":"qwen"}`, "prompt字段不能为空"},
+		{"不支持的参数", `{"prompt":"a","n":2}`, "n 只支持 1"},
+		{"请求格式错误", `{"prompt":`, "请求格式错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleCompletions(w, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("得到 %d %s，期望包含 %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletionResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		echo string
+		want string
+	}{
+		{"普通", "", "你好！"},
+		{"echo", "问候：", "问候：你好！"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := translateResponse(t, &completionTranslator{created: 1718000000, echo: tt.echo}, http.StatusOK, chatResponse("你好！", "length"))
+			resp := decodeJSON(t, rec.Body.String())
+			choice := resp["choices"].([]interface{})[0].(map[string]interface{})
+			if resp["object"] != "text_completion" || choice["text"] != tt.want || choice["finish_reason"] != "length" {
+				t.Errorf("响应 %v", resp)
+			}
+			if usage := resp["usage"].(map[string]interface{}); usage["total_tokens"] != 17.0 {
+				t.Errorf("usage %v", usage)
+			}
+		})
+	}
+
+	// 错误响应原样返回
+	errBody := `{"error":{"message":"模型不存在","type":"invalid_request_error"}}`
+	rec := translateResponse(t, &completionTranslator{}, http.StatusNotFound, errBody)
+	if rec.Code != http.StatusNotFound || decodeJSON(t, rec.Body.String())["error"].(map[string]interface{})["message"] != "模型不存在" {
+		t.Errorf("错误响应 %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCompletionStream(t *testing.T) {
+	out := translateStream(t, &completionTranslator{echo: "问："},
+		chunkEvent("", "", nil),
+		chunkEvent("答", "", nil),
+		chunkEvent("", "stop", &Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}),
+		"data: [DONE]\n\n",
+	)
+	blocks := strings.Split(strings.TrimSpace(out), "\n\n")
+	if len(blocks) != 4 || blocks[3] != "data: [DONE]" {
+		t.Fatalf("得到 %d 个事件:\n%s", len(blocks), out)
+	}
+	var text string
+	var last map[string]interface{}
+	for _, block := range blocks[:3] {
+		last = decodeJSON(t, strings.TrimPrefix(block, "data: "))
+		choice := last["choices"].([]interface{})[0].(map[string]interface{})
+		text += choice["text"].(string)
+	}
+	// echo 只在第一个chunk前输出一次
+	if text != "问：答" {
+		t.Errorf("文本 %q", text)
+	}
+	choice := last["choices"].([]interface{})[0].(map[string]interface{})
+	if choice["finish_reason"] != "stop" || last["usage"].(map[string]interface{})["total_tokens"] != 4.0 {
+		t.Errorf("最后一个chunk %v", last)
+	}
+
+	out = translateStream(t, &completionTranslator{},
+		chunkEvent("部分", "", nil),
+		`data: {"error":{"message":"上游中断","type":"api_error"}}`+"\n\n",
+	)
+	if !strings.Contains(out, `"message":"上游中断"`) {
+		t.Errorf("出错后的输出:\n%s", out)
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var configValue atomic.Pointer[Config]
+
+// currentConfig 返回当前生效的配置
+// 配置热加载时整体替换，调用方拿到的是不会再被修改的快照
+func currentConfig() *Config {
+	return configValue.Load()
+}
+
+// buildConfig 构建完整配置：环境变量作为基础，配置文件中出现的项覆盖环境变量，最后统一校验
+func buildConfig() (*Config, error) {
+	cfg := loadEnvConfig()
+
+	var lines map[string]int
+	var problems []string
+	path := os.Getenv("CONFIG_FILE")
+	if path != "" {
+		var err error
+		lines, problems, err = applyConfigFile(path, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	problems = append(problems, validateConfig(cfg, lines)...)
+	if len(problems) > 0 {
+		if path != "" {
+			return nil, fmt.Errorf("%s:\n%s", path, strings.Join(problems, "\n"))
+		}
+		return nil, errors.New(strings.Join(problems, "\n"))
+	}
+	return cfg, nil
+}
+
+// parseAppsEnv 解析 ALIYUN_APPS 环境变量，格式：模型名=应用ID,模型名=应用ID
+func parseAppsEnv(value string) map[string]AppConfig {
+	apps := make(map[string]AppConfig)
+	for _, item := range strings.Split(value, ",") {
+		name, appID, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		apps[strings.TrimSpace(name)] = AppConfig{AppID: strings.TrimSpace(appID)}
+	}
+	return apps
+}
+
+// parseModelMapEnv 解析模型名映射，格式：模型名=上游模型,模型名=上游模型
+func parseModelMapEnv(value string) map[string]string {
+	models := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		name, model, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		models[strings.TrimSpace(name)] = strings.TrimSpace(model)
+	}
+	return models
+}
+
+// envRefPattern 配置文件中的环境变量引用：${VAR} 或 ${VAR:-默认值}
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateEnv 替换配置文件中的环境变量引用，引用了未设置且没有默认值的变量时报错
+func interpolateEnv(src []byte) ([]byte, []string) {
+	var problems []string
+	lines := bytes.Split(src, []byte("\n"))
+	for i, line := range lines {
+		// YAML和TOML的整行注释不做替换
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		lines[i] = envRefPattern.ReplaceAllFunc(line, func(ref []byte) []byte {
+			m := envRefPattern.FindSubmatch(ref)
+			name := string(m[1])
+			if value, ok := os.LookupEnv(name); ok && value != "" {
+				return []byte(value)
+			}
+			if len(m[2]) > 0 {
+				return m[3]
+			}
+			problems = append(problems, fmt.Sprintf("第%d行: 引用的环境变量 %s 未设置", i+1, name))
+			return nil
+		})
+	}
+	return bytes.Join(lines, []byte("\n")), problems
+}
+
+// applyConfigFile 读取配置文件并覆盖到cfg上
+// 返回各配置项所在的行号（用于校验报错）和发现的问题；文件无法读取或语法错误时返回error
+// 根据扩展名识别格式：.yaml/.yml、.json、.toml
+func applyConfigFile(path string, cfg *Config) (map[string]int, []string, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+
+	src, problems := interpolateEnv(src)
+
+	var root *yaml.Node
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		root, err = yamlToNode(src)
+	case ".json":
+		root, err = jsonToNode(src)
+	case ".toml":
+		root, err = tomlToNode(src)
+	default:
+		return nil, nil, fmt.Errorf("不支持的配置文件格式（支持 .yaml/.yml/.json/.toml）")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析失败: %v", err)
+	}
+
+	lines := make(map[string]int)
+	if root == nil {
+		return lines, problems, nil
+	}
+
+	// 严格模式：出现未知配置项时报错，避免拼写错误被静默忽略
+	checkKnownFields(root, reflect.TypeOf(Config{}), "", lines, &problems)
+
+	if err := root.Decode(cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, nil, err
+		}
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, translateYAMLError(msg))
+		}
+	}
+	return lines, problems, nil
+}
+
+// translateYAMLError 把yaml库的 "line N: ..." 错误转换为统一的行号格式
+func translateYAMLError(msg string) string {
+	if rest, ok := strings.CutPrefix(msg, "line "); ok {
+		if num, detail, ok := strings.Cut(rest, ": "); ok {
+			return fmt.Sprintf("第%s行: 类型错误: %s", num, detail)
+		}
+	}
+	return msg
+}
+
+// yamlToNode 解析YAML，返回顶层映射节点
+func yamlToNode(src []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("第%d行: 配置文件顶层必须是键值映射", root.Line)
+	}
+	return root, nil
+}
+
+// jsonToNode 解析JSON并转换为带行号的yaml节点，使JSON配置也能报告出错行号
+func jsonToNode(src []byte) (*yaml.Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+
+	// lineAt 返回下一个token所在的行号
+	lineAt := func() int {
+		offset := int(dec.InputOffset())
+		for offset < len(src) && strings.ContainsRune(" \t\r\n,:", rune(src[offset])) {
+			offset++
+		}
+		return bytes.Count(src[:offset], []byte("\n")) + 1
+	}
+
+	var parse func() (*yaml.Node, error)
+	parse = func() (*yaml.Node, error) {
+		line := lineAt()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("第%d行: %v", line, err)
+		}
+		switch v := tok.(type) {
+		case json.Delim:
+			if v == '{' {
+				node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line}
+				for dec.More() {
+					keyLine := lineAt()
+					keyTok, err := dec.Token()
+					if err != nil {
+						return nil, fmt.Errorf("第%d行: %v", keyLine, err)
+					}
+					key, _ := keyTok.(string)
+					value, err := parse()
+					if err != nil {
+						return nil, err
+					}
+					node.Content = append(node.Content,
+						&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: keyLine}, value)
+				}
+				dec.Token()
+				return node, nil
+			}
+			node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+			for dec.More() {
+				item, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, item)
+			}
+			dec.Token()
+			return node, nil
+		case string:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v, Line: line}, nil
+		case json.Number:
+			tag := "!!int"
+			if strings.ContainsAny(v.String(), ".eE") {
+				tag = "!!float"
+			}
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: v.String(), Line: line}, nil
+		case bool:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v), Line: line}, nil
+		default:
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null", Line: line}, nil
+		}
+	}
+
+	if len(bytes.TrimSpace(src)) == 0 {
+		return nil, nil
+	}
+	root, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("第%d行: JSON结束后存在多余内容", lineAt())
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("第%d行: 配置文件顶层必须是键值映射", root.Line)
+	}
+	return root, nil
+}
+
+// tomlToNode 解析TOML并转换为带行号的yaml节点
+// TOML解析库不提供键的位置，行号通过扫描源文件中的表头和键得到
+func tomlToNode(src []byte) (*yaml.Node, error) {
+	var data map[string]interface{}
+	if _, err := toml.Decode(string(src), &data); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("第%d行: %s", parseErr.Position.Line, parseErr.Message)
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return tomlValueToNode(data, "", tomlKeyLines(string(src))), nil
+}
+
+// tomlValueToNode 把TOML解码出的值转换为yaml节点
+func tomlValueToNode(value interface{}, path string, lines map[string]int) *yaml.Node {
+	line := lines[path]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			li, lj := lines[joinConfigPath(path, keys[i])], lines[joinConfigPath(path, keys[j])]
+			if li != lj {
+				return li < lj
+			}
+			return keys[i] < keys[j]
+		})
+		for _, key := range keys {
+			childPath := joinConfigPath(path, key)
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: lines[childPath]},
+				tomlValueToNode(v[key], childPath, lines))
+		}
+		return node
+	case []map[string]interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+		for i, item := range v {
+			node.Content = append(node.Content, tomlValueToNode(item, fmt.Sprintf("%s[%d]", path, i), lines))
+		}
+		return node
+	case []interface{}:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: line}
+		for i, item := range v {
+			node.Content = append(node.Content, tomlValueToNode(item, fmt.Sprintf("%s[%d]", path, i), lines))
+		}
+		return node
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v, Line: line}
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(v, 10), Line: line}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(v, 'g', -1, 64), Line: line}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v), Line: line}
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprint(v), Line: line}
+	}
+}
+
+// tomlKeyLines 扫描TOML源文件，记录每个表和键所在的行号
+func tomlKeyLines(src string) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+	arrayIndex := make(map[string]int)
+	for i, raw := range strings.Split(src, "\n") {
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[["):
+			end := strings.Index(line, "]]")
+			if end < 0 {
+				continue
+			}
+			name := normalizeTOMLKey(line[2:end])
+			table = fmt.Sprintf("%s[%d]", name, arrayIndex[name])
+			arrayIndex[name]++
+		case strings.HasPrefix(line, "["):
+			end := strings.Index(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = normalizeTOMLKey(line[1:end])
+		default:
+			eq := strings.Index(line, "=")
+			if eq <= 0 {
+				continue
+			}
+			path := joinConfigPath(table, normalizeTOMLKey(line[:eq]))
+			if _, ok := lines[path]; !ok {
+				lines[path] = i + 1
+			}
+			continue
+		}
+		if _, ok := lines[table]; !ok {
+			lines[table] = i + 1
+		}
+	}
+	return lines
+}
+
+// normalizeTOMLKey 去掉TOML键两侧的空白和引号，保留点号分隔
+func normalizeTOMLKey(key string) string {
+	parts := strings.Split(strings.TrimSpace(key), ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// joinConfigPath 拼接配置项路径
+func joinConfigPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// checkKnownFields 对照结构体的yaml标签检查配置节点，记录每个配置项的行号，未知配置项加入problems
+func checkKnownFields(node *yaml.Node, t reflect.Type, path string, lines map[string]int, problems *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := make(map[string]reflect.Type)
+			collectYAMLFields(t, fields)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				childPath := joinConfigPath(path, key.Value)
+				lines[childPath] = key.Line
+				fieldType, ok := fields[key.Value]
+				if !ok {
+					*problems = append(*problems, fmt.Sprintf("第%d行: 未知配置项 %s", key.Line, childPath))
+					continue
+				}
+				checkKnownFields(value, fieldType, childPath, lines, problems)
+			}
+		case reflect.Map:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				childPath := joinConfigPath(path, key.Value)
+				lines[childPath] = key.Line
+				checkKnownFields(value, t.Elem(), childPath, lines, problems)
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice {
+			for i, item := range node.Content {
+				childPath := fmt.Sprintf("%s[%d]", path, i)
+				lines[childPath] = item.Line
+				checkKnownFields(item, t.Elem(), childPath, lines, problems)
+			}
+		}
+	}
+}
+
+// collectYAMLFields 收集结构体的配置项名称和类型，展开 ,inline 的嵌入结构体
+func collectYAMLFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		switch {
+		case opts == "inline":
+			collectYAMLFields(t.Field(i).Type, fields)
+		case name != "" && name != "-":
+			fields[name] = t.Field(i).Type
+		}
+	}
+}
+
+// validateConfig 校验配置，返回所有问题
+// lines 为配置文件中各配置项的行号，来自环境变量的配置没有行号
+func validateConfig(cfg *Config, lines map[string]int) []string {
+	var problems []string
+	report := func(path, format string, args ...interface{}) {
+		msg := path + ": " + fmt.Sprintf(format, args...)
+		// 配置项本身不在文件中时，使用最近的上级配置项的行号
+		for p := path; p != ""; {
+			if line, ok := lines[p]; ok && line > 0 {
+				msg = fmt.Sprintf("第%d行: %s", line, msg)
+				break
+			}
+			idx := strings.LastIndex(p, ".")
+			if idx < 0 {
+				break
+			}
+			p = p[:idx]
+		}
+		problems = append(problems, msg)
+	}
+
+	if cfg.AppID == "" {
+		report("app_id", "必须设置（配置文件或 ALIYUN_APP_ID 环境变量）")
+	}
+	if cfg.APIKey == "" && len(cfg.APIKeys) == 0 {
+		report("api_key", "必须设置 api_key 或 api_keys（配置文件或 ALIYUN_API_KEY / ALIYUN_API_KEYS 环境变量）")
+	}
+	for i, kc := range cfg.APIKeys {
+		path := fmt.Sprintf("api_keys[%d]", i)
+		if kc.Key == "" {
+			report(path+".key", "必须设置")
+		}
+		if kc.Weight < 0 {
+			report(path+".weight", "不能为负数: %d", kc.Weight)
+		}
+	}
+	switch cfg.APIKeyStrategy {
+	case "", "round_robin", "weighted":
+	default:
+		report("api_key_strategy", "无效的值 %q（可选 round_robin、weighted）", cfg.APIKeyStrategy)
+	}
+	if u, err := url.Parse(cfg.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		report("base_url", "无效的URL: %q", cfg.BaseURL)
+	}
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port <= 0 || port > 65535 {
+		report("port", "无效的端口: %q", cfg.Port)
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := parseProxyURL(cfg.ProxyURL); err != nil {
+			report("proxy_url", "%v", err)
+		}
+	}
+
+	if _, err := parseTLSVersion(cfg.UpstreamTLSMinVersion); err != nil {
+		report("upstream_tls_min_version", "%v", err)
+	}
+	if _, err := parseCertPins(cfg.UpstreamCertPins); err != nil {
+		report("upstream_cert_pins", "%v", err)
+	}
+	if cfg.UpstreamCAFile != "" {
+		if _, err := newUpstreamTLSConfig(&Config{UpstreamCAFile: cfg.UpstreamCAFile}); err != nil {
+			report("upstream_ca_file", "%v", err)
+		}
+	}
+	// SNI覆盖作用于该连接池的所有TLS握手，HTTPS代理的握手也会使用它
+	if cfg.UpstreamTLSServerName != "" && strings.HasPrefix(cfg.ProxyURL, "https://") {
+		report("upstream_tls_server_name", "不能与 https:// 代理同时使用")
+	}
+
+	nonNegative := map[string]int{
+		"request_timeout":            cfg.RequestTimeout,
+		"stream_timeout":             cfg.StreamTimeout,
+		"stream_idle_timeout":        cfg.StreamIdleTimeout,
+		"stream_first_token_timeout": cfg.StreamFirstTokenTimeout,
+		"stream_heartbeat_interval":  cfg.StreamHeartbeatInterval,
+		"max_idle_conns":             cfg.MaxIdleConns,
+		"max_idle_conns_per_host":    cfg.MaxIdleConnsPerHost,
+		"max_conns_per_host":         cfg.MaxConnsPerHost,
+		"idle_conn_timeout":          cfg.IdleConnTimeout,
+		"shutdown_timeout":           cfg.ShutdownTimeout,
+		"shutdown_delay":             cfg.ShutdownDelay,
+		"readiness_probe_interval":   cfg.ReadinessProbeInterval,
+		"budget_warn_percent":        cfg.BudgetWarnPercent,
+		"response_cache_ttl":         cfg.ResponseCacheTTL,
+		"response_cache_max_entries": cfg.ResponseCacheMaxEntries,
+		"response_cache_max_mb":      cfg.ResponseCacheMaxMB,
+		"idempotency_window":         cfg.IdempotencyWindow,
+		"embedding_batch_size":       cfg.EmbeddingBatchSize,
+		"image_task_timeout":         cfg.ImageTaskTimeout,
+		"transcription_task_timeout": cfg.TranscriptionTaskTimeout,
+		"circuit_breaker_threshold":  cfg.CircuitBreakerThreshold,
+		"circuit_breaker_cooldown":   cfg.CircuitBreakerCooldown,
+		"config_watch_interval":      cfg.ConfigWatchInterval,
+		"tls_reload_interval":        cfg.TLSReloadInterval,
+		"api_key_throttle_cooldown":  cfg.APIKeyThrottleCooldown,
+		"api_key_invalid_cooldown":   cfg.APIKeyInvalidCooldown,
+	}
+	for _, name := range sortedKeys(nonNegative) {
+		if nonNegative[name] < 0 {
+			report(name, "不能为负数: %d", nonNegative[name])
+		}
+	}
+	if cfg.TranscriptionMaxUploadMB < 1 {
+		report("transcription_max_upload_mb", "不能小于1: %d", cfg.TranscriptionMaxUploadMB)
+	}
+	if cfg.TaskPollInterval < 1 {
+		report("task_poll_interval", "不能小于1秒: %d", cfg.TaskPollInterval)
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		report("tls_cert_file", "tls_cert_file 和 tls_key_file 必须同时设置")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		report("tls_client_ca_file", "启用mTLS需要先设置 tls_cert_file 和 tls_key_file")
+	}
+	switch cfg.TLSClientAuth {
+	case "", "none", "optional", "require":
+	default:
+		report("tls_client_auth", "无效的值 %q（可选 none、optional、require）", cfg.TLSClientAuth)
+	}
+	if cfg.TLSClientAuth != "" && cfg.TLSClientAuth != "none" && cfg.TLSClientCAFile == "" {
+		report("tls_client_auth", "校验客户端证书需要设置 tls_client_ca_file")
+	}
+
+	seenClientKeys := make(map[string]bool)
+	for i, ck := range cfg.ClientKeys {
+		path := fmt.Sprintf("client_keys[%d]", i)
+		switch {
+		case ck.Key == "":
+			report(path+".key", "必须设置")
+		case seenClientKeys[ck.Key]:
+			report(path+".key", "与其他客户端Key重复")
+		}
+		seenClientKeys[ck.Key] = true
+		if _, ok := cfg.Tenants[ck.Tenant]; ck.Tenant != "" && !ok {
+			report(path+".tenant", "租户 %q 不存在", ck.Tenant)
+		}
+		if ck.MaxTokens < 0 {
+			report(path+".max_tokens", "不能为负数")
+		}
+		if !validMaxTokensAction(ck.MaxTokensAction) {
+			report(path+".max_tokens_action", "无效的值 %q（可选 clamp、reject）", ck.MaxTokensAction)
+		}
+		if ck.Budget.Daily < 0 || ck.Budget.Monthly < 0 {
+			report(path+".budget", "不能为负数")
+		}
+	}
+	for _, name := range sortedKeys(cfg.Tenants) {
+		tenant := cfg.Tenants[name]
+		if tenant.APIKey != "" && tenant.AppID == "" {
+			report("tenants."+name+".app_id", "使用自己的 api_key 时必须设置默认应用")
+		}
+		if tenant.Budget.Daily < 0 || tenant.Budget.Monthly < 0 {
+			report("tenants."+name+".budget", "不能为负数")
+		}
+		for _, model := range sortedKeys(tenant.Apps) {
+			if tenant.Apps[model].AppID == "" {
+				report("tenants."+name+".apps."+model+".app_id", "必须设置")
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.Prices) {
+		if price := cfg.Prices[name]; price.Input < 0 || price.Output < 0 || price.Image < 0 || price.AudioSecond < 0 {
+			report("prices."+name, "价格不能为负数")
+		}
+	}
+	if cfg.BudgetWarnPercent > 100 {
+		report("budget_warn_percent", "不能大于100: %d", cfg.BudgetWarnPercent)
+	}
+
+	for _, name := range sortedKeys(cfg.Apps) {
+		if name == "" {
+			report("apps", "模型名不能为空")
+			continue
+		}
+		if cfg.Apps[name].AppID == "" {
+			report("apps."+name+".app_id", "必须设置")
+		}
+	}
+	return problems
+}
+
+// sortedKeys 返回按字母排序的map键，保证报错顺序稳定
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// reloadMu 保证同一时间只有一次热加载
+var reloadMu sync.Mutex
+
+// reloadConfig 重新加载配置并原子替换；校验失败时保留当前配置
+// 进行中的请求继续使用开始时的配置快照，不会被中断
+func reloadConfig(trigger string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := buildConfig()
+	if err != nil {
+		configMetrics.Add("reload_failures", 1)
+		log.Printf("配置重新加载失败（%s），继续使用当前配置:\n%v", trigger, err)
+		return
+	}
+
+	prev := currentConfig()
+	if cfg.Port != prev.Port {
+		log.Printf("监听端口变更（%s -> %s）需要重启后生效", prev.Port, cfg.Port)
+		cfg.Port = prev.Port
+	}
+	if cfg.StoreFile != prev.StoreFile {
+		log.Printf("存储文件变更（%s -> %s）需要重启后生效", prev.StoreFile, cfg.StoreFile)
+		cfg.StoreFile = prev.StoreFile
+	}
+
+	configValue.Store(cfg)
+	initHTTPClients(cfg, prev)
+	readinessProbe.Invalidate()
+
+	configMetrics.Add("reloads", 1)
+	log.Printf("配置已重新加载（%s），按模型名映射的应用: %d 个", trigger, len(cfg.Apps))
+}
+
+// startConfigReloader 收到SIGHUP时重新加载配置；设置了CONFIG_FILE时还会定期检查文件内容变化
+func startConfigReloader() {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			reloadConfig("SIGHUP")
+		}
+	}()
+
+	path := os.Getenv("CONFIG_FILE")
+	interval := currentConfig().ConfigWatchInterval
+	if path == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		last := fileChecksum(path)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if sum := fileChecksum(path); sum != last {
+				last = sum
+				reloadConfig("配置文件变更")
+			}
+		}
+	}()
+	log.Printf("已启用配置文件热加载: %s（每%d秒检查一次，或发送SIGHUP）", path, interval)
+}
+
+// fileChecksum 计算文件内容的摘要，读取失败时返回空字符串
+func fileChecksum(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEnvConfig 返回只设置了必填项的环境变量配置
+func testEnvConfig(t *testing.T) *Config {
+	t.Helper()
+	t.Setenv("ALIYUN_APP_ID", "app-test")
+	t.Setenv("ALIYUN_API_KEY", "sk-test")
+	return loadEnvConfig()
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(cfg *Config)
+		want   []string // 期望出现的问题，为空表示配置有效
+	}{
+		{"默认配置有效", func(cfg *Config) {}, nil},
+		{"缺少应用ID", func(cfg *Config) { cfg.AppID = "" }, []string{"app_id: 必须设置"}},
+		{"缺少API Key", func(cfg *Config) { cfg.APIKey = "" }, []string{"api_key: 必须设置 api_key 或 api_keys"}},
+		{"Key池代替单个Key", func(cfg *Config) {
+			cfg.APIKey = ""
+			cfg.APIKeys = []APIKeyConfig{{Key: "sk-a", Weight: 1}}
+		}, nil},
+		{"Key池的Key为空且权重为负", func(cfg *Config) {
+			cfg.APIKeys = []APIKeyConfig{{Weight: -1}}
+		}, []string{"api_keys[0].key: 必须设置", "api_keys[0].weight: 不能为负数: -1"}},
+		{"无效的Key选择策略", func(cfg *Config) { cfg.APIKeyStrategy = "random" }, []string{`api_key_strategy: 无效的值 "random"`}},
+		{"无效的base_url", func(cfg *Config) { cfg.BaseURL = "dashscope.aliyuncs.com" }, []string{"base_url: 无效的URL"}},
+		{"无效的端口", func(cfg *Config) { cfg.Port = "70000" }, []string{`port: 无效的端口: "70000"`}},
+		{"负数超时", func(cfg *Config) { cfg.RequestTimeout = -1 }, []string{"request_timeout: 不能为负数: -1"}},
+		{"上传上限小于1MB", func(cfg *Config) { cfg.TranscriptionMaxUploadMB = 0 }, []string{"transcription_max_upload_mb: 不能小于1"}},
+		{"只设置证书没有私钥", func(cfg *Config) { cfg.TLSCertFile = "cert.pem" }, []string{"tls_cert_file: tls_cert_file 和 tls_key_file 必须同时设置"}},
+		{"重复的客户端Key", func(cfg *Config) {
+			cfg.ClientKeys = []ClientKeyConfig{{Key: "ck"}, {Key: "ck"}}
+		}, []string{"client_keys[1].key: 与其他客户端Key重复"}},
+		{"客户端Key的租户不存在", func(cfg *Config) {
+			cfg.ClientKeys = []ClientKeyConfig{{Key: "ck", Tenant: "acme"}}
+		}, []string{`client_keys[0].tenant: 租户 "acme" 不存在`}},
+		{"应用缺少app_id", func(cfg *Config) {
+			cfg.Apps = map[string]AppConfig{"qwen": {}}
+		}, []string{"apps.qwen.app_id: 必须设置"}},
+		{"预警比例超过100", func(cfg *Config) { cfg.BudgetWarnPercent = 120 }, []string{"budget_warn_percent: 不能大于100: 120"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testEnvConfig(t)
+			tt.mutate(cfg)
+			problems := validateConfig(cfg, nil)
+			if len(tt.want) == 0 && len(problems) > 0 {
+				t.Fatalf("期望配置有效，得到 %q", problems)
+			}
+			for _, want := range tt.want {
+				if !containsProblem(problems, want) {
+					t.Errorf("缺少问题 %q，得到 %q", want, problems)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfigLineNumbers(t *testing.T) {
+	cfg := testEnvConfig(t)
+	cfg.Apps = map[string]AppConfig{"qwen": {}}
+	cfg.RequestTimeout = -1
+	lines := map[string]int{"apps": 3, "apps.qwen": 4, "request_timeout": 7}
+
+	problems := validateConfig(cfg, lines)
+	// apps.qwen.app_id 不在文件中，使用最近的上级配置项 apps.qwen 的行号
+	for _, want := range []string{"第4行: apps.qwen.app_id: 必须设置", "第7行: request_timeout: 不能为负数: -1"} {
+		if !containsProblem(problems, want) {
+			t.Errorf("缺少问题 %q，得到 %q", want, problems)
+		}
+	}
+}
+
+func TestBuildConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "YAML未知配置项",
+			file:    "config.yaml",
+			content: "port: \"8080\"\nrequest_timout: 30\n",
+			want:    []string{"第2行: 未知配置项 request_timout"},
+		},
+		{
+			name:    "YAML嵌套配置项的行号",
+			file:    "config.yaml",
+			content: "apps:\n  qwen:\n    app_id: \"\"\n    foo: 1\n",
+			want:    []string{"第4行: 未知配置项 apps.qwen.foo", "第3行: apps.qwen.app_id: 必须设置"},
+		},
+		{
+			name:    "YAML类型错误",
+			file:    "config.yaml",
+			content: "port: \"8080\"\nrequest_timeout: abc\n",
+			want:    []string{"第2行: 类型错误"},
+		},
+		{
+			name:    "JSON校验错误",
+			file:    "config.json",
+			content: "{\n  \"port\": \"8080\",\n  \"request_timeout\": -5\n}\n",
+			want:    []string{"第3行: request_timeout: 不能为负数: -5"},
+		},
+		{
+			name:    "TOML未知配置项",
+			file:    "config.toml",
+			content: "port = \"8080\"\n\n[apps.qwen]\napp_id = \"app-1\"\nfoo = 1\n",
+			want:    []string{"第5行: 未知配置项 apps.qwen.foo"},
+		},
+		{
+			name:    "引用未设置的环境变量",
+			file:    "config.yaml",
+			content: "# ${IGNORED_IN_COMMENT}\napp_id: ${BAILIAN_TEST_UNSET_VAR}\n",
+			want:    []string{"第2行: 引用的环境变量 BAILIAN_TEST_UNSET_VAR 未设置"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testEnvConfig(t)
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", path)
+			_, err := buildConfig()
+			if err == nil {
+				t.Fatal("期望配置无效")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("缺少问题 %q，得到:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildConfigFileOverridesEnv(t *testing.T) {
+	testEnvConfig(t)
+	t.Setenv("BAILIAN_TEST_PORT", "9090")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "port: ${BAILIAN_TEST_PORT}\nrequest_timeout: ${BAILIAN_TEST_UNSET_TIMEOUT:-45}\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "9090" || cfg.RequestTimeout != 45 || cfg.AppID != "app-test" {
+		t.Errorf("port=%q request_timeout=%d app_id=%q", cfg.Port, cfg.RequestTimeout, cfg.AppID)
+	}
+}
+
+// containsProblem 问题列表中是否有包含want的一项
+func containsProblem(problems []string, want string) bool {
+	for _, problem := range problems {
+		if strings.Contains(problem, want) {
+			return true
+		}
+	}
+	return false
+}
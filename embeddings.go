@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// maxEmbeddingInputs 一次请求最多的文本条数，与OpenAI的限制一致；超过上游单次上限的部分由代理分批请求
+const maxEmbeddingInputs = 2048
+
+// EmbeddingRequest OpenAI格式的文本向量请求（/v1/embeddings）
+type EmbeddingRequest struct {
+	Model          string         `json:"model"`
+	Input          embeddingInput `json:"input"`
+	EncodingFormat string         `json:"encoding_format"` // float（默认）/ base64
+	Dimensions     *int           `json:"dimensions"`
+	TextType       string         `json:"text_type"` // DashScope参数：query / document（默认）
+	User           string         `json:"user"`
+}
+
+// embeddingInput 字符串或字符串数组
+type embeddingInput []string
+
+func (in *embeddingInput) UnmarshalJSON(data []byte) error {
+	// null 等同于省略该字段，不能当作空字符串
+	if string(data) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = embeddingInput{text}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return fmt.Errorf("input 必须是字符串或字符串数组，不支持token数组")
+	}
+	*in = texts
+	return nil
+}
+
+// dashscopeEmbeddingResponse DashScope文本向量接口的响应
+type dashscopeEmbeddingResponse struct {
+	Output struct {
+		Embeddings []struct {
+			TextIndex int       `json:"text_index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"embeddings"`
+	} `json:"output"`
+	Usage struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+	RequestID string `json:"request_id"`
+}
+
+// getEmbeddingEndpoint 获取DashScope文本向量接口地址
+func getEmbeddingEndpoint(cfg *Config) string {
+	return cfg.BaseURL + "/api/v1/services/embeddings/text-embedding/text-embedding"
+}
+
+// validate 检查请求参数
+func (req EmbeddingRequest) validate() error {
+	switch {
+	case len(req.Input) == 0:
+		return fmt.Errorf("input字段不能为空")
+	case len(req.Input) > maxEmbeddingInputs:
+		return fmt.Errorf("input 最多 %d 条，收到 %d 条", maxEmbeddingInputs, len(req.Input))
+	case req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64":
+		return fmt.Errorf("无效的 encoding_format %q（可选 float、base64）", req.EncodingFormat)
+	case req.Dimensions != nil && *req.Dimensions <= 0:
+		return fmt.Errorf("dimensions 必须大于0")
+	case req.TextType != "" && req.TextType != "query" && req.TextType != "document":
+		return fmt.Errorf("无效的 text_type %q（可选 query、document）", req.TextType)
+	}
+	for i, text := range req.Input {
+		if text == "" {
+			return fmt.Errorf("input[%d] 不能为空字符串", i)
+		}
+	}
+	return nil
+}
+
+// handleEmbeddings 处理OpenAI格式的文本向量请求，转发到DashScope文本向量接口
+// 文本条数超过 embedding_batch_size 时分批请求上游，结果按原顺序合并
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "只支持POST请求")
+		return
+	}
+	var req EmbeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "请求格式错误: "+err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	cfg := currentConfig()
+	clients := currentClients()
+	reportModel(r.Context(), req.Model)
+	if err := checkModelScope(r, req.Model); err != nil {
+		writeScopeError(w, err)
+		return
+	}
+	model := resolveServiceModel(cfg.EmbeddingModels, cfg.EmbeddingModel, req.Model)
+	route := resolveCredentials(cfg, requestTenant(r))
+	endpoint := getEmbeddingEndpoint(cfg)
+
+	parameters := map[string]interface{}{}
+	if req.Dimensions != nil {
+		parameters["dimension"] = *req.Dimensions
+	}
+	if req.TextType != "" {
+		parameters["text_type"] = req.TextType
+	}
+
+	batchSize := cfg.EmbeddingBatchSize
+	if batchSize <= 0 {
+		batchSize = len(req.Input)
+	}
+	log.Printf("转发文本向量请求到阿里云百炼: %s，模型 %s，%d 条文本", endpoint, model, len(req.Input))
+
+	vectors := make([][]float64, len(req.Input))
+	totalTokens := 0
+	for start := 0; start < len(req.Input); start += batchSize {
+		end := min(start+batchSize, len(req.Input))
+		body, _ := json.Marshal(map[string]interface{}{
+			"model":      model,
+			"input":      map[string]interface{}{"texts": req.Input[start:end]},
+			"parameters": parameters,
+		})
+		status, respBody, err := callService(r.Context(), clients.client, route, http.MethodPost, endpoint, body)
+		if err != nil {
+			writeServiceError(w, err)
+			return
+		}
+		if status != http.StatusOK {
+			writeUpstreamError(w, status, respBody)
+			return
+		}
+
+		var resp dashscopeEmbeddingResponse
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			log.Printf("解析文本向量响应失败: %v", err)
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", "上游响应格式错误")
+			return
+		}
+		// 已完成的批次同样计入用量
+		totalTokens += resp.Usage.TotalTokens
+		reportTokens(r.Context(), modelTokens{ModelID: model, InputTokens: totalTokens})
+		for _, e := range resp.Output.Embeddings {
+			if e.TextIndex < 0 || start+e.TextIndex >= end {
+				continue
+			}
+			vectors[start+e.TextIndex] = e.Embedding
+		}
+	}
+
+	data := make([]map[string]interface{}, len(vectors))
+	for i, vector := range vectors {
+		if vector == nil {
+			log.Printf("上游没有返回第 %d 条文本的向量", i)
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", fmt.Sprintf("上游没有返回 input[%d] 的向量", i))
+			return
+		}
+		var embedding interface{} = vector
+		if req.EncodingFormat == "base64" {
+			embedding = encodeEmbeddingBase64(vector)
+		}
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": embedding}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  req.Model,
+		"usage":  map[string]int{"prompt_tokens": totalTokens, "total_tokens": totalTokens},
+	})
+}
+
+// encodeEmbeddingBase64 按OpenAI的格式编码向量：float32小端序字节的Base64
+func encodeEmbeddingBase64(vector []float64) string {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
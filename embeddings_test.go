@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEncodeEmbeddingBase64(t *testing.T) {
+	tests := []struct {
+		name   string
+		vector []float64
+		want   string
+	}{
+		{"空向量", nil, ""},
+		{"1.0", []float64{1}, "AACAPw=="},
+		{"多个值", []float64{0, -2, 0.5}, "AAAAAAAAAMAAAAA/"},
+	}
+	for _, tt := range tests {
+		if got := encodeEmbeddingBase64(tt.vector); got != tt.want {
+			t.Errorf("%s: 得到 %q，期望 %q", tt.name, got, tt.want)
+		}
+	}
+
+	// 客户端按float32小端序解码后得到原来的值（float32精度）
+	vector := []float64{0.0123, -0.98765, 3.5e-7, 1234.5}
+	raw, err := base64.StdEncoding.DecodeString(encodeEmbeddingBase64(vector))
+	if err != nil || len(raw) != 4*len(vector) {
+		t.Fatalf("解码失败: %v，%d 字节", err, len(raw))
+	}
+	for i, v := range vector {
+		got := math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:]))
+		if got != float32(v) {
+			t.Errorf("第%d个值 %v，期望 %v", i, got, float32(v))
+		}
+	}
+}
+
+func TestEmbeddingInputUnmarshal(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{`{"input":"你好"}`, []string{"你好"}, false},
+		{`{"input":["a","b"]}`, []string{"a", "b"}, false},
+		{`{"input":null}`, nil, false},
+		{`{}`, nil, false},
+		{`{"input":[1,2,3]}`, nil, true},
+	}
+	for _, tt := range tests {
+		var req EmbeddingRequest
+		err := json.Unmarshal([]byte(tt.body), &req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: 错误 %v，期望出错 %v", tt.body, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(req.Input, "|") != strings.Join(tt.want, "|") || len(req.Input) != len(tt.want) {
+			t.Errorf("%s: 得到 %q，期望 %q", tt.body, req.Input, tt.want)
+		}
+	}
+}
+
+func TestEmbeddingRequestValidate(t *testing.T) {
+	zero, dims := 0, 512
+	tests := []struct {
+		name string
+		req  EmbeddingRequest
+		want string // 为空表示有效
+	}{
+		{"有效", EmbeddingRequest{Input: embeddingInput{"a"}, EncodingFormat: "base64", Dimensions: &dims, TextType: "query"}, ""},
+		{"没有input", EmbeddingRequest{}, "input字段不能为空"},
+		{"条数过多", EmbeddingRequest{Input: make(embeddingInput, maxEmbeddingInputs+1)}, "input 最多"},
+		{"无效的编码格式", EmbeddingRequest{Input: embeddingInput{"a"}, EncodingFormat: "binary"}, "encoding_format"},
+		{"dimensions为0", EmbeddingRequest{Input: embeddingInput{"a"}, Dimensions: &zero}, "dimensions 必须大于0"},
+		{"无效的text_type", EmbeddingRequest{Input: embeddingInput{"a"}, TextType: "code"}, "text_type"},
+		{"空字符串", EmbeddingRequest{Input: embeddingInput{"a", ""}}, "input[1] 不能为空字符串"},
+	}
+	for _, tt := range tests {
+		err := tt.req.validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: 期望有效，得到 %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: 得到 %v，期望包含 %q", tt.name, err, tt.want)
+		}
+	}
+}
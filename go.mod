@@ -2,3 +2,7 @@ module aliyun-bailian-proxy
 
 go 1.21
 
+require (
+	github.com/BurntSushi/toml v1.4.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheck 单项检查结果
+type healthCheck struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms,omitempty"`
+	CheckedAt string `json:"checked_at,omitempty"`
+}
+
+// upstreamProbe 缓存的上游探测结果，避免每次就绪检查都访问阿里云
+type upstreamProbe struct {
+	mu        sync.Mutex
+	result    healthCheck
+	checkedAt time.Time
+}
+
+var readinessProbe = &upstreamProbe{}
+
+// getReadinessProbeURL 就绪探测地址，默认使用免费的模型列表接口（同时校验API Key）
+func getReadinessProbeURL(cfg *Config) string {
+	if cfg.ReadinessProbeURL != "" {
+		return cfg.ReadinessProbeURL
+	}
+	return cfg.BaseURL + "/compatible-mode/v1/models"
+}
+
+// Invalidate 清除缓存的探测结果（配置变更后调用）
+func (p *upstreamProbe) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkedAt = time.Time{}
+}
+
+// Check 返回上游探测结果，缓存未过期时直接使用缓存
+func (p *upstreamProbe) Check(ctx context.Context) healthCheck {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cfg := currentConfig()
+	ttl := time.Duration(cfg.ReadinessProbeInterval) * time.Second
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < ttl {
+		return p.result
+	}
+
+	p.result = probeUpstream(ctx, cfg)
+	p.checkedAt = time.Now()
+	p.result.CheckedAt = p.checkedAt.Format(time.RFC3339)
+	return p.result
+}
+
+// probeUpstream 探测上游是否可达、API Key是否有效
+// 直接使用底层Transport，不经过熔断器，熔断期间也能探测；API Key从Key池中轮流选取
+func probeUpstream(ctx context.Context, cfg *Config) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getReadinessProbeURL(cfg), nil)
+	if err != nil {
+		return healthCheck{Status: "fail", Error: err.Error()}
+	}
+	req.Header.Set("User-Agent", "aliyun-bailian-proxy/1.0")
+
+	start := time.Now()
+	transport := &keyPoolTransport{next: currentClients().transport, pool: upstreamKeys}
+	resp, err := transport.RoundTrip(req)
+	latency := time.Since(start).Milliseconds()
+	if errors.Is(err, errNoUpstreamKey) {
+		return healthCheck{Status: "fail", Error: err.Error()}
+	}
+	if err != nil {
+		return healthCheck{Status: "fail", Error: "上游不可达: " + err.Error(), LatencyMs: latency}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return healthCheck{Status: "fail", Error: fmt.Sprintf("API Key无效或无权限(HTTP %d)", resp.StatusCode), LatencyMs: latency}
+	case resp.StatusCode >= 500:
+		return healthCheck{Status: "fail", Error: fmt.Sprintf("上游返回错误(HTTP %d)", resp.StatusCode), LatencyMs: latency}
+	}
+	return healthCheck{Status: "ok", LatencyMs: latency}
+}
+
+// checkConfig 校验当前配置是否可用
+func checkConfig() healthCheck {
+	if problems := validateConfig(currentConfig(), nil); len(problems) > 0 {
+		return healthCheck{Status: "fail", Error: strings.Join(problems, "; ")}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// handleLivez 存活检查：进程能处理请求即返回200
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "ok",
+		"service": "aliyun-bailian-proxy",
+	})
+}
+
+// handleReadyz 就绪检查：配置有效、上游可达、未在排空、熔断器未打开时返回200，否则返回503
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{}
+	ready := true
+
+	checks["config"] = checkConfig()
+
+	if isDraining() {
+		checks["draining"] = healthCheck{Status: "fail", Error: "服务器正在关闭"}
+	} else {
+		checks["draining"] = healthCheck{Status: "ok"}
+	}
+
+	// 半开状态视为就绪：实例被摘流后不会再有试探请求，若报告未就绪熔断器将永远无法关闭
+	switch state := upstreamBreaker.State(); state {
+	case "open":
+		checks["circuit_breaker"] = healthCheck{Status: "fail", Error: "熔断器状态: " + state}
+	case "half_open":
+		checks["circuit_breaker"] = healthCheck{Status: "degraded", Error: "熔断器状态: " + state}
+	default:
+		checks["circuit_breaker"] = healthCheck{Status: "ok"}
+	}
+
+	if upstreamKeys.Available() {
+		checks["upstream_keys"] = healthCheck{Status: "ok"}
+	} else {
+		checks["upstream_keys"] = healthCheck{Status: "fail", Error: errNoUpstreamKey.Error()}
+	}
+
+	// 配置无效时探测没有意义
+	if checks["config"].Status == "ok" {
+		checks["upstream"] = readinessProbe.Check(r.Context())
+	} else {
+		checks["upstream"] = healthCheck{Status: "skipped"}
+	}
+
+	for _, check := range checks {
+		if check.Status == "fail" {
+			ready = false
+		}
+	}
+
+	status := "ready"
+	statusCode := http.StatusOK
+	if !ready {
+		status = "not_ready"
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"service": "aliyun-bailian-proxy",
+		"checks":  checks,
+	})
+}
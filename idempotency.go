@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxIdempotencyKeyLength Idempotency-Key 的最大长度
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentResponseBytes 单个响应（包括完整的SSE流）最多保存的字节数，超过时不保存
+	maxIdempotentResponseBytes = 1024 * 1024
+	// maxIdempotencyStoreBytes 所有保存的响应合计的字节数上限，超过时新的响应不保存
+	maxIdempotencyStoreBytes = 64 * 1024 * 1024
+)
+
+// idempotentResponse 一个带 Idempotency-Key 的请求的响应，进行中时记录已输出的部分
+type idempotentResponse struct {
+	mu       sync.Mutex
+	bodyHash string
+	status   int
+	header   http.Header
+	body     []byte
+	done     bool
+	oversize bool // 响应超过保存上限，已丢弃记录的内容，结束后不保存
+	expires  time.Time
+	changed  chan struct{} // 每次更新时关闭并替换，用于通知等待的重复请求
+}
+
+// idempotencyStore 按客户端和 Idempotency-Key 保存响应
+type idempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	bytes     atomic.Int64 // 所有记录的响应体合计字节数，写入时不持有mu，避免与单个响应的锁交叉
+}
+
+// idempotencyKeys 全局的 Idempotency-Key 响应表
+var idempotencyKeys = &idempotencyStore{responses: make(map[string]*idempotentResponse)}
+
+// Begin 查找相同Key的响应，没有时创建新的记录，返回值表示是否由当前请求处理
+// 已过期但还没被后台清理的记录视为不存在
+func (s *idempotencyStore) Begin(key, bodyHash string, window time.Duration) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if resp, ok := s.responses[key]; ok {
+		resp.mu.Lock()
+		expired := resp.done && now.After(resp.expires)
+		resp.mu.Unlock()
+		if !expired {
+			return resp, false
+		}
+		s.removeLocked(key, resp)
+	}
+	resp := &idempotentResponse{bodyHash: bodyHash, changed: make(chan struct{}), expires: now.Add(window)}
+	s.responses[key] = resp
+	return resp, true
+}
+
+// Forget 删除记录，之后相同Key的请求会重新处理
+func (s *idempotencyStore) Forget(key string, resp *idempotentResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responses[key] == resp {
+		s.removeLocked(key, resp)
+	}
+}
+
+// removeLocked 删除记录并释放它占用的字节数；正在重放的请求仍持有响应体，由GC回收
+func (s *idempotencyStore) removeLocked(key string, resp *idempotentResponse) {
+	delete(s.responses, key)
+	resp.mu.Lock()
+	s.bytes.Add(-int64(len(resp.body)))
+	resp.mu.Unlock()
+}
+
+// expire 清理已过期的记录
+func (s *idempotencyStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, resp := range s.responses {
+		resp.mu.Lock()
+		expired := resp.done && now.After(resp.expires)
+		resp.mu.Unlock()
+		if expired {
+			s.removeLocked(key, resp)
+		}
+	}
+}
+
+// StartExpirer 定期清理已过期的记录，请求处理时不再扫描整个表
+func (s *idempotencyStore) StartExpirer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.expire()
+		}
+	}()
+}
+
+// reserve 为响应体预留字节数，超过总上限时返回false
+func (s *idempotencyStore) reserve(n int) bool {
+	if s.bytes.Add(int64(n)) > maxIdempotencyStoreBytes {
+		s.bytes.Add(-int64(n))
+		return false
+	}
+	return true
+}
+
+// notifyLocked 通知等待的重复请求
+func (resp *idempotentResponse) notifyLocked() {
+	close(resp.changed)
+	resp.changed = make(chan struct{})
+}
+
+// finish 响应结束
+func (resp *idempotentResponse) finish(window time.Duration) {
+	resp.mu.Lock()
+	defer resp.mu.Unlock()
+	resp.done = true
+	resp.expires = time.Now().Add(window)
+	close(resp.changed)
+}
+
+// idempotencyRecorder 把响应同时写给客户端和记录
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	store *idempotencyStore
+	resp  *idempotentResponse
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	rec.resp.mu.Lock()
+	if rec.resp.status == 0 {
+		rec.resp.status = code
+		rec.resp.header = rec.ResponseWriter.Header().Clone()
+		rec.resp.notifyLocked()
+	}
+	rec.resp.mu.Unlock()
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.resp.mu.Lock()
+	if rec.resp.status == 0 {
+		rec.resp.status = http.StatusOK
+		rec.resp.header = rec.ResponseWriter.Header().Clone()
+	}
+	if !rec.resp.oversize {
+		if len(rec.resp.body)+len(b) <= maxIdempotentResponseBytes && rec.store.reserve(len(b)) {
+			rec.resp.body = append(rec.resp.body, b...)
+		} else {
+			// 超过单个响应或总量的上限：丢弃已记录的内容，客户端照常收到完整响应，只是不能重放
+			rec.store.bytes.Add(-int64(len(rec.resp.body)))
+			rec.resp.body = nil
+			rec.resp.oversize = true
+		}
+	}
+	rec.resp.notifyLocked()
+	rec.resp.mu.Unlock()
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush 流式响应需要逐条刷新
+func (rec *idempotencyRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// replay 把记录的响应返回给重复的请求；原请求还在进行时，跟随它的输出直到结束
+func (resp *idempotentResponse) replay(w http.ResponseWriter, r *http.Request) {
+	sent := 0
+	headerWritten := false
+	for {
+		resp.mu.Lock()
+		status, header, done, oversize, changed := resp.status, resp.header, resp.done, resp.oversize, resp.changed
+		var body []byte
+		if !oversize {
+			body = resp.body[sent:]
+		}
+		resp.mu.Unlock()
+
+		if oversize {
+			// 原请求的响应太大无法重放：还没输出时返回409让客户端稍后重试，已输出部分时只能结束
+			if !headerWritten {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				w.Write(openAIErrorJSON("invalid_request_error", "idempotency_response_too_large", "相同 Idempotency-Key 的请求响应过大，无法重放，请在原请求结束后重试"))
+			}
+			return
+		}
+
+		if status != 0 && !headerWritten {
+			for name, values := range header {
+				if name == "Date" || name == "Content-Length" {
+					continue
+				}
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(status)
+			headerWritten = true
+		}
+		if len(body) > 0 {
+			if _, err := w.Write(body); err != nil {
+				return
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			sent += len(body)
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// requestScope 请求所属的客户端（客户端Key、租户或匿名），用于隔离不同客户端的 Idempotency-Key 和异步任务
+func requestScope(r *http.Request) string {
+	if ck := requestClientKey(r); ck != nil {
+		return "key:" + ck.ID
+	}
+	if tenant := requestTenant(r); tenant != "" {
+		return "tenant:" + tenant
+	}
+	return "anonymous"
+}
+
+// maxJSONBodyBytes JSON接口请求体的大小上限
+const maxJSONBodyBytes = 32 * 1024 * 1024
+
+// jsonBodyLimit JSON接口的请求体上限
+func jsonBodyLimit() int64 { return maxJSONBodyBytes }
+
+// transcriptionBodyLimit 语音转写接口的请求体上限：音频文件大小上限加上表单其余字段的余量
+func transcriptionBodyLimit() int64 {
+	return int64(currentConfig().TranscriptionMaxUploadMB)*1024*1024 + 1024*1024
+}
+
+// withBodyLimit 在读取请求体之前限制其大小，必须包在 withIdempotency 外层，
+// 否则带 Idempotency-Key 的请求会绕过限制被完整读入内存
+func withBodyLimit(limit func() int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit())
+		next(w, r)
+	}
+}
+
+// idempotencyRequestHash 计算请求的摘要：方法和路径也参与计算，
+// 同一个Key用于另一个接口时按不同的请求处理（422），不会返回另一种API格式的响应
+func idempotencyRequestHash(method, path, contentType string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	if digest, ok := multipartDigest(contentType, body); ok {
+		h.Write(digest)
+	} else {
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// multipartDigest 按字段名、文件名和内容计算multipart表单的摘要
+// 原始请求体包含客户端每次随机生成的boundary，直接计算摘要时重试的请求永远不会相同
+func multipartDigest(contentType string, body []byte) ([]byte, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, false
+	}
+	h := sha256.New()
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return h.Sum(nil), true
+		}
+		if err != nil {
+			return nil, false
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, false
+		}
+		fmt.Fprintf(h, "%q %q %d\n", part.FormName(), part.FileName(), len(content))
+		h.Write(content)
+	}
+}
+
+// withIdempotency 支持 Idempotency-Key 请求头，客户端重试时不会重复调用上游
+// 相同客户端、相同Key和相同请求体的重复请求返回保存的响应（原请求还在进行时等待并跟随它的输出）；
+// 相同Key但请求体不同时返回422。限流（429）、5xx响应和客户端中途断开的请求不保存，可以用相同的Key重试
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		window := time.Duration(currentConfig().IdempotencyWindow) * time.Second
+		if idempotencyKey == "" || window <= 0 || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Idempotency-Key 过长")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", fmt.Sprintf("请求体超过 %d 字节", tooLarge.Limit))
+				return
+			}
+			http.Error(w, "无法读取请求体", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := idempotencyRequestHash(r.Method, r.URL.Path, r.Header.Get("Content-Type"), body)
+
+		key := requestScope(r) + ":" + idempotencyKey
+		resp, first := idempotencyKeys.Begin(key, bodyHash, window)
+		if !first {
+			if resp.bodyHash != bodyHash {
+				log.Printf("Idempotency-Key %q 被用于不同的请求体", idempotencyKey)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write(openAIErrorJSON("invalid_request_error", "idempotency_key_reused", "Idempotency-Key 已用于另一个不同的请求"))
+				return
+			}
+			log.Printf("重复请求（Idempotency-Key %q），返回保存的响应", idempotencyKey)
+			resp.replay(w, r)
+			return
+		}
+
+		completed := false
+		defer func() {
+			resp.mu.Lock()
+			status, oversize := resp.status, resp.oversize
+			resp.mu.Unlock()
+			// 失败、不完整或超过保存上限的响应不保存，等待中的重复请求收到相同的结果后，下一次重试会重新处理
+			if !completed || status == 0 || oversize || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError || r.Context().Err() != nil {
+				idempotencyKeys.Forget(key, resp)
+			}
+			resp.finish(window)
+		}()
+		next(&idempotencyRecorder{ResponseWriter: w, store: idempotencyKeys, resp: resp}, r)
+		completed = true
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// setTestConfig 在测试期间替换全局配置
+func setTestConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	previous := configValue.Load()
+	configValue.Store(cfg)
+	t.Cleanup(func() { configValue.Store(previous) })
+}
+
+// idempotentHandler 记录调用次数的处理函数，按status和body返回响应
+func idempotentHandler(calls *atomic.Int32, status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+// doIdempotent 发送一个带 Idempotency-Key 的请求
+func doIdempotent(handler http.HandlerFunc, path, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	withBodyLimit(jsonBodyLimit, withIdempotency(handler))(w, r)
+	return w
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	setTestConfig(t, &Config{IdempotencyWindow: 60})
+	var calls atomic.Int32
+	handler := idempotentHandler(&calls, http.StatusOK, `{"id":"chatcmpl-1"}`)
+
+	first := doIdempotent(handler, "/v1/chat/completions", "replay-1", `{"model":"qwen"}`)
+	second := doIdempotent(handler, "/v1/chat/completions", "replay-1", `{"model":"qwen"}`)
+	if calls.Load() != 1 {
+		t.Fatalf("处理函数被调用 %d 次，期望 1", calls.Load())
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("重放得到 %d %q，期望 %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("只有重放的响应应带 Idempotent-Replayed 头")
+	}
+
+	// 没有Key的请求每次都处理
+	doIdempotent(handler, "/v1/chat/completions", "", `{"model":"qwen"}`)
+	doIdempotent(handler, "/v1/chat/completions", "", `{"model":"qwen"}`)
+	if calls.Load() != 3 {
+		t.Errorf("没有Key时处理函数被调用 %d 次，期望 3", calls.Load())
+	}
+}
+
+func TestIdempotencyKeyReused(t *testing.T) {
+	setTestConfig(t, &Config{IdempotencyWindow: 60})
+	tests := []struct {
+		name       string
+		path, body string
+	}{
+		{"请求体不同", "/v1/chat/completions", `{"model":"other"}`},
+		{"路径不同", "/v1/completions", `{"model":"qwen"}`},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			handler := idempotentHandler(&calls, http.StatusOK, `{}`)
+			key := "reused-" + string(rune('a'+i))
+			doIdempotent(handler, "/v1/chat/completions", key, `{"model":"qwen"}`)
+			w := doIdempotent(handler, tt.path, key, tt.body)
+			if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "idempotency_key_reused") {
+				t.Errorf("得到 %d %s，期望422", w.Code, w.Body)
+			}
+			if calls.Load() != 1 {
+				t.Errorf("处理函数被调用 %d 次，期望 1", calls.Load())
+			}
+		})
+	}
+}
+
+func TestIdempotencyNotStored(t *testing.T) {
+	setTestConfig(t, &Config{IdempotencyWindow: 60})
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"上游错误", http.StatusBadGateway, `{"error":{"message":"bad gateway"}}`},
+		{"限流", http.StatusTooManyRequests, `{"error":{"message":"slow down"}}`},
+		{"超过保存上限", http.StatusOK, strings.Repeat("x", maxIdempotentResponseBytes+1)},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			handler := idempotentHandler(&calls, tt.status, tt.body)
+			key := "not-stored-" + string(rune('a'+i))
+			for j := 0; j < 2; j++ {
+				w := doIdempotent(handler, "/v1/chat/completions", key, `{}`)
+				if w.Code != tt.status || w.Body.Len() != len(tt.body) {
+					t.Errorf("第%d次得到 %d（%d 字节），期望 %d（%d 字节）", j+1, w.Code, w.Body.Len(), tt.status, len(tt.body))
+				}
+			}
+			if calls.Load() != 2 {
+				t.Errorf("处理函数被调用 %d 次，期望重试时重新处理", calls.Load())
+			}
+		})
+	}
+	if n := idempotencyKeys.bytes.Load(); n < 0 {
+		t.Errorf("保存的字节数为负: %d", n)
+	}
+}
+
+func TestIdempotencyRejectsBadRequests(t *testing.T) {
+	setTestConfig(t, &Config{IdempotencyWindow: 60})
+	var calls atomic.Int32
+	handler := idempotentHandler(&calls, http.StatusOK, `{}`)
+
+	if w := doIdempotent(handler, "/v1/chat/completions", strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("过长的Key得到 %d，期望400", w.Code)
+	}
+	huge := `{"prompt":"` + strings.Repeat("x", maxJSONBodyBytes) + `"}`
+	if w := doIdempotent(handler, "/v1/chat/completions", "too-large", huge); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("过大的请求体得到 %d，期望413", w.Code)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("处理函数被调用 %d 次，期望 0", calls.Load())
+	}
+}
+
+// multipartBody 用指定的boundary构建multipart表单
+func multipartBody(t *testing.T, boundary string, fields map[string]string, file string) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range sortedKeys(fields) {
+		mw.WriteField(name, fields[name])
+	}
+	part, _ := mw.CreateFormFile("file", "audio.mp3")
+	part.Write([]byte(file))
+	mw.Close()
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestIdempotencyRequestHash(t *testing.T) {
+	fields := map[string]string{"model": "whisper-1", "response_format": "srt"}
+	ct1, body1 := multipartBody(t, "boundary-one", fields, "audio-bytes")
+	ct2, body2 := multipartBody(t, "boundary-two", fields, "audio-bytes")
+	hash := idempotencyRequestHash(http.MethodPost, "/v1/audio/transcriptions", ct1, body1)
+	if got := idempotencyRequestHash(http.MethodPost, "/v1/audio/transcriptions", ct2, body2); got != hash {
+		t.Error("只有boundary不同的表单应得到相同的摘要")
+	}
+
+	ct3, body3 := multipartBody(t, "boundary-one", fields, "other-audio")
+	ct4, body4 := multipartBody(t, "boundary-one", map[string]string{"model": "whisper-1"}, "audio-bytes")
+	tests := []struct {
+		name                      string
+		method, path, contentType string
+		body                      []byte
+	}{
+		{"文件内容不同", http.MethodPost, "/v1/audio/transcriptions", ct3, body3},
+		{"字段不同", http.MethodPost, "/v1/audio/transcriptions", ct4, body4},
+		{"路径不同", http.MethodPost, "/v1/images/generations", ct1, body1},
+		{"方法不同", http.MethodPut, "/v1/audio/transcriptions", ct1, body1},
+	}
+	for _, tt := range tests {
+		if got := idempotencyRequestHash(tt.method, tt.path, tt.contentType, tt.body); got == hash {
+			t.Errorf("%s: 摘要不应相同", tt.name)
+		}
+	}
+
+	// 不是multipart或无法解析的表单按原始请求体计算
+	jsonHash := idempotencyRequestHash(http.MethodPost, "/v1/chat/completions", "application/json", []byte(`{"a":1}`))
+	if jsonHash == idempotencyRequestHash(http.MethodPost, "/v1/chat/completions", "application/json", []byte(`{"a":2}`)) {
+		t.Error("不同的JSON请求体应得到不同的摘要")
+	}
+	if _, ok := multipartDigest("multipart/form-data; boundary=x", []byte("garbage")); ok {
+		t.Error("无法解析的表单不应按字段计算摘要")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	maxImagesPerRequest = 4                // 通义万相一次最多生成4张
+	maxImageDownload    = 32 * 1024 * 1024 // b64_json 下载单张图片的大小上限
+)
+
+// imageSizePattern OpenAI格式的图片尺寸，如 1024x1024
+var imageSizePattern = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
+// ImageRequest OpenAI格式的图片生成请求（/v1/images/generations）
+type ImageRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt"` // DashScope参数：反向提示词
+	N              *int   `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"` // url（默认）/ b64_json
+	Seed           *int   `json:"seed"`            // DashScope参数：随机种子
+	Async          bool   `json:"async"`           // 只提交任务，立即返回任务ID
+	User           string `json:"user"`
+}
+
+// dashscopeImageOutput 图片生成任务的结果
+type dashscopeImageOutput struct {
+	Output struct {
+		Results []struct {
+			URL          string `json:"url"`
+			ActualPrompt string `json:"actual_prompt"`
+			Code         string `json:"code"`
+			Message      string `json:"message"`
+		} `json:"results"`
+	} `json:"output"`
+	Usage struct {
+		ImageCount int `json:"image_count"`
+	} `json:"usage"`
+}
+
+// getImageSynthesisEndpoint 获取DashScope文生图接口地址
+func getImageSynthesisEndpoint(cfg *Config) string {
+	return cfg.BaseURL + "/api/v1/services/aigc/text2image/image-synthesis"
+}
+
+// validate 检查请求参数
+func (req ImageRequest) validate() error {
+	switch {
+	case req.Prompt == "":
+		return fmt.Errorf("prompt字段不能为空")
+	case req.N != nil && (*req.N < 1 || *req.N > maxImagesPerRequest):
+		return fmt.Errorf("n 必须在1到%d之间", maxImagesPerRequest)
+	case req.Size != "" && !imageSizePattern.MatchString(req.Size):
+		return fmt.Errorf("无效的 size %q（格式如 1024x1024）", req.Size)
+	case req.ResponseFormat != "" && req.ResponseFormat != "url" && req.ResponseFormat != "b64_json":
+		return fmt.Errorf("无效的 response_format %q（可选 url、b64_json）", req.ResponseFormat)
+	}
+	return nil
+}
+
+// handleImageGenerations 处理OpenAI格式的图片生成请求，提交通义万相异步任务并轮询到完成
+// 请求中 async 为true时只提交任务，返回202和任务ID，之后通过 GET /v1/images/generations/{任务ID} 查询结果
+func handleImageGenerations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "只支持POST请求")
+		return
+	}
+	var req ImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "请求格式错误: "+err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	cfg := currentConfig()
+	clients := currentClients()
+	reportModel(r.Context(), req.Model)
+	if err := checkModelScope(r, req.Model); err != nil {
+		writeScopeError(w, err)
+		return
+	}
+	model := resolveServiceModel(cfg.ImageModels, cfg.ImageModel, req.Model)
+
+	input := map[string]interface{}{"prompt": req.Prompt}
+	if req.NegativePrompt != "" {
+		input["negative_prompt"] = req.NegativePrompt
+	}
+	parameters := map[string]interface{}{"n": 1}
+	if req.N != nil {
+		parameters["n"] = *req.N
+	}
+	if req.Size != "" {
+		parameters["size"] = strings.Replace(req.Size, "x", "*", 1)
+	}
+	if req.Seed != nil {
+		parameters["seed"] = *req.Seed
+	}
+	body, _ := json.Marshal(map[string]interface{}{"model": model, "input": input, "parameters": parameters})
+	endpoint := getImageSynthesisEndpoint(cfg)
+	log.Printf("提交图片生成任务到阿里云百炼: %s，模型 %s", endpoint, model)
+
+	if err := asyncTasks.CheckCapacity(requestScope(r)); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	task, route, err := submitTask(r.Context(), clients.client, resolveCredentials(cfg, requestTenant(r)), endpoint, body, nil)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	taskID := task.Output.TaskID
+	at := &asyncTask{
+		Kind:          "image",
+		Scope:         requestScope(r),
+		Route:         route,
+		Model:         req.Model,
+		UpstreamModel: model,
+		Format:        req.ResponseFormat,
+		Created:       time.Now(),
+	}
+	asyncTasks.Add(taskID, at)
+	if req.Async {
+		writeImageTaskStatus(w, taskID, at, task)
+		return
+	}
+
+	timeout := time.Duration(cfg.ImageTaskTimeout) * time.Second
+	interval := time.Duration(cfg.TaskPollInterval) * time.Second
+	task, err = waitTask(r.Context(), clients.client, route, getTaskEndpoint(cfg, taskID), interval, timeout)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if !task.Finished() {
+		// 任务已经提交并计费，与异步模式一样返回202和任务ID，幂等重试时重放这个响应而不是再提交一次
+		log.Printf("图片生成任务 %s 在 %d 秒内未完成，返回任务ID", taskID, cfg.ImageTaskTimeout)
+		writeImageTaskStatus(w, taskID, at, task)
+		return
+	}
+	writeImageTaskResult(w, r, taskID, at, task)
+}
+
+// handleImageTask 查询图片生成任务（GET /v1/images/generations/{任务ID}），只能查询自己提交的任务
+// 任务未完成时返回202和任务状态，完成后返回与同步请求相同的结果
+func handleImageTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "只支持GET请求")
+		return
+	}
+	taskID := strings.TrimPrefix(r.URL.Path, "/v1/images/generations/")
+	at, ok := asyncTasks.Get(taskID, "image", requestScope(r))
+	if !ok {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("图片生成任务 %s 不存在或已过期", taskID))
+		return
+	}
+	reportModel(r.Context(), at.Model)
+
+	cfg := currentConfig()
+	task, err := pollTask(r.Context(), currentClients().client, at.Route, getTaskEndpoint(cfg, taskID))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if !task.Finished() {
+		writeImageTaskStatus(w, taskID, at, task)
+		return
+	}
+	writeImageTaskResult(w, r, taskID, at, task)
+}
+
+// writeImageTaskStatus 返回未完成的任务的状态
+func writeImageTaskStatus(w http.ResponseWriter, taskID string, at *asyncTask, task *dashscopeTask) {
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"id":      taskID,
+		"object":  "image.generation.task",
+		"created": at.Created.Unix(),
+		"model":   at.Model,
+		"status":  strings.ToLower(task.Output.TaskStatus),
+	})
+}
+
+// writeImageTaskResult 返回已结束的任务的结果，第一次拿到成功结果时计入用量
+func writeImageTaskResult(w http.ResponseWriter, r *http.Request, taskID string, at *asyncTask, task *dashscopeTask) {
+	if !task.Succeeded() {
+		writeTaskFailure(w, taskID, task.Output.Code, task.Output.Message)
+		return
+	}
+	var output dashscopeImageOutput
+	if err := json.Unmarshal(task.body, &output); err != nil {
+		log.Printf("解析图片生成结果失败: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "上游响应格式错误")
+		return
+	}
+
+	// 部分图片失败时只返回成功的图片，全部失败时返回第一个错误
+	var data []map[string]interface{}
+	for _, result := range output.Output.Results {
+		if result.URL == "" {
+			log.Printf("图片生成任务 %s 中的图片失败: %s %s", taskID, result.Code, result.Message)
+			continue
+		}
+		item := map[string]interface{}{"url": result.URL}
+		if result.ActualPrompt != "" {
+			item["revised_prompt"] = result.ActualPrompt
+		}
+		data = append(data, item)
+	}
+	if len(data) == 0 {
+		code, message := "", "没有生成图片"
+		if len(output.Output.Results) > 0 {
+			code, message = output.Output.Results[0].Code, output.Output.Results[0].Message
+		}
+		writeTaskFailure(w, taskID, code, message)
+		return
+	}
+
+	if asyncTasks.MarkReported(at) {
+		images := output.Usage.ImageCount
+		if images == 0 {
+			images = len(data)
+		}
+		reportTokens(r.Context(), modelTokens{ModelID: at.UpstreamModel, Images: images})
+	}
+
+	if at.Format == "b64_json" {
+		// 图片地址在OSS上，不经过Key池，避免把DashScope的API Key发送到其他主机
+		client := directClient(currentConfig(), currentClients())
+		for _, item := range data {
+			image, err := downloadImage(r.Context(), client, item["url"].(string))
+			if err != nil {
+				log.Printf("下载生成的图片失败: %v", err)
+				writeOpenAIError(w, http.StatusBadGateway, "server_error", "下载生成的图片失败: "+err.Error())
+				return
+			}
+			delete(item, "url")
+			item["b64_json"] = base64.StdEncoding.EncodeToString(image)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      taskID,
+		"created": at.Created.Unix(),
+		"data":    data,
+	})
+}
+
+// downloadImage 下载生成的图片
+func downloadImage(ctx context.Context, client *http.Client, imageURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxImageDownload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > maxImageDownload {
+		return nil, fmt.Errorf("图片超过 %d MB", maxImageDownload/1024/1024)
+	}
+	return image, nil
+}
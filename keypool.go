@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoUpstreamKey 所有上游API Key都被暂停或停用
+var errNoUpstreamKey = errors.New("没有可用的上游API Key，请稍后重试")
+
+// APIKeyConfig 上游API Key池中的一个Key
+type APIKeyConfig struct {
+	Name   string `yaml:"name"`   // 显示名称，用于日志和管理接口，为空时使用打码后的Key
+	Key    string `yaml:"key"`    // DashScope API Key
+	Weight int    `yaml:"weight"` // 权重（weighted策略），0表示1
+}
+
+// poolKey Key池中单个Key的运行状态
+type poolKey struct {
+	name          string
+	key           string
+	weight        int
+	current       int       // 平滑加权轮询的当前值
+	benchedUntil  time.Time // 暂停到该时间（限流或Key无效）
+	disabled      bool      // 欠费等原因永久停用，需通过管理接口恢复
+	lastErrorCode string
+	lastErrorAt   time.Time
+	requests      int64
+	failures      int64
+}
+
+// keyPool 上游API Key池
+// 按轮询或加权轮询分配Key；返回 Throttling / InvalidApiKey 的Key暂停一段时间，返回 Arrearage 的Key永久停用
+type keyPool struct {
+	mu               sync.Mutex
+	keys             []*poolKey
+	weighted         bool
+	throttleCooldown time.Duration
+	invalidCooldown  time.Duration
+}
+
+// upstreamKeys 全局上游Key池
+var upstreamKeys = &keyPool{}
+
+// Configure 根据配置更新Key池，热加载时保留仍在池中的Key的状态
+func (p *keyPool) Configure(cfg *Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existing := make(map[string]*poolKey, len(p.keys))
+	for _, k := range p.keys {
+		existing[k.key] = k
+	}
+
+	var keys []*poolKey
+	seen := make(map[string]bool)
+	for _, kc := range configuredAPIKeys(cfg) {
+		if seen[kc.Key] {
+			continue
+		}
+		seen[kc.Key] = true
+		k, ok := existing[kc.Key]
+		if !ok {
+			k = &poolKey{key: kc.Key}
+		}
+		k.name = kc.Name
+		if k.name == "" {
+			k.name = maskAPIKey(kc.Key)
+		}
+		k.weight = kc.Weight
+		if k.weight <= 0 {
+			k.weight = 1
+		}
+		keys = append(keys, k)
+	}
+
+	p.keys = keys
+	p.weighted = cfg.APIKeyStrategy == "weighted"
+	p.throttleCooldown = time.Duration(cfg.APIKeyThrottleCooldown) * time.Second
+	p.invalidCooldown = time.Duration(cfg.APIKeyInvalidCooldown) * time.Second
+}
+
+// configuredAPIKeys 返回配置中的所有上游Key：api_key 在前，api_keys 在后
+func configuredAPIKeys(cfg *Config) []APIKeyConfig {
+	var keys []APIKeyConfig
+	if cfg.APIKey != "" {
+		keys = append(keys, APIKeyConfig{Key: cfg.APIKey})
+	}
+	return append(keys, cfg.APIKeys...)
+}
+
+// available Key当前是否可用
+func (k *poolKey) available(now time.Time) bool {
+	return !k.disabled && !now.Before(k.benchedUntil)
+}
+
+// Pick 选择一个可用的Key（平滑加权轮询），exclude中的Key不参与选择；没有可用Key时返回nil
+func (p *keyPool) Pick(exclude map[*poolKey]bool) *poolKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *poolKey
+	total := 0
+	for _, k := range p.keys {
+		if !k.available(now) || exclude[k] {
+			continue
+		}
+		weight := 1
+		if p.weighted {
+			weight = k.weight
+		}
+		k.current += weight
+		total += weight
+		if best == nil || k.current > best.current {
+			best = k
+		}
+	}
+	if best != nil {
+		best.current -= total
+		best.requests++
+	}
+	return best
+}
+
+// Available 是否至少有一个可用的Key
+func (p *keyPool) Available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, k := range p.keys {
+		if k.available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report 根据上游错误码更新Key状态，返回该Key是否被暂停或停用（可以换Key重试）
+func (p *keyPool) Report(k *poolKey, statusCode int, code string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case code == "Arrearage":
+		k.disabled = true
+		log.Printf("上游API Key %s 欠费，已停用", k.name)
+	case strings.HasPrefix(code, "Throttling") || (code == "" && statusCode == http.StatusTooManyRequests):
+		k.benchedUntil = now.Add(p.throttleCooldown)
+		log.Printf("上游API Key %s 被限流(%s)，暂停 %s", k.name, code, p.throttleCooldown)
+	case code == "InvalidApiKey" || (code == "" && statusCode == http.StatusUnauthorized):
+		k.benchedUntil = now.Add(p.invalidCooldown)
+		log.Printf("上游API Key %s 无效，暂停 %s", k.name, p.invalidCooldown)
+	default:
+		return false
+	}
+	if code == "" {
+		code = "HTTP " + strconv.Itoa(statusCode)
+	}
+	k.failures++
+	k.lastErrorCode = code
+	k.lastErrorAt = now
+	return true
+}
+
+// Enable 恢复被暂停或停用的Key，name为空时恢复全部，返回恢复的数量
+func (p *keyPool) Enable(name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, k := range p.keys {
+		if name == "" || k.name == name {
+			k.disabled = false
+			k.benchedUntil = time.Time{}
+			n++
+		}
+	}
+	return n
+}
+
+// upstreamKeyStatus Key池状态，用于管理接口
+type upstreamKeyStatus struct {
+	Name          string `json:"name"`
+	Key           string `json:"key"`
+	Weight        int    `json:"weight"`
+	Status        string `json:"status"` // active / benched / disabled
+	BenchedUntil  string `json:"benched_until,omitempty"`
+	LastErrorCode string `json:"last_error_code,omitempty"`
+	LastErrorAt   string `json:"last_error_at,omitempty"`
+	Requests      int64  `json:"requests"`
+	Failures      int64  `json:"failures"`
+}
+
+// Status 返回所有Key的状态，Key本身打码显示
+func (p *keyPool) Status() []upstreamKeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	result := make([]upstreamKeyStatus, 0, len(p.keys))
+	for _, k := range p.keys {
+		s := upstreamKeyStatus{
+			Name:          k.name,
+			Key:           maskAPIKey(k.key),
+			Weight:        k.weight,
+			Status:        "active",
+			LastErrorCode: k.lastErrorCode,
+			Requests:      k.requests,
+			Failures:      k.failures,
+		}
+		switch {
+		case k.disabled:
+			s.Status = "disabled"
+		case now.Before(k.benchedUntil):
+			s.Status = "benched"
+			s.BenchedUntil = k.benchedUntil.Format(time.RFC3339)
+		}
+		if !k.lastErrorAt.IsZero() {
+			s.LastErrorAt = k.lastErrorAt.Format(time.RFC3339)
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// maskAPIKey 打码显示Key，只保留前3位和后4位
+func maskAPIKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:3] + "****" + key[len(key)-4:]
+}
+
+// keyPoolTransport 为上游请求分配Key池中的Key
+// 请求已带有Authorization时（如租户自己的Key）不经过Key池；
+// Key被限流、无效或欠费时，在请求体可以重放的情况下换下一个Key重试
+type keyPoolTransport struct {
+	next http.RoundTripper
+	pool *keyPool
+}
+
+func (t *keyPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	tried := make(map[*poolKey]bool)
+	for {
+		key := t.pool.Pick(tried)
+		if key == nil {
+			return nil, errNoUpstreamKey
+		}
+		tried[key] = true
+
+		attempt := req.Clone(req.Context())
+		if len(tried) > 1 {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+		}
+		attempt.Header.Set("Authorization", "Bearer "+key.key)
+
+		resp, err := t.next.RoundTrip(attempt)
+		if err != nil || resp.StatusCode < 400 {
+			return resp, err
+		}
+
+		// 读取错误响应中的错误码，再把响应体放回去交给调用方处理
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		var upstreamErr struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(body, &upstreamErr)
+
+		if !t.pool.Report(key, resp.StatusCode, upstreamErr.Code) || req.GetBody == nil || !t.pool.hasOther(tried) {
+			return resp, nil
+		}
+		log.Printf("使用下一个上游API Key重试")
+	}
+}
+
+// hasOther 除已尝试过的Key外是否还有可用的Key
+func (p *keyPool) hasOther(tried map[*poolKey]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, k := range p.keys {
+		if k.available(now) && !tried[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAPIKeysEnv 解析 ALIYUN_API_KEYS 环境变量，格式：Key[:权重],Key[:权重]
+func parseAPIKeysEnv(value string) []APIKeyConfig {
+	var keys []APIKeyConfig
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kc := APIKeyConfig{Key: item}
+		if key, weight, ok := strings.Cut(item, ":"); ok {
+			if w, err := strconv.Atoi(weight); err == nil {
+				kc = APIKeyConfig{Key: key, Weight: w}
+			}
+		}
+		keys = append(keys, kc)
+	}
+	return keys
+}
+
+// handleAdminUpstreamKeys 管理接口：GET 查看上游Key池状态，POST 恢复被暂停或停用的Key
+func handleAdminUpstreamKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"strategy": currentConfig().APIKeyStrategy,
+			"keys":     upstreamKeys.Status(),
+		})
+	case http.MethodPost:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "请求格式错误: "+err.Error())
+				return
+			}
+		}
+		n := upstreamKeys.Enable(body.Name)
+		if n == 0 {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("上游API Key不存在: %s", body.Name))
+			return
+		}
+		log.Printf("管理接口恢复了 %d 个上游API Key", n)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": n})
+	default:
+		http.Error(w, "只支持GET和POST请求", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestKeyPool 创建Key池，Key名与Key相同
+func newTestKeyPool(strategy string, keys ...APIKeyConfig) *keyPool {
+	for i := range keys {
+		keys[i].Name = keys[i].Key
+	}
+	p := &keyPool{}
+	p.Configure(&Config{
+		APIKeys:                keys,
+		APIKeyStrategy:         strategy,
+		APIKeyThrottleCooldown: 60,
+		APIKeyInvalidCooldown:  300,
+	})
+	return p
+}
+
+// pickNames 连续选择n次，返回选中的Key名
+func pickNames(p *keyPool, n int) string {
+	var names []string
+	for i := 0; i < n; i++ {
+		k := p.Pick(nil)
+		if k == nil {
+			names = append(names, "-")
+			continue
+		}
+		names = append(names, k.name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestKeyPoolPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		keys     []APIKeyConfig
+		want     string
+	}{
+		{"轮询", "round_robin", []APIKeyConfig{{Key: "a", Weight: 5}, {Key: "b"}, {Key: "c"}}, "a,b,c,a,b,c"},
+		{"平滑加权轮询", "weighted", []APIKeyConfig{{Key: "a", Weight: 5}, {Key: "b", Weight: 1}, {Key: "c", Weight: 1}}, "a,a,b,a,c,a,a"},
+		{"权重为0按1计算", "weighted", []APIKeyConfig{{Key: "a", Weight: 2}, {Key: "b"}}, "a,b,a,a,b,a"},
+		{"单个Key", "weighted", []APIKeyConfig{{Key: "a", Weight: 3}}, "a,a,a"},
+		{"空池", "round_robin", nil, "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestKeyPool(tt.strategy, tt.keys...)
+			if got := pickNames(p, strings.Count(tt.want, ",")+1); got != tt.want {
+				t.Errorf("得到 %s，期望 %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyPoolPickExclude(t *testing.T) {
+	p := newTestKeyPool("round_robin", APIKeyConfig{Key: "a"}, APIKeyConfig{Key: "b"})
+	a := p.Pick(nil)
+	if k := p.Pick(map[*poolKey]bool{a: true}); k == nil || k.name != "b" {
+		t.Fatalf("排除a后应选择b，得到 %v", k)
+	}
+	if k := p.Pick(map[*poolKey]bool{p.keys[0]: true, p.keys[1]: true}); k != nil {
+		t.Errorf("全部排除时应返回nil，得到 %s", k.name)
+	}
+}
+
+func TestKeyPoolReport(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		code       string
+		wantRetry  bool
+		wantStatus string
+		wantCode   string
+	}{
+		{"限流", http.StatusTooManyRequests, "Throttling.RateQuota", true, "benched", "Throttling.RateQuota"},
+		{"没有错误码的429", http.StatusTooManyRequests, "", true, "benched", "HTTP 429"},
+		{"Key无效", http.StatusUnauthorized, "InvalidApiKey", true, "benched", "InvalidApiKey"},
+		{"没有错误码的401", http.StatusUnauthorized, "", true, "benched", "HTTP 401"},
+		{"欠费", http.StatusBadRequest, "Arrearage", true, "disabled", "Arrearage"},
+		{"请求错误不影响Key", http.StatusBadRequest, "InvalidParameter", false, "active", ""},
+		{"服务端错误不影响Key", http.StatusInternalServerError, "", false, "active", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestKeyPool("round_robin", APIKeyConfig{Key: "a"}, APIKeyConfig{Key: "b"})
+			a := p.Pick(nil)
+			if got := p.Report(a, tt.statusCode, tt.code); got != tt.wantRetry {
+				t.Errorf("Report返回 %v，期望 %v", got, tt.wantRetry)
+			}
+			status := p.Status()[0]
+			if status.Status != tt.wantStatus || status.LastErrorCode != tt.wantCode {
+				t.Errorf("状态 %s/%q，期望 %s/%q", status.Status, status.LastErrorCode, tt.wantStatus, tt.wantCode)
+			}
+			// 被暂停或停用的Key不再被选中
+			if tt.wantStatus != "active" {
+				if got := pickNames(p, 3); got != "b,b,b" {
+					t.Errorf("暂停后得到 %s，期望 b,b,b", got)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyPoolBenchExpiresAndEnable(t *testing.T) {
+	p := newTestKeyPool("round_robin", APIKeyConfig{Key: "a"}, APIKeyConfig{Key: "b"})
+	a, b := p.keys[0], p.keys[1]
+	p.Report(a, http.StatusTooManyRequests, "Throttling")
+	p.Report(b, http.StatusBadRequest, "Arrearage")
+	if p.Available() {
+		t.Fatal("所有Key都被暂停或停用时不应可用")
+	}
+
+	// 暂停到期后自动恢复，停用的Key需要手动恢复
+	a.benchedUntil = time.Now().Add(-time.Second)
+	if got := pickNames(p, 2); got != "a,a" {
+		t.Errorf("暂停到期后得到 %s，期望 a,a", got)
+	}
+	if n := p.Enable("b"); n != 1 {
+		t.Errorf("Enable返回 %d，期望 1", n)
+	}
+	if n := p.Enable("missing"); n != 0 {
+		t.Errorf("Enable不存在的Key返回 %d，期望 0", n)
+	}
+	if got := pickNames(p, 2); !strings.Contains(got, "b") {
+		t.Errorf("恢复后得到 %s，期望包含b", got)
+	}
+}
+
+func TestKeyPoolConfigureKeepsState(t *testing.T) {
+	p := newTestKeyPool("round_robin", APIKeyConfig{Key: "a"}, APIKeyConfig{Key: "b"})
+	p.Report(p.keys[0], http.StatusBadRequest, "Arrearage")
+
+	// 热加载：a保留停用状态，重复的Key只保留一个，api_key排在api_keys前面
+	p.Configure(&Config{
+		APIKey:         "c",
+		APIKeys:        []APIKeyConfig{{Key: "a", Name: "a"}, {Key: "a", Name: "dup"}},
+		APIKeyStrategy: "weighted",
+	})
+	status := p.Status()
+	if len(status) != 2 {
+		t.Fatalf("得到 %d 个Key，期望 2", len(status))
+	}
+	if status[0].Name != maskAPIKey("c") || status[0].Status != "active" {
+		t.Errorf("第一个Key %+v，期望打码的c", status[0])
+	}
+	if status[1].Name != "a" || status[1].Status != "disabled" || status[1].Weight != 1 {
+		t.Errorf("第二个Key %+v，期望停用的a", status[1])
+	}
+}
+
+func TestParseAPIKeysEnv(t *testing.T) {
+	got := parseAPIKeysEnv(" sk-a:3, sk-b ,,sk-c:x")
+	want := []APIKeyConfig{{Key: "sk-a", Weight: 3}, {Key: "sk-b"}, {Key: "sk-c:x"}}
+	if len(got) != len(want) {
+		t.Fatalf("得到 %+v，期望 %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("第%d个 %+v，期望 %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestKeyPoolTransportRetriesNextKey(t *testing.T) {
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen = append(seen, r.Header.Get("Authorization")+" "+string(body))
+		if r.Header.Get("Authorization") == "Bearer a" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":"Throttling.RateQuota","message":"rate limited"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer upstream.Close()
+
+	p := newTestKeyPool("round_robin", APIKeyConfig{Key: "a"}, APIKeyConfig{Key: "b"})
+	client := &http.Client{Transport: &keyPoolTransport{next: http.DefaultTransport, pool: p}}
+	resp, err := client.Post(upstream.URL, "application/json", strings.NewReader(`{"q":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("状态码 %d，期望 200", resp.StatusCode)
+	}
+	if want := []string{`Bearer a {"q":1}`, `Bearer b {"q":1}`}; strings.Join(seen, "|") != strings.Join(want, "|") {
+		t.Errorf("上游收到 %q，期望 %q", seen, want)
+	}
+
+	// 自带Authorization的请求（租户自己的Key）不经过Key池
+	seen = nil
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set("Authorization", "Bearer tenant")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(seen) != 1 || seen[0] != "Bearer tenant " {
+		t.Errorf("上游收到 %q，期望只用租户的Key", seen)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +15,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +33,8 @@ type OpenAIRequest struct {
 	Stop             []string               `json:"stop,omitempty"`
 	Functions        []interface{}          `json:"functions,omitempty"`
 	FunctionCall     interface{}            `json:"function_call,omitempty"`
+	HasThoughts      *bool                  `json:"has_thoughts,omitempty"` // 百炼应用参数：是否输出思考过程
+	SessionID        string                 `json:"-"`                      // 百炼会话ID，只由内部前端（Responses API）设置，不对Chat Completions客户端开放
 	ExtraBody        map[string]interface{} `json:"-"` // 用于存储其他未定义的字段
 }
 
@@ -64,19 +70,80 @@ type Usage struct {
 }
 
 // Config 配置结构
+// yaml标签对应配置文件（CONFIG_FILE）中的键名，与环境变量名的小写形式一致
 type Config struct {
-	Port                string
-	AppID               string
-	APIKey              string
-	BaseURL             string
-	ProxyURL            string
-	UseNative           bool   // 是否使用原生API格式
-	RequestTimeout      int    // 非流式请求超时时间（秒）
-	StreamTimeout       int    // 流式请求超时时间（秒）
-	MaxIdleConns        int    // 最大空闲连接数
-	MaxIdleConnsPerHost int    // 每个主机最大空闲连接数
-	MaxConnsPerHost     int    // 每个主机最大连接数
-	IdleConnTimeout     int    // 空闲连接超时时间（秒）
+	Port                     string                  `yaml:"port"`
+	AppID                    string                  `yaml:"app_id"`
+	APIKey                   string                  `yaml:"api_key"`
+	APIKeys                  []APIKeyConfig          `yaml:"api_keys"`                  // 上游API Key池，与api_key一起轮流使用
+	APIKeyStrategy           string                  `yaml:"api_key_strategy"`          // Key池分配策略：round_robin / weighted
+	APIKeyThrottleCooldown   int                     `yaml:"api_key_throttle_cooldown"` // Key被限流后暂停的时间（秒）
+	APIKeyInvalidCooldown    int                     `yaml:"api_key_invalid_cooldown"`  // Key无效后暂停的时间（秒）
+	StoreFile                string                  `yaml:"store_file"`                // 管理接口创建的Key、租户和用量的存储文件，修改后需重启
+	AuditLogFile             string                  `yaml:"audit_log_file"`            // 管理操作审计日志文件（每行一个JSON）
+	AdminToken               string                  `yaml:"admin_token"`               // 管理接口认证Token，为空时不启用管理接口
+	BaseURL                  string                  `yaml:"base_url"`
+	ProxyURL                 string                  `yaml:"proxy_url"`                   // 出站代理地址（http/https/socks5）
+	ProxyUsername            string                  `yaml:"proxy_username"`              // 代理认证用户名，设置后覆盖URL中的认证信息
+	ProxyPassword            string                  `yaml:"proxy_password"`              // 代理认证密码
+	NoProxy                  string                  `yaml:"no_proxy"`                    // 不走代理的目标，逗号分隔
+	UpstreamCAFile           string                  `yaml:"upstream_ca_file"`            // 追加信任的CA证书（PEM），用于出口TLS解密的企业网络
+	UpstreamTLSMinVersion    string                  `yaml:"upstream_tls_min_version"`    // 访问上游的最低TLS版本：1.2 / 1.3
+	UpstreamTLSServerName    string                  `yaml:"upstream_tls_server_name"`    // 覆盖TLS握手的SNI和证书校验使用的主机名
+	UpstreamCertPins         string                  `yaml:"upstream_cert_pins"`          // DashScope证书公钥固定（sha256/Base64），逗号分隔
+	UseNative                bool                    `yaml:"use_native_api"`              // 是否使用原生API格式
+	RequestTimeout           int                     `yaml:"request_timeout"`             // 非流式请求超时时间（秒）
+	StreamTimeout            int                     `yaml:"stream_timeout"`              // 流式请求总时长上限（秒），0表示不限制
+	MaxIdleConns             int                     `yaml:"max_idle_conns"`              // 最大空闲连接数
+	MaxIdleConnsPerHost      int                     `yaml:"max_idle_conns_per_host"`     // 每个主机最大空闲连接数
+	MaxConnsPerHost          int                     `yaml:"max_conns_per_host"`          // 每个主机最大连接数
+	IdleConnTimeout          int                     `yaml:"idle_conn_timeout"`           // 空闲连接超时时间（秒）
+	AggregateStream          bool                    `yaml:"non_stream_aggregate"`        // 非流式请求是否通过上游流式接口聚合
+	StreamIdleTimeout        int                     `yaml:"stream_idle_timeout"`         // 上游流式事件最大空闲间隔（秒）
+	StreamFirstTokenTimeout  int                     `yaml:"stream_first_token_timeout"`  // 等待上游首个事件的超时时间（秒）
+	StreamHeartbeatInterval  int                     `yaml:"stream_heartbeat_interval"`   // 向客户端发送SSE心跳的间隔（秒），0表示不发送
+	ShutdownTimeout          int                     `yaml:"shutdown_timeout"`            // 优雅关闭时等待进行中请求完成的最长时间（秒）
+	ShutdownDelay            int                     `yaml:"shutdown_delay"`              // 收到关闭信号后，停止接受新连接前保持未就绪状态的时间（秒）
+	ReadinessProbeURL        string                  `yaml:"readiness_probe_url"`         // 就绪检查探测的上游地址，为空时使用模型列表接口
+	ReadinessProbeInterval   int                     `yaml:"readiness_probe_interval"`    // 上游探测结果缓存时间（秒）
+	CircuitBreakerThreshold  int                     `yaml:"circuit_breaker_threshold"`   // 连续失败多少次后熔断，0表示不启用
+	CircuitBreakerCooldown   int                     `yaml:"circuit_breaker_cooldown"`    // 熔断后的冷却时间（秒）
+	ConfigWatchInterval      int                     `yaml:"config_watch_interval"`       // 配置文件变更检查间隔（秒），0表示只响应SIGHUP
+	Apps                     map[string]AppConfig    `yaml:"apps"`                        // 模型名 -> 百炼应用，未匹配的模型使用AppID
+	TLSCertFile              string                  `yaml:"tls_cert_file"`               // 服务端证书，与私钥同时设置时启用HTTPS
+	TLSKeyFile               string                  `yaml:"tls_key_file"`                // 服务端私钥
+	TLSClientCAFile          string                  `yaml:"tls_client_ca_file"`          // 校验客户端证书的CA（mTLS）
+	TLSClientAuth            string                  `yaml:"tls_client_auth"`             // 客户端证书校验方式：none / optional / require
+	TLSReloadInterval        int                     `yaml:"tls_reload_interval"`         // 证书文件变更检查间隔（秒），0表示不自动重新加载
+	TLSClientTenants         map[string]string       `yaml:"tls_client_tenants"`          // 客户端证书标识（CN/SAN） -> 租户
+	Tenants                  map[string]TenantConfig `yaml:"tenants"`                     // 租户名 -> 租户的百炼凭证、业务空间和应用
+	ClientKeys               []ClientKeyConfig       `yaml:"client_keys"`                 // 客户端Key，配置后请求必须携带其中之一
+	Prices                   map[string]PriceConfig  `yaml:"prices"`                      // 模型名或上游model_id -> 每千token价格，用于估算费用
+	BudgetWarnPercent        int                     `yaml:"budget_warn_percent"`         // 费用达到预算的百分之多少时在响应头中提醒
+	ResponseCache            bool                    `yaml:"response_cache"`              // 是否缓存确定性请求（temperature为0）的回答
+	ResponseCacheTTL         int                     `yaml:"response_cache_ttl"`          // 缓存的回答的有效期（秒）
+	ResponseCacheMaxEntries  int                     `yaml:"response_cache_max_entries"`  // 最多缓存的回答条数，0表示不限制
+	ResponseCacheMaxMB       int                     `yaml:"response_cache_max_mb"`       // 缓存占用的内存上限（MB），0表示不限制
+	RequestCoalescing        bool                    `yaml:"request_coalescing"`          // 相同的确定性请求同时到达时只调用一次上游
+	IdempotencyWindow        int                     `yaml:"idempotency_window"`          // 带 Idempotency-Key 的请求的响应保存时间（秒），0表示不支持
+	EmbeddingModel           string                  `yaml:"embedding_model"`             // 默认的DashScope文本向量模型
+	EmbeddingModels          map[string]string       `yaml:"embedding_models"`            // 模型名 -> DashScope文本向量模型，未匹配的模型名使用EmbeddingModel
+	EmbeddingBatchSize       int                     `yaml:"embedding_batch_size"`        // 每次请求上游的最多文本条数，超过时分批请求，0表示不拆分
+	RerankModel              string                  `yaml:"rerank_model"`                // 默认的DashScope文本排序模型
+	RerankModels             map[string]string       `yaml:"rerank_models"`               // 模型名 -> DashScope文本排序模型，未匹配的模型名使用RerankModel
+	ImageModel               string                  `yaml:"image_model"`                 // 默认的DashScope图片生成模型
+	ImageModels              map[string]string       `yaml:"image_models"`                // 模型名 -> DashScope图片生成模型，未匹配的模型名使用ImageModel
+	ImageTaskTimeout         int                     `yaml:"image_task_timeout"`          // 等待图片生成任务完成的最长时间（秒）
+	TaskPollInterval         int                     `yaml:"task_poll_interval"`          // 轮询异步任务的初始间隔（秒），之后逐次增加到10秒
+	TranscriptionModel       string                  `yaml:"transcription_model"`         // 默认的DashScope录音文件识别模型
+	TranscriptionModels      map[string]string       `yaml:"transcription_models"`        // 模型名 -> DashScope录音文件识别模型，未匹配的模型名使用TranscriptionModel
+	TranscriptionTaskTimeout int                     `yaml:"transcription_task_timeout"`  // 等待录音文件识别任务完成的最长时间（秒）
+	TranscriptionMaxUploadMB int                     `yaml:"transcription_max_upload_mb"` // 上传的音频文件大小上限（MB）
+}
+
+// AppConfig 百炼应用配置，客户端通过请求中的model字段选择应用
+type AppConfig struct {
+	AppID string `yaml:"app_id" json:"app_id"`
 }
 
 // AliyunNativeRequest 阿里云百炼原生API请求格式
@@ -102,62 +169,189 @@ type AliyunNativeResponse struct {
 		} `json:"models"`
 	} `json:"usage"`
 	RequestID string `json:"request_id"`
+	// 流式响应中途出错时，事件中携带错误码和错误信息
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// upstreamClients 访问上游使用的HTTP客户端（复用连接，提高性能）
+// 配置热加载时整体替换，进行中的请求继续使用旧客户端
+type upstreamClients struct {
+	transport *http.Transport // 底层连接池，健康探测直接使用以绕过熔断器
+	client    *http.Client    // 非流式请求客户端
+	stream    *http.Client    // 流式请求专用客户端
 }
 
-var config Config
+var clientsValue atomic.Pointer[upstreamClients]
 
-// 全局HTTP客户端（复用连接，提高性能）
-var httpClient *http.Client
-var httpClientStream *http.Client // 流式请求专用客户端
+// currentClients 返回当前的上游HTTP客户端
+func currentClients() *upstreamClients {
+	return clientsValue.Load()
+}
 
 func main() {
 	// 加载配置
 	loadConfig()
+	cfg := currentConfig()
 
 	// 初始化HTTP客户端（配置连接池以支持高并发）
-	initHTTPClients()
-
-	// 设置路由
-	http.HandleFunc("/v1/chat/completions", handleChatCompletions)
-	http.HandleFunc("/health", handleHealth)
+	initHTTPClients(cfg, nil)
 
-	log.Printf("服务器启动，监听端口 %s", config.Port)
-	log.Printf("阿里云百炼应用ID: %s", config.AppID)
-	if config.UseNative {
-		log.Printf("API端点: %s (原生API格式)", getAliyunNativeEndpoint())
-	} else {
-		log.Printf("API端点: %s (兼容模式)", getAliyunEndpoint())
+	// 加载管理接口创建的Key、租户和用量，用量每10秒写入一次文件
+	if err := clientStore.Open(cfg.StoreFile); err != nil {
+		log.Fatalf("加载存储失败: %v", err)
 	}
-	
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
-		log.Fatalf("服务器启动失败: %v", err)
+	clientStore.StartFlusher(10 * time.Second)
+	// 在后台清理过期的 Idempotency-Key 响应
+	idempotencyKeys.StartExpirer(time.Minute)
+	// 在后台清理过期的异步任务
+	asyncTasks.StartExpirer(10 * time.Minute)
+
+	// 监听SIGHUP和配置文件变更，热加载配置
+	startConfigReloader()
+
+	// 设置路由：不使用http.DefaultServeMux，导入expvar会在上面注册不带认证的 /debug/vars
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleChatCompletions))))
+	mux.HandleFunc("/v1/completions", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleCompletions))))
+	mux.HandleFunc("/v1/messages", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleAnthropicMessages))))
+	mux.HandleFunc("/v1/responses", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleResponses))))
+	mux.HandleFunc("/v1/embeddings", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleEmbeddings))))
+	mux.HandleFunc("/v1/rerank", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleRerank))))
+	mux.HandleFunc("/v1/images/generations", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleImageGenerations))))
+	mux.HandleFunc("/v1/images/generations/", requireTaskPollKey(handleImageTask))
+	mux.HandleFunc("/v1/audio/transcriptions", requireClientKey(withBodyLimit(transcriptionBodyLimit, withIdempotency(handleTranscriptions))))
+	mux.HandleFunc("/v1/audio/transcriptions/", requireTaskPollKey(handleTranscriptionTask))
+	// Ollama兼容接口
+	mux.HandleFunc("/api/chat", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleOllamaChat))))
+	mux.HandleFunc("/api/generate", requireClientKey(withBodyLimit(jsonBodyLimit, withIdempotency(handleOllamaGenerate))))
+	mux.HandleFunc("/api/tags", requireClientKey(handleOllamaTags))
+	mux.HandleFunc("/api/version", requireClientKey(handleOllamaVersion))
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/livez", handleLivez)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/admin/upstream-keys", requireAdmin(handleAdminUpstreamKeys))
+	mux.HandleFunc("/admin/keys", requireAdmin(handleAdminKeys))
+	mux.HandleFunc("/admin/keys/", requireAdmin(handleAdminKeys))
+	mux.HandleFunc("/admin/tenants", requireAdmin(handleAdminTenants))
+	mux.HandleFunc("/admin/tenants/", requireAdmin(handleAdminTenants))
+	mux.HandleFunc("/admin/metrics", requireAdmin(expvar.Handler().ServeHTTP))
+
+	log.Printf("服务器启动，监听端口 %s", cfg.Port)
+	log.Printf("阿里云百炼应用ID: %s，按模型名映射的应用: %d 个", cfg.AppID, len(cfg.Apps))
+	if cfg.UseNative {
+		log.Printf("API端点: %s (原生API格式)", getAliyunNativeEndpoint(cfg, cfg.AppID))
+	} else {
+		log.Printf("API端点: %s (兼容模式)", getAliyunEndpoint(cfg, cfg.AppID))
 	}
+
+	runServer(&http.Server{Addr: ":" + cfg.Port, Handler: withClientIdentity(mux)})
+
+	// 退出前写入尚未保存的用量
+	clientStore.Flush()
 }
 
-// loadConfig 加载配置
+// loadConfig 加载配置：环境变量 -> 配置文件（CONFIG_FILE）-> 校验，校验失败时退出
 func loadConfig() {
+	cfg, err := buildConfig()
+	if err != nil {
+		log.Fatalf("配置错误:\n%v", err)
+	}
+	configValue.Store(cfg)
+}
+
+// loadEnvConfig 从环境变量加载配置
+func loadEnvConfig() *Config {
+	config := &Config{}
 	config.Port = getEnv("PORT", "8080")
 	config.AppID = getEnv("ALIYUN_APP_ID", "")
 	config.APIKey = getEnv("ALIYUN_API_KEY", "")
+	// 上游Key池，格式：Key[:权重],Key[:权重]
+	config.APIKeys = parseAPIKeysEnv(getEnv("ALIYUN_API_KEYS", ""))
+	config.APIKeyStrategy = getEnv("API_KEY_STRATEGY", "round_robin")
+	config.APIKeyThrottleCooldown = getEnvInt("API_KEY_THROTTLE_COOLDOWN", 60) // 被限流的Key暂停60秒
+	config.APIKeyInvalidCooldown = getEnvInt("API_KEY_INVALID_COOLDOWN", 300)  // 无效的Key暂停5分钟
+	config.AdminToken = getEnv("ADMIN_TOKEN", "")
+	config.StoreFile = getEnv("STORE_FILE", "data/store.json")
+	config.AuditLogFile = getEnv("AUDIT_LOG_FILE", "data/audit.log")
 	config.BaseURL = getEnv("ALIYUN_BASE_URL", "https://dashscope.aliyuncs.com")
 	config.ProxyURL = getEnv("PROXY_URL", "")
+	config.ProxyUsername = getEnv("PROXY_USERNAME", "")
+	config.ProxyPassword = getEnv("PROXY_PASSWORD", "")
+	config.NoProxy = getEnv("NO_PROXY", os.Getenv("no_proxy"))
+	config.UpstreamCAFile = getEnv("UPSTREAM_CA_FILE", "")
+	config.UpstreamTLSMinVersion = getEnv("UPSTREAM_TLS_MIN_VERSION", "1.2")
+	config.UpstreamTLSServerName = getEnv("UPSTREAM_TLS_SERVER_NAME", "")
+	config.UpstreamCertPins = getEnv("UPSTREAM_CERT_PINS", "")
 	// 默认使用原生API格式（官方推荐）
 	config.UseNative = getEnv("USE_NATIVE_API", "true") == "true"
+	// 按模型名映射的应用，格式：模型名=应用ID,模型名=应用ID
+	config.Apps = parseAppsEnv(getEnv("ALIYUN_APPS", ""))
 
 	// 性能优化配置
 	config.RequestTimeout = getEnvInt("REQUEST_TIMEOUT", 180)      // 非流式请求超时180秒（增加以支持长文本生成）
-	config.StreamTimeout = getEnvInt("STREAM_TIMEOUT", 600)        // 流式请求超时600秒（增加以支持长文本流式生成）
+	config.StreamTimeout = getEnvInt("STREAM_TIMEOUT", 600)        // 流式请求总时长上限600秒（活跃与否由空闲超时判断）
 	config.MaxIdleConns = getEnvInt("MAX_IDLE_CONNS", 100)         // 最大空闲连接数
 	config.MaxIdleConnsPerHost = getEnvInt("MAX_IDLE_CONNS_PER_HOST", 50) // 每个主机最大空闲连接数
 	config.MaxConnsPerHost = getEnvInt("MAX_CONNS_PER_HOST", 100)  // 每个主机最大连接数
 	config.IdleConnTimeout = getEnvInt("IDLE_CONN_TIMEOUT", 90)    // 空闲连接超时90秒
-
-	if config.AppID == "" {
-		log.Fatal("错误: 必须设置 ALIYUN_APP_ID 环境变量")
-	}
-	if config.APIKey == "" {
-		log.Fatal("错误: 必须设置 ALIYUN_API_KEY 环境变量")
-	}
+	config.AggregateStream = getEnv("NON_STREAM_AGGREGATE", "false") == "true" // 非流式请求走上游流式接口
+	config.StreamIdleTimeout = getEnvInt("STREAM_IDLE_TIMEOUT", 60) // 两个流式事件之间最长等待60秒
+	config.StreamFirstTokenTimeout = getEnvInt("STREAM_FIRST_TOKEN_TIMEOUT", 120) // 首个事件最长等待120秒
+	config.StreamHeartbeatInterval = getEnvInt("STREAM_HEARTBEAT_INTERVAL", 15)   // 每15秒无数据发送一次心跳
+	config.ShutdownTimeout = getEnvInt("SHUTDOWN_TIMEOUT", 30)                    // 优雅关闭最长等待30秒
+	config.ShutdownDelay = getEnvInt("SHUTDOWN_DELAY", 0)                         // 默认收到信号后立即停止接受新连接
+
+	// 健康检查与熔断配置
+	config.ReadinessProbeURL = getEnv("READINESS_PROBE_URL", "")
+	config.ReadinessProbeInterval = getEnvInt("READINESS_PROBE_INTERVAL", 30)  // 探测结果缓存30秒
+	config.CircuitBreakerThreshold = getEnvInt("CIRCUIT_BREAKER_THRESHOLD", 0) // 默认不启用熔断
+	config.CircuitBreakerCooldown = getEnvInt("CIRCUIT_BREAKER_COOLDOWN", 30)  // 熔断冷却30秒
+
+	config.ConfigWatchInterval = getEnvInt("CONFIG_WATCH_INTERVAL", 5) // 每5秒检查一次配置文件
+
+	// HTTPS与mTLS配置
+	config.TLSCertFile = getEnv("TLS_CERT_FILE", "")
+	config.TLSKeyFile = getEnv("TLS_KEY_FILE", "")
+	config.TLSClientCAFile = getEnv("TLS_CLIENT_CA_FILE", "")
+	config.TLSClientAuth = getEnv("TLS_CLIENT_AUTH", "")
+	config.TLSReloadInterval = getEnvInt("TLS_RELOAD_INTERVAL", 60) // 每60秒检查一次证书文件
+	// 客户端证书映射的租户，格式：证书标识=租户,证书标识=租户
+	config.TLSClientTenants = parseTenantsEnv(getEnv("TLS_CLIENT_TENANTS", ""))
+
+	// 客户端Key，格式：Key=租户,Key=租户（租户的凭证和应用只能在配置文件中设置）
+	config.ClientKeys = parseClientKeysEnv(getEnv("CLIENT_KEYS", ""))
+	config.BudgetWarnPercent = getEnvInt("BUDGET_WARN_PERCENT", 80) // 费用达到预算的80%时提醒
+
+	// 响应缓存配置（默认不启用）
+	config.ResponseCache = getEnv("RESPONSE_CACHE", "false") == "true"
+	config.ResponseCacheTTL = getEnvInt("RESPONSE_CACHE_TTL", 3600)                  // 缓存1小时
+	config.ResponseCacheMaxEntries = getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 10000) // 最多1万条
+	config.ResponseCacheMaxMB = getEnvInt("RESPONSE_CACHE_MAX_MB", 64)              // 最多占用64MB
+	config.RequestCoalescing = getEnv("REQUEST_COALESCING", "false") == "true"
+	config.IdempotencyWindow = getEnvInt("IDEMPOTENCY_WINDOW", 3600) // Idempotency-Key 的响应保存1小时
+
+	// 文本向量配置，模型映射格式：模型名=向量模型,模型名=向量模型
+	config.EmbeddingModel = getEnv("EMBEDDING_MODEL", "text-embedding-v3")
+	config.EmbeddingModels = parseModelMapEnv(getEnv("EMBEDDING_MODELS", ""))
+	config.EmbeddingBatchSize = getEnvInt("EMBEDDING_BATCH_SIZE", 10) // text-embedding-v3 单次最多10条
+
+	// 文本排序配置，模型映射格式同上
+	config.RerankModel = getEnv("RERANK_MODEL", "gte-rerank-v2")
+	config.RerankModels = parseModelMapEnv(getEnv("RERANK_MODELS", ""))
+
+	// 图片生成配置（异步任务）
+	config.ImageModel = getEnv("IMAGE_MODEL", "wanx2.1-t2i-turbo")
+	config.ImageModels = parseModelMapEnv(getEnv("IMAGE_MODELS", ""))
+	config.ImageTaskTimeout = getEnvInt("IMAGE_TASK_TIMEOUT", 120) // 最多等待2分钟
+	config.TaskPollInterval = getEnvInt("TASK_POLL_INTERVAL", 1)   // 从1秒开始轮询
+
+	// 语音转写配置（录音文件识别异步任务）
+	config.TranscriptionModel = getEnv("TRANSCRIPTION_MODEL", "paraformer-v2")
+	config.TranscriptionModels = parseModelMapEnv(getEnv("TRANSCRIPTION_MODELS", ""))
+	config.TranscriptionTaskTimeout = getEnvInt("TRANSCRIPTION_TASK_TIMEOUT", 300) // 最多等待5分钟
+	config.TranscriptionMaxUploadMB = getEnvInt("TRANSCRIPTION_MAX_UPLOAD_MB", 25) // 与OpenAI的上限一致
+	return config
 }
 
 // getEnvInt 获取环境变量并转换为整数
@@ -171,15 +365,75 @@ func getEnvInt(key string, defaultValue int) int {
 }
 
 // initHTTPClients 初始化HTTP客户端（配置连接池）
-func initHTTPClients() {
-	// 创建自定义Transport，配置连接池
+// prev为热加载前的配置，连接池相关配置未变化时复用原有连接池
+func initHTTPClients(cfg *Config, prev *Config) {
+	old := currentClients()
+
+	var transport *http.Transport
+	if old != nil && prev != nil && transportKey(prev) == transportKey(cfg) {
+		transport = old.transport
+	} else {
+		transport = newUpstreamTransport(cfg)
+	}
+
+	// 所有上游请求都经过熔断器，再由Key池分配API Key
+	upstreamKeys.Configure(cfg)
+	upstreamBreaker.Configure(cfg.CircuitBreakerThreshold, time.Duration(cfg.CircuitBreakerCooldown)*time.Second)
+	breaker := &breakerTransport{next: &keyPoolTransport{next: transport, pool: upstreamKeys}, breaker: upstreamBreaker}
+
+	clientsValue.Store(&upstreamClients{
+		transport: transport,
+		// 非流式请求客户端（有超时限制）
+		client: &http.Client{
+			Transport: breaker,
+			Timeout:   time.Duration(cfg.RequestTimeout) * time.Second,
+		},
+		// 流式请求客户端（不设置总超时，由streamWatchdog按首包/空闲/总时长分别控制）
+		stream: &http.Client{
+			Transport: breaker,
+		},
+	})
+
+	// 旧连接池上进行中的请求不受影响，只关闭空闲连接
+	if old != nil && old.transport != transport {
+		old.transport.CloseIdleConnections()
+	}
+
+	log.Printf("HTTP客户端已初始化 - 最大空闲连接: %d, 每主机最大连接: %d, 请求超时: %ds, 流式首包/空闲/总时长: %ds/%ds/%ds",
+		cfg.MaxIdleConns, cfg.MaxConnsPerHost, cfg.RequestTimeout,
+		cfg.StreamFirstTokenTimeout, cfg.StreamIdleTimeout, cfg.StreamTimeout)
+}
+
+// newUpstreamTransport 创建自定义Transport，配置连接池、出站代理和上游TLS
+func newUpstreamTransport(cfg *Config) *http.Transport {
+	// 代理地址已在配置校验时检查过，这里不会出错
+	proxy, err := newProxyFunc(cfg)
+	if err != nil {
+		log.Printf("出站代理配置无效，使用直连: %v", err)
+	} else if proxy != nil {
+		proxyURL, _ := parseProxyURL(cfg.ProxyURL)
+		log.Printf("出站代理: %s，不走代理: %q", proxyURL.Redacted(), cfg.NoProxy)
+	}
+
+	// TLS配置同样已校验过；CA文件在校验后被删除等情况下拒绝所有TLS连接，而不是退回到不完整的校验
+	tlsConfig, err := newUpstreamTLSConfig(cfg)
+	if err != nil {
+		log.Printf("上游TLS配置无效，HTTPS请求将失败: %v", err)
+		tlsErr := err
+		tlsConfig = &tls.Config{
+			VerifyConnection: func(tls.ConnectionState) error { return tlsErr },
+		}
+	}
+
 	// 注意：ResponseHeaderTimeout 应该大于或等于 Client.Timeout
 	// 这里设置为0表示不限制，由Client.Timeout控制
-	transport := &http.Transport{
-		MaxIdleConns:        config.MaxIdleConns,
-		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
-		MaxConnsPerHost:     config.MaxConnsPerHost,
-		IdleConnTimeout:     time.Duration(config.IdleConnTimeout) * time.Second,
+	return &http.Transport{
+		Proxy:               proxy,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(cfg.IdleConnTimeout) * time.Second,
 		DisableKeepAlives:   false, // 启用连接复用
 		DialContext: (&net.Dialer{
 			Timeout:   10 * time.Second, // 连接超时
@@ -189,21 +443,15 @@ func initHTTPClients() {
 		ExpectContinueTimeout: 1 * time.Second,
 		ResponseHeaderTimeout: 0, // 0表示不限制，由Client.Timeout控制
 	}
+}
 
-	// 非流式请求客户端（有超时限制）
-	httpClient = &http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(config.RequestTimeout) * time.Second,
-	}
-
-	// 流式请求客户端（超时时间更长，但不为0以避免资源泄漏）
-	httpClientStream = &http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(config.StreamTimeout) * time.Second,
-	}
-
-	log.Printf("HTTP客户端已初始化 - 最大空闲连接: %d, 每主机最大连接: %d, 请求超时: %ds, 流式超时: %ds", 
-		config.MaxIdleConns, config.MaxConnsPerHost, config.RequestTimeout, config.StreamTimeout)
+// transportKey 连接池相关的配置，变化时需要重建Transport
+// 包含CA文件内容的摘要，替换CA文件后发送SIGHUP即可生效
+func transportKey(cfg *Config) string {
+	return fmt.Sprintf("%d|%d|%d|%d|%s|%s|%s|%s|%s|%x|%s|%s|%s",
+		cfg.MaxIdleConns, cfg.MaxIdleConnsPerHost, cfg.MaxConnsPerHost, cfg.IdleConnTimeout,
+		cfg.ProxyURL, cfg.ProxyUsername, cfg.ProxyPassword, cfg.NoProxy,
+		cfg.UpstreamCAFile, fileChecksum(cfg.UpstreamCAFile), cfg.UpstreamTLSMinVersion, cfg.UpstreamTLSServerName, cfg.UpstreamCertPins)
 }
 
 // getEnv 获取环境变量，如果不存在则返回默认值
@@ -215,19 +463,36 @@ func getEnv(key, defaultValue string) string {
 }
 
 // getAliyunEndpoint 获取阿里云百炼API端点（兼容模式，已废弃）
-func getAliyunEndpoint() string {
+func getAliyunEndpoint(cfg *Config, appID string) string {
 	// 兼容模式端点（可能不支持）
-	return fmt.Sprintf("%s/api/v2/apps/agent/%s/compatible-mode/v1/chat/completions", config.BaseURL, config.AppID)
+	return fmt.Sprintf("%s/api/v2/apps/agent/%s/compatible-mode/v1/chat/completions", cfg.BaseURL, appID)
 }
 
 // getAliyunNativeEndpoint 获取阿里云百炼原生API端点（官方推荐）
-func getAliyunNativeEndpoint() string {
-	return fmt.Sprintf("%s/api/v1/apps/%s/completion", config.BaseURL, config.AppID)
+func getAliyunNativeEndpoint(cfg *Config, appID string) string {
+	return fmt.Sprintf("%s/api/v1/apps/%s/completion", cfg.BaseURL, appID)
+}
+
+// resolveAppID 根据请求中的模型名选择百炼应用，未配置映射时使用默认应用
+func resolveAppID(cfg *Config, model string) string {
+	if app, ok := cfg.Apps[model]; ok {
+		return app.AppID
+	}
+	return cfg.AppID
 }
 
 // handleHealth 健康检查端点
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if isDraining() {
+		// 正在优雅关闭，让负载均衡停止转发新请求
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "draining",
+			"service": "aliyun-bailian-proxy",
+		})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "ok",
 		"service": "aliyun-bailian-proxy",
@@ -248,6 +513,11 @@ func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("读取请求体失败: %v", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", fmt.Sprintf("请求体超过 %d 字节", tooLarge.Limit))
+			return
+		}
 		http.Error(w, "无法读取请求体", http.StatusBadRequest)
 		return
 	}
@@ -267,19 +537,44 @@ func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	serveChatCompletion(w, r, openAIReq)
+}
+
+// serveChatCompletion 把OpenAI格式的聊天请求转发到上游并以OpenAI格式返回
+// 其他API格式的入口（如 /v1/messages）把请求转换为OpenAIRequest后调用，并通过 translatingWriter 转换响应
+func serveChatCompletion(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest) {
+	// 使用请求开始时的配置快照，热加载不影响进行中的请求
+	cfg := currentConfig()
+	clients := currentClients()
+	// 按客户端Key和租户的权限确定上游应用和凭证
+	reportModel(r.Context(), openAIReq.Model)
+	if err := enforceScopes(w, r, &openAIReq); err != nil {
+		writeScopeError(w, err)
+		return
+	}
+	route, err := resolveRoute(cfg, requestTenant(r), openAIReq.Model)
+	if err != nil {
+		log.Printf("拒绝请求: %v", err)
+		writeOpenAIError(w, http.StatusForbidden, "permission_error", err.Error())
+		return
+	}
+	appID := route.AppID
+
 	var aliyunReqBody []byte
+	var aliyunReq AliyunNativeRequest
 	var endpoint string
 
-	if config.UseNative {
+	if cfg.UseNative {
 		// 使用原生API格式
 		// 注意：原生API可能不支持流式响应，需要特殊处理
-		aliyunReq := convertToNativeFormat(openAIReq)
+		aliyunReq = convertToNativeFormat(openAIReq)
+		route.applyDefaultParameters(&aliyunReq)
 		aliyunReqBody, err = json.Marshal(aliyunReq)
-		endpoint = getAliyunNativeEndpoint()
+		endpoint = getAliyunNativeEndpoint(cfg, appID)
 	} else {
 		// 使用兼容模式（OpenAI格式）
 		aliyunReqBody, err = json.Marshal(openAIReq)
-		endpoint = getAliyunEndpoint()
+		endpoint = getAliyunEndpoint(cfg, appID)
 	}
 
 	if err != nil {
@@ -288,24 +583,74 @@ func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 响应缓存与请求合并：只对确定性请求（temperature为0）生效，键由租户、应用和规范化的请求内容组成
+	if cfg.UseNative && (cfg.ResponseCache || cfg.RequestCoalescing) && deterministicRequest(aliyunReq) {
+		cacheKey := requestCacheKey(requestTenant(r), route, aliyunReq)
+		lookup, store := cacheDirectives(r)
+		store = store && cfg.ResponseCache
+		if cfg.ResponseCache && lookup {
+			if answer, age, ok := responseCache.Get(cacheKey); ok {
+				cacheMetrics.Add("hits", 1)
+				log.Printf("命中响应缓存: 应用 %s，已缓存 %v", appID, age.Round(time.Second))
+				writeCachedAnswer(w, answer, openAIReq.Model, openAIReq.Stream, age)
+				return
+			}
+			cacheMetrics.Add("misses", 1)
+			w.Header().Set("X-Cache", "MISS")
+		} else if cfg.ResponseCache {
+			cacheMetrics.Add("bypasses", 1)
+			w.Header().Set("X-Cache", "BYPASS")
+		}
+
+		// 相同的请求共享一次上游调用：第一个请求在后台发起调用，所有相同的请求（包括它自己）都订阅结果，
+		// 上游调用不绑定任何一个客户端，只有所有订阅者都离开后才取消
+		if cfg.RequestCoalescing {
+			f, leader := inflight.Join(cacheKey, r.Context())
+			if leader {
+				coalesceMetrics.Add("leaders", 1)
+				go runFlight(f, store, func(fw http.ResponseWriter, fr *http.Request) {
+					forwardChatCompletion(fw, fr, cfg, clients, route, openAIReq, aliyunReqBody, endpoint)
+				}, r)
+			}
+			f.Follow(w, r, openAIReq.Model, openAIReq.Stream, leader)
+			return
+		}
+
+		if store {
+			var capture *answerCapture
+			r, capture = withAnswerCapture(r, nil)
+			defer storeAnswer(cacheKey, capture)
+		}
+	}
+
+	forwardChatCompletion(w, r, cfg, clients, route, openAIReq, aliyunReqBody, endpoint)
+}
+
+// forwardChatCompletion 把转换后的请求发送到上游，并按流式、聚合或非流式的方式返回OpenAI格式的响应
+func forwardChatCompletion(w http.ResponseWriter, r *http.Request, cfg *Config, clients *upstreamClients, route upstreamRoute, openAIReq OpenAIRequest, aliyunReqBody []byte, endpoint string) {
 	// 限制日志长度，避免日志过长
 	reqBodyStr := string(aliyunReqBody)
 	if len(reqBodyStr) > 500 {
 		reqBodyStr = reqBodyStr[:500] + "...(已截断)"
 	}
-	log.Printf("转发请求到阿里云百炼: %s", endpoint)
+	if tenant := requestTenant(r); tenant != "" {
+		log.Printf("转发请求到阿里云百炼: %s (租户: %s)", endpoint, tenant)
+	} else {
+		log.Printf("转发请求到阿里云百炼: %s", endpoint)
+	}
 	log.Printf("请求内容: %s", reqBodyStr)
 
 	// 创建HTTP请求
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(aliyunReqBody))
+	// 使用客户端请求的上下文，客户端断开时同时取消上游请求
+	req, err := http.NewRequestWithContext(r.Context(), "POST", endpoint, bytes.NewBuffer(aliyunReqBody))
 	if err != nil {
 		log.Printf("创建请求失败: %v", err)
 		http.Error(w, "创建请求失败", http.StatusInternalServerError)
 		return
 	}
 
-	// 设置请求头
-	req.Header.Set("Authorization", "Bearer "+config.APIKey)
+	// 设置请求头（租户没有自己的Key时，Authorization由Key池在发送时设置）
+	route.apply(req)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "aliyun-bailian-proxy/1.0")
 
@@ -321,22 +666,38 @@ func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		req.Header.Set("Accept", accept)
 	}
 
+	// 非流式请求通过上游流式接口聚合，避免长回答触发总超时
+	if !openAIReq.Stream && cfg.UseNative && cfg.AggregateStream {
+		handleAggregatedResponseNative(clients.stream, req, w, openAIReq.Model)
+		return
+	}
+
 	// 如果是流式请求，需要特殊处理
 	if openAIReq.Stream {
 		// 如果使用原生API，需要转换SSE格式
-		if config.UseNative {
-			handleStreamResponseNative(httpClientStream, req, w, openAIReq.Model)
+		if cfg.UseNative {
+			handleStreamResponseNative(clients.stream, req, w, openAIReq.Model)
 		} else {
-			handleStreamResponse(httpClientStream, req, w)
+			handleStreamResponse(clients.stream, req, w, openAIReq.Model)
 		}
 		return
 	}
 
 	// 发送请求（使用全局客户端，复用连接）
-	resp, err := httpClient.Do(req)
+	resp, err := clients.client.Do(req)
 	if err != nil {
 		log.Printf("请求失败: %v", err)
 		
+		// 熔断中或没有可用的Key，快速失败
+		if errors.Is(err, errCircuitOpen) {
+			writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", errCircuitOpen.Error())
+			return
+		}
+		if errors.Is(err, errNoUpstreamKey) {
+			writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", errNoUpstreamKey.Error())
+			return
+		}
+
 		// 检查是否是超时错误
 		if strings.Contains(err.Error(), "timeout") {
 			// 超时错误，返回504 Gateway Timeout
@@ -382,9 +743,15 @@ func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 
 	// 如果使用原生API格式，需要转换响应格式为OpenAI格式
 	var finalRespBody []byte
-	if config.UseNative {
+	if cfg.UseNative {
 		if resp.StatusCode == http.StatusOK {
-			// 成功响应，转换为OpenAI格式
+			// 成功响应，记录用量并转换为OpenAI格式
+			var nativeResp AliyunNativeResponse
+			if json.Unmarshal(respBody, &nativeResp) == nil {
+				reportUsage(r.Context(), nativeResp)
+				reportAnswer(r.Context(), nativeResp)
+				reportSession(r.Context(), nativeResp.Output.SessionID)
+			}
 			convertedBody := convertNativeResponseToOpenAI(respBody, openAIReq.Model)
 			if convertedBody != nil && len(convertedBody) > 0 {
 				finalRespBody = convertedBody
@@ -442,6 +809,9 @@ func convertToNativeFormat(openAIReq OpenAIRequest) AliyunNativeRequest {
 		}
 		input["messages"] = aliyunMessages
 	}
+	if openAIReq.SessionID != "" {
+		input["session_id"] = openAIReq.SessionID
+	}
 	
 	// 构建parameters
 	parameters := make(map[string]interface{})
@@ -463,6 +833,9 @@ func convertToNativeFormat(openAIReq OpenAIRequest) AliyunNativeRequest {
 	if openAIReq.FrequencyPenalty != nil {
 		parameters["frequency_penalty"] = *openAIReq.FrequencyPenalty
 	}
+	if openAIReq.HasThoughts != nil {
+		parameters["has_thoughts"] = *openAIReq.HasThoughts
+	}
 	
 	// 如果parameters为空，设置为空对象而不是nil
 	if len(parameters) == 0 {
@@ -553,6 +926,36 @@ type OpenAIErrorResponse struct {
 	} `json:"error"`
 }
 
+// writeOpenAIError 以OpenAI错误格式返回错误
+func writeOpenAIError(w http.ResponseWriter, statusCode int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(openAIErrorJSON(errType, "", message))
+}
+
+// openAIErrorJSON 构建OpenAI格式的错误JSON
+func openAIErrorJSON(errType, code, message string) []byte {
+	errorResp := OpenAIErrorResponse{}
+	errorResp.Error.Message = message
+	errorResp.Error.Type = errType
+	errorResp.Error.Code = code
+	errorJSON, _ := json.Marshal(errorResp)
+	return errorJSON
+}
+
+// upstreamErrorToOpenAI 将上游错误响应转换为OpenAI错误格式
+// 已经是OpenAI格式（兼容模式）的直接返回，无法解析时包装为通用错误
+func upstreamErrorToOpenAI(body []byte, statusCode int) []byte {
+	var existing OpenAIErrorResponse
+	if err := json.Unmarshal(body, &existing); err == nil && existing.Error.Message != "" {
+		return body
+	}
+	if convertedError := convertNativeErrorToOpenAI(body, statusCode); len(convertedError) > 0 {
+		return convertedError
+	}
+	return openAIErrorJSON("api_error", "", fmt.Sprintf("上游返回错误(HTTP %d)", statusCode))
+}
+
 // parseSSEError 从SSE格式中提取JSON错误数据
 func parseSSEError(sseBody []byte) []byte {
 	bodyStr := string(sseBody)
@@ -682,49 +1085,78 @@ func convertNativeErrorToOpenAI(errorBody []byte, statusCode int) []byte {
 }
 
 // handleStreamResponse 处理流式响应（兼容模式，直接转发）
-func handleStreamResponse(client *http.Client, req *http.Request, w http.ResponseWriter) {
+func handleStreamResponse(client *http.Client, req *http.Request, w http.ResponseWriter, model string) {
+	parent := req.Context()
+	wd, ctx := newStreamWatchdogFromConfig(parent)
+	defer wd.Stop()
+	req = req.WithContext(ctx)
+
 	// 设置流式响应头
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no") // 禁用nginx缓冲
+	sw := newSSEWriter(w)
+	defer sw.Close()
+	created := time.Now().Unix()
 
 	// 发送请求
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("流式请求失败: %v", err)
-		http.Error(w, "无法连接到阿里云百炼API", http.StatusInternalServerError)
+		statusCode, errType, message, _ := classifyStreamError(parent, wd, err)
+		if errType == "" {
+			return
+		}
+		if statusCode == http.StatusBadGateway {
+			message = "无法连接到阿里云百炼API: " + err.Error()
+		}
+		failStream(sw, statusCode, openAIErrorJSON(errType, "", message), "", model, created)
 		return
 	}
 	defer resp.Body.Close()
 
-	// 如果响应状态码不是200，需要转换为OpenAI错误格式
+	// 如果响应状态码不是200，转换为OpenAI错误格式并以对应状态码返回
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		errorMsg := fmt.Sprintf("data: %s\n\n", string(body))
-		w.WriteHeader(resp.StatusCode)
-		w.Write([]byte(errorMsg))
+		sw.WriteError(resp.StatusCode, upstreamErrorToOpenAI(body, resp.StatusCode))
 		return
 	}
 
-	// 流式传输响应
-	buffer := make([]byte, 4096)
+	recordStreamStarted()
+	sw.StartHeartbeat(time.Duration(currentConfig().StreamHeartbeatInterval) * time.Second)
+
+	// 按事件转发，保证心跳不会插入到一个事件的中间
+	reader := bufio.NewReader(&watchdogReader{r: resp.Body, wd: wd})
+	var event bytes.Buffer
+	var done bool
 	for {
-		n, err := resp.Body.Read(buffer)
-		if n > 0 {
-			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
-				log.Printf("写入响应失败: %v", writeErr)
-				return
-			}
-			if flusher, ok := w.(http.Flusher); ok {
-				flusher.Flush()
+		line, err := reader.ReadBytes('\n')
+		event.Write(line)
+		trimmed := bytes.TrimSpace(line)
+		if bytes.Equal(trimmed, []byte("data: [DONE]")) || bytes.Equal(trimmed, []byte("data:[DONE]")) {
+			done = true
+		}
+		if len(trimmed) == 0 || err != nil {
+			if event.Len() > 0 {
+				if _, writeErr := sw.Write(event.Bytes()); writeErr != nil {
+					log.Printf("写入响应失败: %v", writeErr)
+					recordStreamTruncated(truncateClientDisconnect)
+					return
+				}
+				event.Reset()
 			}
 		}
-		if err == io.EOF {
-			break
+		if err == io.EOF && done {
+			recordStreamCompleted()
+			return
 		}
 		if err != nil {
-			log.Printf("读取流式响应失败: %v", err)
+			if err == io.EOF {
+				err = nil
+			}
+			statusCode, errType, message, reason := classifyStreamError(parent, wd, err)
+			log.Printf("流式响应被截断: %s, %v", reason, err)
+			recordStreamTruncated(reason)
+			if errType != "" {
+				failStream(sw, statusCode, openAIErrorJSON(errType, reason, message), "", model, created)
+			}
 			return
 		}
 	}
@@ -732,144 +1164,153 @@ func handleStreamResponse(client *http.Client, req *http.Request, w http.Respons
 
 // handleStreamResponseNative 处理原生API的流式响应，转换SSE格式
 func handleStreamResponseNative(client *http.Client, req *http.Request, w http.ResponseWriter, model string) {
+	parent := req.Context()
+	wd, ctx := newStreamWatchdogFromConfig(parent)
+	defer wd.Stop()
+	req = req.WithContext(ctx)
+
 	// 设置流式响应头
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
+	sw := newSSEWriter(w)
+	defer sw.Close()
+
+	var lastText string
+	var requestID string
+	var created int64 = time.Now().Unix()
 
 	// 发送请求
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("流式请求失败: %v", err)
-		errorResp := OpenAIErrorResponse{}
-		errorResp.Error.Message = "无法连接到阿里云百炼API: " + err.Error()
-		errorResp.Error.Type = "server_error"
-		errorJSON, _ := json.Marshal(errorResp)
-		fmt.Fprintf(w, "data: %s\n\n", string(errorJSON))
+		statusCode, errType, message, _ := classifyStreamError(parent, wd, err)
+		if errType == "" {
+			return
+		}
+		if statusCode == http.StatusBadGateway {
+			message = "无法连接到阿里云百炼API: " + err.Error()
+		}
+		failStream(sw, statusCode, openAIErrorJSON(errType, "", message), requestID, model, created)
 		return
 	}
 	defer resp.Body.Close()
 
-	// 如果响应状态码不是200，转换为OpenAI错误格式
+	// 如果响应状态码不是200，转换为OpenAI错误格式并以对应状态码返回
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		convertedError := convertNativeErrorToOpenAI(body, resp.StatusCode)
-		if convertedError != nil && len(convertedError) > 0 {
-			fmt.Fprintf(w, "data: %s\n\n", string(convertedError))
-		} else {
-			fmt.Fprintf(w, "data: %s\n\n", string(body))
-		}
+		sw.WriteError(resp.StatusCode, upstreamErrorToOpenAI(body, resp.StatusCode))
 		return
 	}
 
+	recordStreamStarted()
+	sw.StartHeartbeat(time.Duration(currentConfig().StreamHeartbeatInterval) * time.Second)
+
 	// 解析SSE流式响应并转换格式
-	scanner := bufio.NewScanner(resp.Body)
-	var lastText string
-	var requestID string
-	var created int64 = time.Now().Unix()
-	
-	for scanner.Scan() {
-		line := scanner.Text()
-		
-		// 解析SSE格式
-		if strings.HasPrefix(line, "data:") {
-			jsonStr := strings.TrimPrefix(line, "data:")
-			jsonStr = strings.TrimSpace(jsonStr)
-			
-			// 跳过空行和非JSON数据
-			if jsonStr == "" || !strings.HasPrefix(jsonStr, "{") {
-				continue
-			}
-			
-			// 尝试解析为阿里云响应格式
-			var nativeResp AliyunNativeResponse
-			if err := json.Unmarshal([]byte(jsonStr), &nativeResp); err != nil {
-				// 解析失败，跳过
-				log.Printf("解析SSE数据失败: %v, 数据: %s", err, jsonStr[:min(100, len(jsonStr))])
-				continue
-			}
-			
-			// 提取request_id（第一次）
-			if requestID == "" && nativeResp.RequestID != "" {
-				requestID = nativeResp.RequestID
-			}
-			
-			// 获取当前文本内容
-			currentText := nativeResp.Output.Text
-			
-			// 计算增量内容
-			if len(currentText) > len(lastText) {
-				delta := currentText[len(lastText):]
-				lastText = currentText
-				
-				// 转换为OpenAI格式的SSE
-				chunkResp := map[string]interface{}{
-					"id":      requestID,
-					"object":  "chat.completion.chunk",
-					"created": created,
-					"model":   model,
-					"choices": []map[string]interface{}{
-						{
-							"index": 0,
-							"delta": map[string]interface{}{
-								"content": delta,
-							},
-							"finish_reason": nil,
+	var finished, clientGone bool
+	var upstreamError *AliyunNativeResponse
+
+	err = readNativeStream(&watchdogReader{r: resp.Body, wd: wd}, func(nativeResp AliyunNativeResponse) bool {
+		// 提取request_id（第一次）
+		if requestID == "" && nativeResp.RequestID != "" {
+			requestID = nativeResp.RequestID
+		}
+
+		// 上游在流中返回了错误事件
+		if nativeResp.Code != "" {
+			upstreamError = &nativeResp
+			return false
+		}
+		reportUsage(parent, nativeResp)
+		reportProgress(parent, nativeResp)
+		reportSession(parent, nativeResp.Output.SessionID)
+
+		// 获取当前文本内容
+		currentText := nativeResp.Output.Text
+
+		// 计算增量内容
+		if len(currentText) > len(lastText) {
+			delta := currentText[len(lastText):]
+			lastText = currentText
+
+			// 转换为OpenAI格式的SSE
+			chunkResp := map[string]interface{}{
+				"id":      requestID,
+				"object":  "chat.completion.chunk",
+				"created": created,
+				"model":   model,
+				"choices": []map[string]interface{}{
+					{
+						"index": 0,
+						"delta": map[string]interface{}{
+							"content": delta,
 						},
+						"finish_reason": nil,
 					},
-				}
-				
-				chunkJSON, _ := json.Marshal(chunkResp)
-				fmt.Fprintf(w, "data: %s\n\n", string(chunkJSON))
-				
-				if flusher, ok := w.(http.Flusher); ok {
-					flusher.Flush()
-				}
+				},
 			}
-			
-			// 如果finish_reason不是null或空，发送完成消息
-			finishReason := nativeResp.Output.FinishReason
-			if finishReason != "" && finishReason != "null" {
-				// 构建最终chunk，包含finish_reason和usage信息
-				finalChunk := map[string]interface{}{
-					"id":      requestID,
-					"object":  "chat.completion.chunk",
-					"created": created,
-					"model":   model,
-					"choices": []map[string]interface{}{
-						{
-							"index":        0,
-							"delta":        map[string]interface{}{},
-							"finish_reason": finishReason,
-						},
+
+			chunkJSON, _ := json.Marshal(chunkResp)
+			if err := sw.WriteData(chunkJSON); err != nil {
+				log.Printf("写入响应失败: %v", err)
+				clientGone = true
+				return false
+			}
+		}
+
+		// 如果finish_reason不是null或空，发送完成消息
+		finishReason := nativeResp.Output.FinishReason
+		if finishReason != "" && finishReason != "null" {
+			// 构建最终chunk，包含finish_reason和usage信息
+			finalChunk := map[string]interface{}{
+				"id":      requestID,
+				"object":  "chat.completion.chunk",
+				"created": created,
+				"model":   model,
+				"choices": []map[string]interface{}{
+					{
+						"index":         0,
+						"delta":         map[string]interface{}{},
+						"finish_reason": finishReason,
 					},
+				},
+			}
+
+			// 如果有usage信息，添加到finalChunk中
+			if len(nativeResp.Usage.Models) > 0 {
+				finalChunk["usage"] = map[string]interface{}{
+					"prompt_tokens":     nativeResp.Usage.Models[0].InputTokens,
+					"completion_tokens": nativeResp.Usage.Models[0].OutputTokens,
+					"total_tokens":      nativeResp.Usage.Models[0].InputTokens + nativeResp.Usage.Models[0].OutputTokens,
 				}
-				
-				// 如果有usage信息，添加到finalChunk中
-				if len(nativeResp.Usage.Models) > 0 {
-					finalChunk["usage"] = map[string]interface{}{
-						"prompt_tokens":     nativeResp.Usage.Models[0].InputTokens,
-						"completion_tokens": nativeResp.Usage.Models[0].OutputTokens,
-						"total_tokens":      nativeResp.Usage.Models[0].InputTokens + nativeResp.Usage.Models[0].OutputTokens,
-					}
-				}
-				
-				finalJSON, _ := json.Marshal(finalChunk)
-				fmt.Fprintf(w, "data: %s\n\n", string(finalJSON))
-				
-				// 发送结束标记
-				fmt.Fprintf(w, "data: [DONE]\n\n")
-				if flusher, ok := w.(http.Flusher); ok {
-					flusher.Flush()
-				}
-				break
 			}
+
+			finalJSON, _ := json.Marshal(finalChunk)
+			sw.WriteData(finalJSON)
+
+			// 发送结束标记
+			sw.Write([]byte("data: [DONE]\n\n"))
+			finished = true
+			nativeResp.RequestID = requestID
+			reportAnswer(parent, nativeResp)
+			return false
+		}
+		return true
+	})
+
+	switch {
+	case finished:
+		recordStreamCompleted()
+	case clientGone:
+		recordStreamTruncated(truncateClientDisconnect)
+	case upstreamError != nil:
+		log.Printf("上游流式响应返回错误: %s %s", upstreamError.Code, upstreamError.Message)
+		recordStreamTruncated(truncateUpstreamError)
+		failStream(sw, http.StatusBadGateway, openAIErrorJSON("api_error", upstreamError.Code, upstreamError.Message), requestID, model, created)
+	default:
+		statusCode, errType, message, reason := classifyStreamError(parent, wd, err)
+		log.Printf("流式响应被截断: %s, %v", reason, err)
+		recordStreamTruncated(reason)
+		if errType != "" {
+			failStream(sw, statusCode, openAIErrorJSON(errType, reason, message), requestID, model, created)
 		}
-	}
-	
-	if err := scanner.Err(); err != nil {
-		log.Printf("读取流式响应失败: %v", err)
 	}
 }
 
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+)
+
+// 运行指标，通过需要管理Token的 /admin/metrics 以JSON形式暴露（expvar）
+var (
+	// streamMetrics 流式请求计数：started / completed / truncated
+	streamMetrics = expvar.NewMap("stream")
+	// streamTruncatedReasons 按原因统计被截断的流式请求
+	streamTruncatedReasons = expvar.NewMap("stream_truncated_reasons")
+	// configMetrics 配置热加载计数：reloads / reload_failures
+	configMetrics = expvar.NewMap("config")
+	// cacheMetrics 响应缓存计数：hits / misses / bypasses / stores / evictions
+	cacheMetrics = expvar.NewMap("response_cache")
+	// coalesceMetrics 请求合并计数：leaders / followers / fallbacks
+	coalesceMetrics = expvar.NewMap("request_coalescing")
+)
+
+// 流被截断的原因
+const (
+	truncateFirstTokenTimeout = "first_token_timeout"
+	truncateIdleTimeout       = "idle_timeout"
+	truncateMaxDuration       = "max_duration"
+	truncateClientDisconnect  = "client_disconnect"
+	truncateUpstreamRead      = "upstream_read_error"
+	truncateUpstreamEOF       = "upstream_eof"
+	truncateUpstreamError     = "upstream_error_event"
+	truncateServerShutdown    = "server_shutdown"
+)
+
+// recordStreamStarted 记录一个成功建立（上游返回200）的流
+func recordStreamStarted() {
+	streamMetrics.Add("started", 1)
+}
+
+// recordStreamCompleted 记录一个正常结束（发送了[DONE]）的流
+func recordStreamCompleted() {
+	streamMetrics.Add("completed", 1)
+}
+
+// recordStreamTruncated 记录一个被截断的流
+func recordStreamTruncated(reason string) {
+	streamMetrics.Add("truncated", 1)
+	streamTruncatedReasons.Add(reason, 1)
+}
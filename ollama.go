@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ollamaVersion /api/version 返回的版本号，部分客户端会检查Ollama版本
+const ollamaVersion = "0.5.0"
+
+// ollamaModifiedAt /api/tags 中模型的修改时间，使用服务启动时间
+var ollamaModifiedAt = time.Now()
+
+// OllamaOptions Ollama请求中的模型参数，只转换百炼支持的部分
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature"`
+	TopP        *float64 `json:"top_p"`
+	NumPredict  *int     `json:"num_predict"`
+	Stop        []string `json:"stop"`
+}
+
+// OllamaMessage Ollama格式的消息
+type OllamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+// OllamaChatRequest /api/chat 请求格式
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream"` // Ollama默认流式输出
+	Options  OllamaOptions   `json:"options"`
+}
+
+// OllamaGenerateRequest /api/generate 请求格式
+type OllamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	System  string        `json:"system"`
+	Images  []string      `json:"images"`
+	Stream  *bool         `json:"stream"`
+	Options OllamaOptions `json:"options"`
+}
+
+// apply 把模型参数设置到OpenAI格式的请求中
+func (o OllamaOptions) apply(req *OpenAIRequest) {
+	req.Temperature = o.Temperature
+	req.TopP = o.TopP
+	req.MaxTokens = o.NumPredict
+	req.Stop = o.Stop
+}
+
+// ollamaStream Ollama请求未设置stream时默认流式输出
+func ollamaStream(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+// handleOllamaChat 处理Ollama格式的对话请求（/api/chat）
+func handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	t := &ollamaTranslator{start: time.Now()}
+	var req OllamaChatRequest
+	if !decodeJSONBody(w, r, t, &req) {
+		return
+	}
+	if len(req.Messages) == 0 {
+		rejectTranslated(w, t, "messages字段不能为空")
+		return
+	}
+	openAIReq := OpenAIRequest{Model: req.Model, Stream: ollamaStream(req.Stream)}
+	req.Options.apply(&openAIReq)
+	for i, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" && msg.Role != "system" {
+			rejectTranslated(w, t, fmt.Sprintf("messages[%d].role 无效: %q", i, msg.Role))
+			return
+		}
+		if len(msg.Images) > 0 {
+			rejectTranslated(w, t, fmt.Sprintf("messages[%d]: 百炼应用不支持图片输入", i))
+			return
+		}
+		openAIReq.Messages = append(openAIReq.Messages, Message{Role: msg.Role, Content: msg.Content})
+	}
+	t.model = req.Model
+	serveTranslated(w, r, openAIReq, t)
+}
+
+// handleOllamaGenerate 处理Ollama格式的补全请求（/api/generate）
+func handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	t := &ollamaTranslator{start: time.Now(), generate: true}
+	var req OllamaGenerateRequest
+	if !decodeJSONBody(w, r, t, &req) {
+		return
+	}
+	if req.Prompt == "" {
+		rejectTranslated(w, t, "prompt字段不能为空")
+		return
+	}
+	if len(req.Images) > 0 {
+		rejectTranslated(w, t, "百炼应用不支持图片输入")
+		return
+	}
+	openAIReq := OpenAIRequest{Model: req.Model, Stream: ollamaStream(req.Stream)}
+	req.Options.apply(&openAIReq)
+	if req.System != "" {
+		openAIReq.Messages = append(openAIReq.Messages, Message{Role: "system", Content: req.System})
+	}
+	openAIReq.Messages = append(openAIReq.Messages, Message{Role: "user", Content: req.Prompt})
+	t.model = req.Model
+	serveTranslated(w, r, openAIReq, t)
+}
+
+// handleOllamaTags 列出可用的模型（/api/tags），即配置的应用中当前客户端可以使用的模型名
+func handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	names := map[string]bool{}
+	for name := range cfg.Apps {
+		names[name] = true
+	}
+	tenant, hasTenant := lookupTenant(cfg, requestTenant(r))
+	for name := range tenant.Apps {
+		names[name] = true
+	}
+
+	ck := requestClientKey(r)
+	var models []map[string]interface{}
+	for _, name := range sortedKeys(names) {
+		if hasTenant && len(tenant.AllowedApps) > 0 && !containsString(tenant.AllowedApps, name) {
+			continue
+		}
+		if ck != nil && len(ck.AllowedModels) > 0 && !containsString(ck.AllowedModels, name) {
+			continue
+		}
+		models = append(models, ollamaModel(name))
+	}
+	// 没有配置应用时所有模型名都使用默认应用
+	if len(names) == 0 {
+		models = append(models, ollamaModel("default"))
+	}
+	if models == nil {
+		models = []map[string]interface{}{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"models": models})
+}
+
+// ollamaModel /api/tags 中的一个模型
+func ollamaModel(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"model":       name,
+		"modified_at": ollamaModifiedAt.UTC().Format(time.RFC3339),
+		"size":        0,
+		"digest":      "",
+		"details": map[string]interface{}{
+			"format":             "bailian",
+			"family":             "bailian",
+			"families":           []string{"bailian"},
+			"parameter_size":     "",
+			"quantization_level": "",
+		},
+	}
+}
+
+// handleOllamaVersion 返回Ollama版本（/api/version）
+func handleOllamaVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"version": ollamaVersion})
+}
+
+// ollamaTranslator 把OpenAI格式的响应转换为Ollama格式，流式响应为NDJSON（每行一个JSON）
+type ollamaTranslator struct {
+	model    string
+	generate bool // /api/generate 使用 response 字段，/api/chat 使用 message 字段
+	start    time.Time
+	failed   bool
+}
+
+// message 构建一行Ollama响应
+func (t *ollamaTranslator) message(content string, done bool) map[string]interface{} {
+	msg := map[string]interface{}{
+		"model":      t.model,
+		"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		"done":       done,
+	}
+	if t.generate {
+		msg["response"] = content
+	} else {
+		msg["message"] = map[string]string{"role": "assistant", "content": content}
+	}
+	return msg
+}
+
+// finish 补充结束信息：结束原因、耗时和token数
+func (t *ollamaTranslator) finish(msg map[string]interface{}, finishReason string, usage *Usage) {
+	msg["done_reason"] = finishReason
+	msg["total_duration"] = time.Since(t.start).Nanoseconds()
+	if usage != nil {
+		msg["prompt_eval_count"] = usage.PromptTokens
+		msg["eval_count"] = usage.CompletionTokens
+	}
+}
+
+// line 序列化为NDJSON的一行
+func ollamaLine(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return append(data, '\n')
+}
+
+func (t *ollamaTranslator) ContentType(stream bool) string {
+	if stream {
+		return "application/x-ndjson"
+	}
+	return "application/json; charset=utf-8"
+}
+
+func (t *ollamaTranslator) Response(resp OpenAIResponse) []byte {
+	choice := resp.Choices[0]
+	msg := t.message(choice.Message.Content, true)
+	t.finish(msg, choice.FinishReason, &resp.Usage)
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+func (t *ollamaTranslator) Error(statusCode int, errResp OpenAIErrorResponse) (int, []byte) {
+	data, _ := json.Marshal(map[string]string{"error": errResp.Error.Message})
+	return statusCode, data
+}
+
+func (t *ollamaTranslator) Chunk(chunk openAIChunk) []byte {
+	if t.failed || len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+	var out []byte
+	if choice.Delta.Content != "" {
+		out = append(out, ollamaLine(t.message(choice.Delta.Content, false))...)
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "error" {
+		msg := t.message("", true)
+		t.finish(msg, *choice.FinishReason, chunk.Usage)
+		out = append(out, ollamaLine(msg)...)
+	}
+	return out
+}
+
+func (t *ollamaTranslator) StreamError(errResp OpenAIErrorResponse) []byte {
+	t.failed = true
+	return ollamaLine(map[string]string{"error": errResp.Error.Message})
+}
+
+func (t *ollamaTranslator) StreamDone() []byte {
+	return nil
+}
+
+// Heartbeat NDJSON没有注释行，不发送心跳
+func (t *ollamaTranslator) Heartbeat() []byte {
+	return nil
+}
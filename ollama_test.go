@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOllamaRequestValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		want    string
+	}{
+		{"没有消息", handleOllamaChat, `{"model":"qwen","messages":[]}`, "messages字段不能为空"},
+		{"无效的角色", handleOllamaChat, `{"model":"qwen","messages":[{"role":"tool","content":"x"}]}`, `messages[0].role 无效: \"tool\"`},
+		{"缺少角色", handleOllamaChat, `{"model":"qwen","messages":[{"role":"user","content":"hi"},{"content":"x"}]}`, `messages[1].role 无效: \"\"`},
+		{"图片输入", handleOllamaChat, `{"model":"qwen","messages":[{"role":"user","content":"看图","images":["aGk="]}]}`, "messages[0]: 百炼应用不支持图片输入"},
+		{"没有prompt", handleOllamaGenerate, `{"model":"qwen"}`, "prompt字段不能为空"},
+		{"generate图片输入", handleOllamaGenerate, `{"model":"qwen","prompt":"看图","images":["aGk="]}`, "百炼应用不支持图片输入"},
+		{"请求格式错误", handleOllamaChat, `{"messages":`, "请求格式错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tt.body)))
+			// 错误响应为Ollama格式 {"error": "..."}
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `{"error":"`) || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("得到 %d %s，期望包含 %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestOllamaOptions(t *testing.T) {
+	temperature, numPredict := 0.3, 128
+	var req OpenAIRequest
+	OllamaOptions{Temperature: &temperature, NumPredict: &numPredict, Stop: []string{"\n\n"}}.apply(&req)
+	if *req.Temperature != 0.3 || *req.MaxTokens != 128 || req.TopP != nil || len(req.Stop) != 1 {
+		t.Errorf("转换后的参数 %+v", req)
+	}
+
+	streamFalse := false
+	if !ollamaStream(nil) || ollamaStream(&streamFalse) {
+		t.Error("未设置stream时应默认流式输出")
+	}
+}
+
+func TestOllamaResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		generate bool
+		check    func(resp map[string]interface{}) bool
+	}{
+		{"chat", false, func(resp map[string]interface{}) bool {
+			msg := resp["message"].(map[string]interface{})
+			return msg["role"] == "assistant" && msg["content"] == "你好！"
+		}},
+		{"generate", true, func(resp map[string]interface{}) bool { return resp["response"] == "你好！" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &ollamaTranslator{model: "qwen", generate: tt.generate}
+			rec := translateResponse(t, tr, http.StatusOK, chatResponse("你好！", "stop"))
+			resp := decodeJSON(t, rec.Body.String())
+			if !tt.check(resp) || resp["done"] != true || resp["done_reason"] != "stop" || resp["model"] != "qwen" {
+				t.Errorf("响应 %v", resp)
+			}
+			if resp["prompt_eval_count"] != 12.0 || resp["eval_count"] != 5.0 {
+				t.Errorf("token数 %v/%v", resp["prompt_eval_count"], resp["eval_count"])
+			}
+			if rec.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+				t.Errorf("Content-Type %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	rec := translateResponse(t, &ollamaTranslator{}, http.StatusNotFound, `{"error":{"message":"模型不存在","type":"invalid_request_error"}}`)
+	if rec.Code != http.StatusNotFound || rec.Body.String() != `{"error":"模型不存在"}` {
+		t.Errorf("错误响应 %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	out := translateStream(t, &ollamaTranslator{model: "qwen"},
+		chunkEvent("你", "", nil),
+		": heartbeat\n\n",
+		chunkEvent("好", "", nil),
+		chunkEvent("", "length", &Usage{PromptTokens: 4, CompletionTokens: 2}),
+		"data: [DONE]\n\n",
+	)
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("得到 %d 行，期望 3 行（心跳不输出）:\n%s", len(lines), out)
+	}
+	var content string
+	for _, line := range lines[:2] {
+		msg := decodeJSON(t, line)
+		if msg["done"] != false {
+			t.Errorf("中间的行 %v", msg)
+		}
+		content += msg["message"].(map[string]interface{})["content"].(string)
+	}
+	final := decodeJSON(t, lines[2])
+	if content != "你好" || final["done"] != true || final["done_reason"] != "length" || final["eval_count"] != 2.0 {
+		t.Errorf("内容 %q，最后一行 %v", content, final)
+	}
+
+	out = translateStream(t, &ollamaTranslator{model: "qwen"},
+		chunkEvent("部分", "", nil),
+		`data: {"error":{"message":"上游中断","type":"api_error"}}`+"\n\n",
+		chunkEvent("", "stop", nil),
+	)
+	if !strings.HasSuffix(out, `{"error":"上游中断"}`+"\n") {
+		t.Errorf("出错后的输出:\n%s", out)
+	}
+}
+
+func TestOllamaTags(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *Config
+		ck   *clientKey
+		want string
+	}{
+		{"没有配置应用", &Config{}, nil, "default"},
+		{"所有应用", &Config{Apps: map[string]AppConfig{"qwen": {AppID: "a"}, "bot": {AppID: "b"}}}, nil, "bot,qwen"},
+		{"客户端Key限制模型", &Config{Apps: map[string]AppConfig{"qwen": {AppID: "a"}, "bot": {AppID: "b"}}},
+			&clientKey{ID: "k", KeyScopes: KeyScopes{AllowedModels: []string{"qwen"}}}, "qwen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, tt.cfg)
+			r := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+			if tt.ck != nil {
+				r = r.WithContext(context.WithValue(r.Context(), clientKeyKey{}, tt.ck))
+			}
+			w := httptest.NewRecorder()
+			handleOllamaTags(w, r)
+			var names []string
+			for _, model := range decodeJSON(t, w.Body.String())["models"].([]interface{}) {
+				names = append(names, model.(map[string]interface{})["name"].(string))
+			}
+			if strings.Join(names, ",") != tt.want {
+				t.Errorf("模型 %q，期望 %s", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestOllamaVersionRequiresClientKey(t *testing.T) {
+	setTestStore(t)
+	setTestConfig(t, &Config{ClientKeys: []ClientKeyConfig{{Name: "desktop", Key: "sk-desktop"}}})
+	handler := requireClientKey(handleOllamaVersion)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("没有Key时得到 %d，期望401", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+	r.Header.Set("Authorization", "Bearer sk-desktop")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || decodeJSON(t, w.Body.String())["version"] != ollamaVersion {
+		t.Errorf("得到 %d %s", w.Code, w.Body)
+	}
+}
+
+// setTestStore 在测试期间使用临时文件中的空存储
+func setTestStore(t *testing.T) {
+	t.Helper()
+	previous := clientStore
+	clientStore = &keyStore{}
+	if err := clientStore.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientStore = previous })
+}
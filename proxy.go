@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// newProxyFunc 根据配置创建Transport使用的出站代理函数
+// 支持 http://、https://（HTTP CONNECT）和 socks5://（socks5h:// 由代理解析域名），
+// 认证信息可以写在URL中，也可以通过 proxy_username / proxy_password 单独设置；
+// no_proxy 中列出的目标不经过代理。未配置代理时返回nil（直连）
+func newProxyFunc(cfg *Config) (func(*http.Request) (*url.URL, error), error) {
+	if cfg.ProxyURL == "" {
+		return nil, nil
+	}
+
+	proxyURL, err := parseProxyURL(cfg.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyUsername != "" {
+		proxyURL.User = url.UserPassword(cfg.ProxyUsername, cfg.ProxyPassword)
+	}
+
+	noProxy := parseNoProxy(cfg.NoProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxy.match(req.URL) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// parseProxyURL 解析并校验代理地址
+func parseProxyURL(raw string) (*url.URL, error) {
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("无效的代理地址")
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("不支持的代理协议 %q（支持 http、https、socks5、socks5h）", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("代理地址缺少主机名: %s", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+// noProxyList NO_PROXY 规则
+type noProxyList struct {
+	all     bool         // "*" 表示所有目标都不走代理
+	nets    []*net.IPNet // CIDR
+	ips     []net.IP     // 单个IP
+	domains []noProxyDomain
+}
+
+// noProxyDomain 域名规则，匹配域名本身及其子域名；port为空表示匹配所有端口
+type noProxyDomain struct {
+	name string
+	port string
+}
+
+// parseNoProxy 解析逗号分隔的 NO_PROXY 列表，格式与curl等工具一致：
+// *、IP、CIDR、域名（example.com 或 .example.com，均匹配子域名），可带端口
+func parseNoProxy(value string) noProxyList {
+	var list noProxyList
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if item == "*" {
+			list.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(item); err == nil {
+			list.nets = append(list.nets, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(item); ip != nil {
+			list.ips = append(list.ips, ip)
+			continue
+		}
+		host, port := item, ""
+		if h, p, err := net.SplitHostPort(item); err == nil {
+			host, port = h, p
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			list.ips = append(list.ips, ip)
+			continue
+		}
+		list.domains = append(list.domains, noProxyDomain{name: strings.TrimPrefix(host, "."), port: port})
+	}
+	return list
+}
+
+// match 判断目标地址是否不走代理
+func (l noProxyList) match(target *url.URL) bool {
+	if l.all {
+		return true
+	}
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		if target.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range l.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		for _, noProxyIP := range l.ips {
+			if noProxyIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, domain := range l.domains {
+		if domain.port != "" && domain.port != port {
+			continue
+		}
+		if host == domain.name || strings.HasSuffix(host, "."+domain.name) {
+			return true
+		}
+	}
+	return false
+}
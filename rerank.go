@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// RerankRequest 排序请求（/v1/rerank），兼容Cohere和Jina的请求格式
+type RerankRequest struct {
+	Model           string           `json:"model"`
+	Query           string           `json:"query"`
+	Documents       []rerankDocument `json:"documents"`
+	TopN            *int             `json:"top_n"`
+	ReturnDocuments *bool            `json:"return_documents"` // 默认返回文档内容（与Jina一致）
+}
+
+// rerankDocument 字符串或 {"text": "..."} 对象
+type rerankDocument string
+
+func (d *rerankDocument) UnmarshalJSON(data []byte) error {
+	// null 不是有效的文档，不能当作空字符串
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil && string(data) != "null" {
+		*d = rerankDocument(text)
+		return nil
+	}
+	var doc struct {
+		Text *string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil || doc.Text == nil {
+		return fmt.Errorf("documents 中的元素必须是字符串或带 text 字段的对象")
+	}
+	*d = rerankDocument(*doc.Text)
+	return nil
+}
+
+// dashscopeRerankResponse DashScope文本排序接口的响应
+type dashscopeRerankResponse struct {
+	Output struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	} `json:"output"`
+	Usage struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+	RequestID string `json:"request_id"`
+}
+
+// getRerankEndpoint 获取DashScope文本排序接口地址
+func getRerankEndpoint(cfg *Config) string {
+	return cfg.BaseURL + "/api/v1/services/rerank/text-rerank/text-rerank"
+}
+
+// validate 检查请求参数
+func (req RerankRequest) validate() error {
+	switch {
+	case req.Query == "":
+		return fmt.Errorf("query字段不能为空")
+	case len(req.Documents) == 0:
+		return fmt.Errorf("documents字段不能为空")
+	case req.TopN != nil && *req.TopN <= 0:
+		return fmt.Errorf("top_n 必须大于0")
+	}
+	return nil
+}
+
+// handleRerank 处理Cohere/Jina格式的排序请求，转发到DashScope文本排序接口（gte-rerank）
+func handleRerank(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "只支持POST请求")
+		return
+	}
+	var req RerankRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "请求格式错误: "+err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	cfg := currentConfig()
+	clients := currentClients()
+	reportModel(r.Context(), req.Model)
+	if err := checkModelScope(r, req.Model); err != nil {
+		writeScopeError(w, err)
+		return
+	}
+	model := resolveServiceModel(cfg.RerankModels, cfg.RerankModel, req.Model)
+	route := resolveCredentials(cfg, requestTenant(r))
+	endpoint := getRerankEndpoint(cfg)
+
+	documents := make([]string, len(req.Documents))
+	for i, doc := range req.Documents {
+		documents[i] = string(doc)
+	}
+	// 文档内容由代理按index补充，不需要上游返回
+	parameters := map[string]interface{}{"return_documents": false}
+	if req.TopN != nil {
+		parameters["top_n"] = *req.TopN
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      model,
+		"input":      map[string]interface{}{"query": req.Query, "documents": documents},
+		"parameters": parameters,
+	})
+	log.Printf("转发排序请求到阿里云百炼: %s，模型 %s，%d 个文档", endpoint, model, len(documents))
+
+	status, respBody, err := callService(r.Context(), clients.client, route, http.MethodPost, endpoint, body)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if status != http.StatusOK {
+		writeUpstreamError(w, status, respBody)
+		return
+	}
+	var resp dashscopeRerankResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		log.Printf("解析排序响应失败: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "上游响应格式错误")
+		return
+	}
+	reportTokens(r.Context(), modelTokens{ModelID: model, InputTokens: resp.Usage.TotalTokens})
+
+	returnDocuments := req.ReturnDocuments == nil || *req.ReturnDocuments
+	results := make([]map[string]interface{}, 0, len(resp.Output.Results))
+	for _, result := range resp.Output.Results {
+		if result.Index < 0 || result.Index >= len(documents) {
+			continue
+		}
+		item := map[string]interface{}{"index": result.Index, "relevance_score": result.RelevanceScore}
+		if returnDocuments {
+			item["document"] = map[string]string{"text": documents[result.Index]}
+		}
+		results = append(results, item)
+	}
+
+	// 同时包含Cohere（id、meta）和Jina（model、usage）响应中的字段
+	id := resp.RequestID
+	if id == "" {
+		id = newRandomID()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      id,
+		"model":   req.Model,
+		"results": results,
+		"usage":   map[string]int{"prompt_tokens": resp.Usage.TotalTokens, "total_tokens": resp.Usage.TotalTokens},
+		"meta": map[string]interface{}{
+			"api_version":  map[string]string{"version": "1"},
+			"billed_units": map[string]int{"search_units": 1},
+		},
+	})
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// responseIDPrefix Responses API的响应ID前缀，每个响应的ID都是唯一的随机值
+	responseIDPrefix = "resp_"
+	// maxResponseSessions 保存的响应ID到百炼会话映射的最大条数，超出时淘汰最久未使用的
+	maxResponseSessions = 10000
+	// responseSessionTTL 响应ID可以用于继续对话的时长
+	responseSessionTTL = 24 * time.Hour
+)
+
+// responseSessionEntry 一个响应对应的百炼会话
+type responseSessionEntry struct {
+	key        string // 客户端范围:响应ID
+	sessionKey string // 客户端范围:会话ID
+	responseID string
+	sessionID  string
+	expires    time.Time
+}
+
+// responseSessionStore 响应ID到百炼会话的映射，按客户端隔离，限制条数
+// 百炼会话只保存线性的对话历史，不能从较早的轮次分支，因此只有会话最新一轮的响应可以继续对话
+type responseSessionStore struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List        // 队首为最近使用
+	latest  map[string]string // 客户端范围:会话ID -> 会话最新一轮的响应ID
+}
+
+var responseSessions = &responseSessionStore{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+	latest:  make(map[string]string),
+}
+
+// Put 记录响应所属的会话，该响应成为会话的最新一轮
+func (s *responseSessionStore) Put(scope, responseID, sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scope + ":" + responseID
+	if elem, ok := s.entries[key]; ok {
+		s.removeLocked(elem)
+	}
+	entry := &responseSessionEntry{
+		key:        key,
+		sessionKey: scope + ":" + sessionID,
+		responseID: responseID,
+		sessionID:  sessionID,
+		expires:    time.Now().Add(responseSessionTTL),
+	}
+	s.entries[key] = s.order.PushFront(entry)
+	s.latest[entry.sessionKey] = responseID
+	for s.order.Len() > maxResponseSessions {
+		s.removeLocked(s.order.Back())
+	}
+}
+
+// Session 查找响应所属的百炼会话，响应不存在、已过期或不是会话的最新一轮时返回错误
+func (s *responseSessionStore) Session(scope, responseID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[scope+":"+responseID]
+	if !ok {
+		return "", fmt.Errorf("previous_response_id %s 不存在或已过期", responseID)
+	}
+	entry := elem.Value.(*responseSessionEntry)
+	if time.Now().After(entry.expires) {
+		s.removeLocked(elem)
+		return "", fmt.Errorf("previous_response_id %s 不存在或已过期", responseID)
+	}
+	if latest := s.latest[entry.sessionKey]; latest != responseID {
+		return "", fmt.Errorf("响应 %s 不是会话的最新一轮，百炼会话不支持从较早的轮次继续，请使用 %s", responseID, latest)
+	}
+	s.order.MoveToFront(elem)
+	return entry.sessionID, nil
+}
+
+func (s *responseSessionStore) removeLocked(elem *list.Element) {
+	entry := s.order.Remove(elem).(*responseSessionEntry)
+	delete(s.entries, entry.key)
+	if s.latest[entry.sessionKey] == entry.responseID {
+		delete(s.latest, entry.sessionKey)
+	}
+}
+
+// sessionCapture 记录上游返回的百炼会话ID，由各处理函数在解析上游响应时更新
+// 会话ID只在内部传给Responses API前端，不出现在Chat Completions的响应中
+type sessionCapture struct {
+	mu        sync.Mutex
+	sessionID string
+}
+
+// sessionCaptureKey 请求上下文中保存会话记录的键
+type sessionCaptureKey struct{}
+
+// withSessionCapture 在请求上下文中创建会话记录
+func withSessionCapture(r *http.Request) (*http.Request, *sessionCapture) {
+	capture := &sessionCapture{}
+	return r.WithContext(context.WithValue(r.Context(), sessionCaptureKey{}, capture)), capture
+}
+
+// reportSession 记录上游返回的百炼会话ID
+func reportSession(ctx context.Context, sessionID string) {
+	capture, _ := ctx.Value(sessionCaptureKey{}).(*sessionCapture)
+	if capture == nil || sessionID == "" {
+		return
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	capture.sessionID = sessionID
+}
+
+// SessionID 返回记录的会话ID，上游没有返回时为空
+func (c *sessionCapture) SessionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionID
+}
+
+// ResponsesRequest OpenAI Responses API 请求格式
+type ResponsesRequest struct {
+	Model              string         `json:"model"`
+	Input              responsesInput `json:"input"`
+	Instructions       string         `json:"instructions"`
+	PreviousResponseID string         `json:"previous_response_id"`
+	MaxOutputTokens    *int           `json:"max_output_tokens"`
+	Temperature        *float64       `json:"temperature"`
+	TopP               *float64       `json:"top_p"`
+	Stream             bool           `json:"stream"`
+	User               string         `json:"user"`
+}
+
+// responsesInputItem 输入中的一条消息，content可以是字符串或内容数组
+type responsesInputItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// responsesInput 字符串或消息数组
+type responsesInput []responsesInputItem
+
+func (in *responsesInput) UnmarshalJSON(data []byte) error {
+	// null 等同于省略该字段，不能当作空字符串
+	if string(data) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		content, _ := json.Marshal(text)
+		*in = responsesInput{{Type: "message", Role: "user", Content: content}}
+		return nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("input 必须是字符串或消息数组")
+	}
+	*in = items
+	return nil
+}
+
+// text 把消息内容转换为纯文本
+func (item responsesInputItem) text() (string, error) {
+	var text string
+	if err := json.Unmarshal(item.Content, &text); err == nil {
+		return text, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(item.Content, &parts); err != nil {
+		return "", fmt.Errorf("content 必须是字符串或内容数组")
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text", "text":
+			texts = append(texts, part.Text)
+		default:
+			return "", fmt.Errorf("不支持的内容类型 %q", part.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// toOpenAI 转换为OpenAI格式的请求：instructions作为system消息，previous_response_id对应的百炼会话作为session_id
+func (req ResponsesRequest) toOpenAI(scope string) (OpenAIRequest, error) {
+	openAIReq := OpenAIRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxOutputTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stream:      req.Stream,
+		User:        req.User,
+	}
+	if req.Instructions != "" {
+		openAIReq.Messages = append(openAIReq.Messages, Message{Role: "system", Content: req.Instructions})
+	}
+	for i, item := range req.Input {
+		if item.Type != "" && item.Type != "message" {
+			return OpenAIRequest{}, fmt.Errorf("input[%d]: 不支持的类型 %q", i, item.Type)
+		}
+		role := item.Role
+		if role == "developer" {
+			role = "system"
+		}
+		if role != "user" && role != "assistant" && role != "system" {
+			return OpenAIRequest{}, fmt.Errorf("input[%d].role 无效: %q", i, item.Role)
+		}
+		content, err := item.text()
+		if err != nil {
+			return OpenAIRequest{}, fmt.Errorf("input[%d]: %v", i, err)
+		}
+		openAIReq.Messages = append(openAIReq.Messages, Message{Role: role, Content: content})
+	}
+	if req.PreviousResponseID != "" {
+		if !strings.HasPrefix(req.PreviousResponseID, responseIDPrefix) || len(req.PreviousResponseID) == len(responseIDPrefix) {
+			return OpenAIRequest{}, fmt.Errorf("无效的 previous_response_id: %q", req.PreviousResponseID)
+		}
+		// 原生请求只有一条user消息时才以 prompt 发送；带消息列表时百炼使用显式的消息而忽略会话保存的历史
+		if len(openAIReq.Messages) != 1 || openAIReq.Messages[0].Role != "user" {
+			return OpenAIRequest{}, fmt.Errorf("带 previous_response_id 时 input 只能是一条user消息，且不能带 instructions（百炼会话的历史由上游保存）")
+		}
+		sessionID, err := responseSessions.Session(scope, req.PreviousResponseID)
+		if err != nil {
+			return OpenAIRequest{}, err
+		}
+		openAIReq.SessionID = sessionID
+	}
+	return openAIReq, nil
+}
+
+// handleResponses 处理OpenAI Responses API请求（/v1/responses）
+func handleResponses(w http.ResponseWriter, r *http.Request) {
+	t := &responsesTranslator{}
+	var req ResponsesRequest
+	if !decodeJSONBody(w, r, t, &req) {
+		return
+	}
+	if len(req.Input) == 0 {
+		rejectTranslated(w, t, "input字段不能为空")
+		return
+	}
+	// 兼容模式下上游不返回会话ID，响应不会关联到任何会话
+	if req.PreviousResponseID != "" && !currentConfig().UseNative {
+		rejectTranslated(w, t, "兼容模式不支持 previous_response_id，百炼会话只在原生API模式（USE_NATIVE_API=true）下可用")
+		return
+	}
+	scope := requestScope(r)
+	openAIReq, err := req.toOpenAI(scope)
+	if err != nil {
+		rejectTranslated(w, t, err.Error())
+		return
+	}
+	r, t.session = withSessionCapture(r)
+	t.req = req
+	t.scope = scope
+	t.id = responseIDPrefix + newRandomID()
+	t.created = time.Now().Unix()
+	serveTranslated(w, r, openAIReq, t)
+}
+
+// responsesTranslator 把OpenAI Chat Completions格式的响应转换为Responses API格式
+type responsesTranslator struct {
+	req      ResponsesRequest
+	scope    string
+	session  *sessionCapture
+	created  int64
+	id       string
+	itemID   string
+	text     strings.Builder
+	sequence int
+	started  bool
+	failed   bool
+}
+
+// rememberSession 响应完成后记录响应ID对应的百炼会话，之后可以通过 previous_response_id 继续对话
+// 上游没有返回会话ID（如命中缓存）时不记录，该响应不能用于继续对话
+func (t *responsesTranslator) rememberSession() {
+	if sessionID := t.session.SessionID(); sessionID != "" {
+		responseSessions.Put(t.scope, t.id, sessionID)
+	}
+}
+
+// responseObject 构建Responses API的响应对象
+func (t *responsesTranslator) responseObject(id, status, text, finishReason string, usage *Usage) map[string]interface{} {
+	resp := map[string]interface{}{
+		"id":                   id,
+		"object":               "response",
+		"created_at":           t.created,
+		"status":               status,
+		"model":                t.req.Model,
+		"output":               []interface{}{},
+		"previous_response_id": nilIfEmpty(t.req.PreviousResponseID),
+		"instructions":         nilIfEmpty(t.req.Instructions),
+		"max_output_tokens":    t.req.MaxOutputTokens,
+		"temperature":          t.req.Temperature,
+		"top_p":                t.req.TopP,
+		"incomplete_details":   nil,
+		"error":                nil,
+		"usage":                nil,
+	}
+	if status == "completed" || status == "incomplete" {
+		resp["output"] = []interface{}{t.messageItem("completed", text)}
+		if finishReason == "length" {
+			resp["status"] = "incomplete"
+			resp["incomplete_details"] = map[string]string{"reason": "max_output_tokens"}
+		}
+	}
+	if usage != nil {
+		resp["usage"] = map[string]int{
+			"input_tokens":  usage.PromptTokens,
+			"output_tokens": usage.CompletionTokens,
+			"total_tokens":  usage.TotalTokens,
+		}
+	}
+	return resp
+}
+
+// messageItem 构建输出中的消息
+func (t *responsesTranslator) messageItem(status, text string) map[string]interface{} {
+	content := []interface{}{}
+	if status == "completed" {
+		content = append(content, outputTextPart(text))
+	}
+	return map[string]interface{}{
+		"type":    "message",
+		"id":      t.itemID,
+		"status":  status,
+		"role":    "assistant",
+		"content": content,
+	}
+}
+
+// outputTextPart 构建输出文本内容
+func outputTextPart(text string) map[string]interface{} {
+	return map[string]interface{}{"type": "output_text", "text": text, "annotations": []interface{}{}}
+}
+
+// nilIfEmpty 空字符串返回nil，序列化为null
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// event 构建一个Responses API的SSE事件
+func (t *responsesTranslator) event(name string, data map[string]interface{}) []byte {
+	data["type"] = name
+	data["sequence_number"] = t.sequence
+	t.sequence++
+	payload, _ := json.Marshal(data)
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", name, payload))
+}
+
+func (t *responsesTranslator) ContentType(stream bool) string {
+	if stream {
+		return "text/event-stream"
+	}
+	return "application/json"
+}
+
+func (t *responsesTranslator) Response(resp OpenAIResponse) []byte {
+	t.itemID = "msg_" + newRandomID()
+	choice := resp.Choices[0]
+	t.rememberSession()
+	body, _ := json.Marshal(t.responseObject(t.id, "completed", choice.Message.Content, choice.FinishReason, &resp.Usage))
+	return body
+}
+
+func (t *responsesTranslator) Error(statusCode int, errResp OpenAIErrorResponse) (int, []byte) {
+	body, _ := json.Marshal(errResp)
+	return statusCode, body
+}
+
+func (t *responsesTranslator) Chunk(chunk openAIChunk) []byte {
+	if t.failed || len(chunk.Choices) == 0 {
+		return nil
+	}
+	var out []byte
+	if !t.started {
+		t.started = true
+		t.itemID = "msg_" + newRandomID()
+		out = append(out, t.event("response.created", map[string]interface{}{"response": t.responseObject(t.id, "in_progress", "", "", nil)})...)
+		out = append(out, t.event("response.in_progress", map[string]interface{}{"response": t.responseObject(t.id, "in_progress", "", "", nil)})...)
+		out = append(out, t.event("response.output_item.added", map[string]interface{}{"output_index": 0, "item": t.messageItem("in_progress", "")})...)
+		out = append(out, t.event("response.content_part.added", map[string]interface{}{
+			"item_id": t.itemID, "output_index": 0, "content_index": 0, "part": outputTextPart(""),
+		})...)
+	}
+
+	choice := chunk.Choices[0]
+	if choice.Delta.Content != "" {
+		t.text.WriteString(choice.Delta.Content)
+		out = append(out, t.event("response.output_text.delta", map[string]interface{}{
+			"item_id": t.itemID, "output_index": 0, "content_index": 0, "delta": choice.Delta.Content,
+		})...)
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "error" {
+		text := t.text.String()
+		out = append(out, t.event("response.output_text.done", map[string]interface{}{
+			"item_id": t.itemID, "output_index": 0, "content_index": 0, "text": text,
+		})...)
+		out = append(out, t.event("response.content_part.done", map[string]interface{}{
+			"item_id": t.itemID, "output_index": 0, "content_index": 0, "part": outputTextPart(text),
+		})...)
+		out = append(out, t.event("response.output_item.done", map[string]interface{}{"output_index": 0, "item": t.messageItem("completed", text)})...)
+		t.rememberSession()
+		final := t.responseObject(t.id, "completed", text, *choice.FinishReason, chunk.Usage)
+		name := "response.completed"
+		if final["status"] == "incomplete" {
+			name = "response.incomplete"
+		}
+		out = append(out, t.event(name, map[string]interface{}{"response": final})...)
+	}
+	return out
+}
+
+func (t *responsesTranslator) StreamError(errResp OpenAIErrorResponse) []byte {
+	t.failed = true
+	resp := t.responseObject(t.id, "failed", "", "", nil)
+	resp["error"] = map[string]string{"code": "server_error", "message": errResp.Error.Message}
+	return t.event("response.failed", map[string]interface{}{"response": resp})
+}
+
+func (t *responsesTranslator) StreamDone() []byte {
+	return nil
+}
+
+func (t *responsesTranslator) Heartbeat() []byte {
+	return []byte(": ping\n\n")
+}
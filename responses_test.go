@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// parseResponsesRequest 解析Responses API请求
+func parseResponsesRequest(t *testing.T, body string) ResponsesRequest {
+	t.Helper()
+	var req ResponsesRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestResponsesToOpenAI(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []Message
+	}{
+		{
+			"字符串输入",
+			`{"input":"你好","instructions":"简短回答"}`,
+			[]Message{{Role: "system", Content: "简短回答"}, {Role: "user", Content: "你好"}},
+		},
+		{
+			"消息数组和内容数组",
+			`{"input":[
+				{"role":"developer","content":"你是助手"},
+				{"type":"message","role":"user","content":[{"type":"input_text","text":"第一段"},{"type":"input_text","text":"第二段"}]},
+				{"role":"assistant","content":[{"type":"output_text","text":"好的"}]}
+			]}`,
+			[]Message{{Role: "system", Content: "你是助手"}, {Role: "user", Content: "第一段\n第二段"}, {Role: "assistant", Content: "好的"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openAIReq, err := parseResponsesRequest(t, tt.body).toOpenAI("anonymous")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(openAIReq.Messages) != len(tt.want) {
+				t.Fatalf("得到 %+v，期望 %+v", openAIReq.Messages, tt.want)
+			}
+			for i := range tt.want {
+				if openAIReq.Messages[i] != tt.want[i] {
+					t.Errorf("messages[%d] = %+v，期望 %+v", i, openAIReq.Messages[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	maxTokens := 64
+	req := parseResponsesRequest(t, `{"model":"qwen","input":"hi","max_output_tokens":64,"stream":true,"user":"u-1"}`)
+	openAIReq, _ := req.toOpenAI("anonymous")
+	if openAIReq.Model != "qwen" || *openAIReq.MaxTokens != maxTokens || !openAIReq.Stream || openAIReq.User != "u-1" || openAIReq.SessionID != "" {
+		t.Errorf("请求参数 %+v", openAIReq)
+	}
+}
+
+func TestResponsesToOpenAIErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"不支持的输入类型", `{"input":[{"type":"function_call_output","role":"user"}]}`, `input[0]: 不支持的类型 "function_call_output"`},
+		{"无效的角色", `{"input":[{"role":"tool","content":"x"}]}`, `input[0].role 无效: "tool"`},
+		{"图片内容", `{"input":[{"role":"user","content":[{"type":"input_image"}]}]}`, `input[0]: 不支持的内容类型 "input_image"`},
+		{"无效的previous_response_id", `{"input":"hi","previous_response_id":"chatcmpl-1"}`, "无效的 previous_response_id"},
+		{"previous_response_id带instructions", `{"input":"hi","instructions":"x","previous_response_id":"resp_1"}`, "input 只能是一条user消息"},
+		{"previous_response_id带多条消息", `{"input":[{"role":"user","content":"a"},{"role":"user","content":"b"}],"previous_response_id":"resp_1"}`, "input 只能是一条user消息"},
+		{"previous_response_id带assistant消息", `{"input":[{"role":"assistant","content":"a"}],"previous_response_id":"resp_1"}`, "input 只能是一条user消息"},
+		{"previous_response_id不存在", `{"input":"hi","previous_response_id":"resp_missing"}`, "不存在或已过期"},
+	}
+	for _, tt := range tests {
+		_, err := parseResponsesRequest(t, tt.body).toOpenAI("anonymous")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: 得到 %v，期望包含 %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestResponsesSessionContinuation(t *testing.T) {
+	scope := "key:test-session"
+	responseSessions.Put(scope, "resp_turn1", "session-1")
+	responseSessions.Put(scope, "resp_turn2", "session-1")
+
+	openAIReq, err := parseResponsesRequest(t, `{"input":"继续","previous_response_id":"resp_turn2"}`).toOpenAI(scope)
+	if err != nil || openAIReq.SessionID != "session-1" {
+		t.Fatalf("得到 %q %v，期望会话 session-1", openAIReq.SessionID, err)
+	}
+
+	// 只能从会话最新一轮继续；其他客户端看不到这个响应
+	if _, err := parseResponsesRequest(t, `{"input":"继续","previous_response_id":"resp_turn1"}`).toOpenAI(scope); err == nil || !strings.Contains(err.Error(), "resp_turn2") {
+		t.Errorf("从较早的轮次继续得到 %v", err)
+	}
+	if _, err := parseResponsesRequest(t, `{"input":"继续","previous_response_id":"resp_turn2"}`).toOpenAI("key:other"); err == nil {
+		t.Error("其他客户端不应使用这个响应继续对话")
+	}
+}
+
+func TestHandleResponsesRejectsPreviousResponseIDInCompatMode(t *testing.T) {
+	setTestConfig(t, &Config{UseNative: false})
+	r := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{"input":"hi","previous_response_id":"resp_1"}`))
+	w := httptest.NewRecorder()
+	handleResponses(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "兼容模式不支持 previous_response_id") {
+		t.Errorf("得到 %d %s", w.Code, w.Body)
+	}
+}
+
+// newTestResponsesTranslator 创建Responses API的translator，上游返回的会话ID为sessionID
+func newTestResponsesTranslator(t *testing.T, body, scope, sessionID string) *responsesTranslator {
+	t.Helper()
+	r, capture := withSessionCapture(httptest.NewRequest(http.MethodPost, "/v1/responses", nil))
+	reportSession(r.Context(), sessionID)
+	return &responsesTranslator{req: parseResponsesRequest(t, body), scope: scope, session: capture, id: "resp_test" + scope, created: 1718000000}
+}
+
+func TestResponsesResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		finishReason string
+		wantStatus   string
+		wantDetails  interface{}
+	}{
+		{"完成", "stop", "completed", nil},
+		{"达到max_output_tokens", "length", "incomplete", map[string]interface{}{"reason": "max_output_tokens"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope := "key:response-" + tt.finishReason
+			tr := newTestResponsesTranslator(t, `{"model":"qwen","input":"hi","instructions":"简短"}`, scope, "session-"+tt.finishReason)
+			rec := translateResponse(t, tr, http.StatusOK, chatResponse("你好！", tt.finishReason))
+			resp := decodeJSON(t, rec.Body.String())
+			if resp["id"] != tr.id || resp["object"] != "response" || resp["status"] != tt.wantStatus || resp["instructions"] != "简短" {
+				t.Errorf("响应 %v", resp)
+			}
+			if details, _ := json.Marshal(resp["incomplete_details"]); string(details) != mustJSON(tt.wantDetails) {
+				t.Errorf("incomplete_details %s", details)
+			}
+			item := resp["output"].([]interface{})[0].(map[string]interface{})
+			part := item["content"].([]interface{})[0].(map[string]interface{})
+			if item["role"] != "assistant" || part["type"] != "output_text" || part["text"] != "你好！" {
+				t.Errorf("输出 %v", item)
+			}
+			if usage := resp["usage"].(map[string]interface{}); usage["total_tokens"] != 17.0 {
+				t.Errorf("usage %v", usage)
+			}
+			// 响应ID可以继续对话
+			if sessionID, err := responseSessions.Session(scope, tr.id); err != nil || sessionID != "session-"+tt.finishReason {
+				t.Errorf("响应ID对应的会话 %q %v", sessionID, err)
+			}
+		})
+	}
+}
+
+func TestResponsesStream(t *testing.T) {
+	tr := newTestResponsesTranslator(t, `{"model":"qwen","input":"hi","stream":true}`, "key:stream", "")
+	out := translateStream(t, tr,
+		chunkEvent("你", "", nil),
+		chunkEvent("好", "", nil),
+		chunkEvent("", "stop", &Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}),
+		"data: [DONE]\n\n",
+	)
+	var names []string
+	var last map[string]interface{}
+	for i, block := range strings.Split(strings.TrimSpace(out), "\n\n") {
+		name, data, _ := strings.Cut(block, "\ndata: ")
+		event := decodeJSON(t, data)
+		if event["sequence_number"] != float64(i) {
+			t.Errorf("第%d个事件的 sequence_number 为 %v", i, event["sequence_number"])
+		}
+		names = append(names, strings.TrimPrefix(name, "event: "))
+		last = event
+	}
+	want := "response.created,response.in_progress,response.output_item.added,response.content_part.added," +
+		"response.output_text.delta,response.output_text.delta,response.output_text.done,response.content_part.done," +
+		"response.output_item.done,response.completed"
+	if strings.Join(names, ",") != want {
+		t.Fatalf("事件 %s\n期望 %s", strings.Join(names, ","), want)
+	}
+	resp := last["response"].(map[string]interface{})
+	item := resp["output"].([]interface{})[0].(map[string]interface{})
+	if text := item["content"].([]interface{})[0].(map[string]interface{})["text"]; text != "你好" {
+		t.Errorf("完整文本 %v", text)
+	}
+	// 上游没有返回会话ID时，响应不能用于继续对话
+	if _, err := responseSessions.Session("key:stream", tr.id); err == nil {
+		t.Error("没有会话ID的响应不应被记录")
+	}
+}
+
+func TestResponsesStreamError(t *testing.T) {
+	tr := newTestResponsesTranslator(t, `{"model":"qwen","input":"hi","stream":true}`, "key:stream-error", "")
+	out := translateStream(t, tr,
+		chunkEvent("部分", "", nil),
+		`data: {"error":{"message":"上游中断","type":"api_error"}}`+"\n\n",
+		chunkEvent("", "stop", nil),
+	)
+	blocks := strings.Split(strings.TrimSpace(out), "\n\n")
+	name, data, _ := strings.Cut(blocks[len(blocks)-1], "\ndata: ")
+	resp := decodeJSON(t, data)["response"].(map[string]interface{})
+	if name != "event: response.failed" || resp["status"] != "failed" || resp["error"].(map[string]interface{})["message"] != "上游中断" {
+		t.Errorf("最后一个事件 %s %v", name, resp)
+	}
+}
+
+// mustJSON 序列化为JSON字符串
+func mustJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// KeyScopes 客户端Key的权限范围，零值表示不限制
+type KeyScopes struct {
+	AllowedModels   []string `yaml:"allowed_models" json:"allowed_models,omitempty"`       // 允许使用的模型名，为空表示不限制
+	DisableStream   bool     `yaml:"disable_stream" json:"disable_stream,omitempty"`       // 禁止流式输出
+	DisableThoughts bool     `yaml:"disable_thoughts" json:"disable_thoughts,omitempty"`   // 禁止开启 has_thoughts（输出思考过程）
+	MaxTokens       int      `yaml:"max_tokens" json:"max_tokens,omitempty"`               // max_tokens上限，0表示不限制
+	MaxTokensAction string   `yaml:"max_tokens_action" json:"max_tokens_action,omitempty"` // 超过上限时的处理：clamp（默认，降为上限）/ reject
+}
+
+// validMaxTokensAction 检查 max_tokens_action 的取值
+func validMaxTokensAction(action string) bool {
+	return action == "" || action == "clamp" || action == "reject"
+}
+
+// scopeError 请求超出Key的权限范围
+type scopeError struct {
+	code    string
+	message string
+}
+
+func (e *scopeError) Error() string {
+	return e.message
+}
+
+// enforceScopes 按客户端Key的权限范围检查请求，在转换为上游格式之前调用
+// 不允许的模型、流式输出和has_thoughts直接拒绝；max_tokens按配置降为上限或拒绝，
+// 请求未设置max_tokens时使用上限。禁止has_thoughts时显式关闭，租户的默认参数也不能开启
+func enforceScopes(w http.ResponseWriter, r *http.Request, req *OpenAIRequest) error {
+	ck := requestClientKey(r)
+	if ck == nil {
+		return nil
+	}
+	scopes := ck.KeyScopes
+
+	if err := checkModelScope(r, req.Model); err != nil {
+		return err
+	}
+	if scopes.DisableStream && req.Stream {
+		return &scopeError{"stream_not_allowed", fmt.Sprintf("API Key %s 不允许使用流式输出", ck.Name)}
+	}
+	if scopes.DisableThoughts {
+		if req.HasThoughts != nil && *req.HasThoughts {
+			return &scopeError{"thoughts_not_allowed", fmt.Sprintf("API Key %s 不允许开启 has_thoughts", ck.Name)}
+		}
+		disabled := false
+		req.HasThoughts = &disabled
+	}
+	if limit := scopes.MaxTokens; limit > 0 {
+		switch {
+		case req.MaxTokens == nil:
+			req.MaxTokens = &limit
+		case *req.MaxTokens > limit && scopes.MaxTokensAction == "reject":
+			return &scopeError{"max_tokens_exceeded", fmt.Sprintf("max_tokens 超过 API Key %s 的上限 %d", ck.Name, limit)}
+		case *req.MaxTokens > limit:
+			log.Printf("max_tokens %d 超过 API Key %s 的上限，降为 %d", *req.MaxTokens, ck.Name, limit)
+			w.Header().Set("X-Max-Tokens-Clamped", strconv.Itoa(limit))
+			req.MaxTokens = &limit
+		}
+	}
+	return nil
+}
+
+// checkModelScope 检查客户端Key是否允许使用请求的模型名，对话以外的接口（如文本向量）同样适用
+func checkModelScope(r *http.Request, model string) error {
+	ck := requestClientKey(r)
+	if ck == nil || len(ck.AllowedModels) == 0 || containsString(ck.AllowedModels, model) {
+		return nil
+	}
+	return &scopeError{"model_not_allowed", fmt.Sprintf("API Key %s 无权使用模型 %q", ck.Name, model)}
+}
+
+// writeScopeError 返回权限错误
+func writeScopeError(w http.ResponseWriter, err error) {
+	log.Printf("拒绝请求: %v", err)
+	code := ""
+	if se, ok := err.(*scopeError); ok {
+		code = se.code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(openAIErrorJSON("permission_error", code, err.Error()))
+}
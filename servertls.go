@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloader 监听证书文件变化并自动加载，证书轮换时无需重启
+type certReloader struct {
+	mu         sync.RWMutex
+	certFile   string
+	keyFile    string
+	caFile     string
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+	modTimes   string // 上次加载时各文件的修改时间和大小
+	clientAuth tls.ClientAuthType
+}
+
+// newCertReloader 加载证书，加载失败时返回错误
+func newCertReloader(cfg *Config) (*certReloader, error) {
+	cr := &certReloader{
+		certFile:   cfg.TLSCertFile,
+		keyFile:    cfg.TLSKeyFile,
+		caFile:     cfg.TLSClientCAFile,
+		clientAuth: parseClientAuth(cfg.TLSClientAuth, cfg.TLSClientCAFile),
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// parseClientAuth 解析客户端证书校验方式；配置了CA但未指定方式时要求客户端证书
+func parseClientAuth(mode, caFile string) tls.ClientAuthType {
+	switch mode {
+	case "none":
+		return tls.NoClientCert
+	case "optional":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	}
+	if caFile != "" {
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+// fileModTimes 返回证书相关文件的修改时间，用于判断是否需要重新加载
+func (cr *certReloader) fileModTimes() string {
+	var buf bytes.Buffer
+	for _, path := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&buf, "%d|%d;", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return buf.String()
+}
+
+// load 读取证书、私钥和客户端CA
+func (cr *certReloader) load() error {
+	modTimes := cr.fileModTimes()
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("加载TLS证书失败: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if cr.caFile != "" {
+		pem, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return fmt.Errorf("读取客户端CA失败: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("客户端CA文件中没有有效的证书: %s", cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.clientCAs = clientCAs
+	cr.modTimes = modTimes
+	cr.mu.Unlock()
+	return nil
+}
+
+// watch 定期检查证书文件，变化后重新加载；加载失败时继续使用旧证书
+func (cr *certReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cr.mu.RLock()
+			changed := cr.fileModTimes() != cr.modTimes
+			cr.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := cr.load(); err != nil {
+				log.Printf("TLS证书重新加载失败，继续使用旧证书: %v", err)
+				continue
+			}
+			log.Printf("TLS证书已重新加载: %s", cr.certFile)
+		}
+	}()
+}
+
+// tlsConfig 创建服务端TLS配置，证书和客户端CA在每次握手时取最新的
+func (cr *certReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+			return cr.cert, nil
+		},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.mu.RLock()
+		defer cr.mu.RUnlock()
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientAuth = cr.clientAuth
+		c.ClientCAs = cr.clientCAs
+		return c, nil
+	}
+	return base
+}
+
+// clientIdentityKey 请求上下文中保存客户端身份（租户）的键
+type clientIdentityKey struct{}
+
+// requestTenant 返回通过客户端证书或客户端Key识别出的租户，未识别时返回空字符串
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(clientIdentityKey{}).(string)
+	return tenant
+}
+
+// certSubjects 返回客户端证书中可用于映射租户的标识：CN、DNS SAN、URI SAN（如SPIFFE ID）、邮箱
+func certSubjects(cert *x509.Certificate) []string {
+	subjects := []string{cert.Subject.CommonName}
+	subjects = append(subjects, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	return append(subjects, cert.EmailAddresses...)
+}
+
+// withClientIdentity 根据已验证的客户端证书识别租户并写入请求上下文
+// 配置了 tls_client_tenants 时，证书没有对应租户的请求会被拒绝
+func withClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenants := currentConfig().TLSClientTenants
+		cert := r.TLS.VerifiedChains[0][0]
+		for _, subject := range certSubjects(cert) {
+			if tenant, ok := tenants[subject]; ok && subject != "" {
+				ctx := context.WithValue(r.Context(), clientIdentityKey{}, tenant)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		if len(tenants) > 0 {
+			log.Printf("客户端证书未映射到租户: CN=%s", cert.Subject.CommonName)
+			writeOpenAIError(w, http.StatusForbidden, "permission_error", "客户端证书未授权: "+cert.Subject.CommonName)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseTenantsEnv 解析 TLS_CLIENT_TENANTS 环境变量，格式：证书标识=租户,证书标识=租户
+func parseTenantsEnv(value string) map[string]string {
+	tenants := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		// 证书标识中可能含有等号，以最后一个等号分隔
+		idx := strings.LastIndex(item, "=")
+		if idx <= 0 {
+			continue
+		}
+		tenants[strings.TrimSpace(item[:idx])] = strings.TrimSpace(item[idx+1:])
+	}
+	return tenants
+}
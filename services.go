@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DashScope服务类接口（文本向量、排序等）不经过百炼应用，直接按模型名调用，
+// 与对话接口共用客户端认证、权限范围、预算、用量统计以及上游Key池和熔断器
+
+// resolveServiceModel 根据请求中的模型名选择DashScope模型，未配置映射时使用默认模型
+func resolveServiceModel(models map[string]string, defaultModel, model string) string {
+	if mapped, ok := models[model]; ok {
+		return mapped
+	}
+	return defaultModel
+}
+
+// callService 向DashScope服务类接口发送请求，返回上游的状态码和响应体
+// 凭证和业务空间由route设置，route没有API Key时由Key池分配
+func callService(ctx context.Context, client *http.Client, route upstreamRoute, method, endpoint string, body []byte) (int, []byte, error) {
+	req, err := newServiceRequest(ctx, route, method, endpoint, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	status, respBody, _, err := doService(client, req)
+	return status, respBody, err
+}
+
+// newServiceRequest 创建服务类接口请求，设置凭证、业务空间和通用请求头
+func newServiceRequest(ctx context.Context, route upstreamRoute, method, endpoint string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	route.apply(req)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "aliyun-bailian-proxy/1.0")
+	return req, nil
+}
+
+// doService 发送请求并读取响应，同时返回上游实际收到的Authorization
+// Key池分配的Key只设置在发送的请求副本上，异步任务需要用同一个Key查询结果
+func doService(client *http.Client, req *http.Request) (status int, body []byte, authorization string, err error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	authorization = req.Header.Get("Authorization")
+	if resp.Request != nil && resp.Request.Header.Get("Authorization") != "" {
+		authorization = resp.Request.Header.Get("Authorization")
+	}
+	return resp.StatusCode, body, authorization, nil
+}
+
+// directClient 访问OSS等DashScope以外的地址（下载生成的图片、上传文件）使用的客户端
+// 复用上游连接池和出站代理，但不经过Key池和熔断器，请求中不会带上DashScope的API Key
+func directClient(cfg *Config, clients *upstreamClients) *http.Client {
+	return &http.Client{Transport: clients.transport, Timeout: time.Duration(cfg.RequestTimeout) * time.Second}
+}
+
+// upstreamStatusError 上游返回了错误响应，由 writeServiceError 转换为OpenAI格式返回
+type upstreamStatusError struct {
+	status int
+	body   []byte
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("上游返回错误(HTTP %d)", e.status)
+}
+
+// writeServiceError 服务类接口请求上游失败时返回OpenAI格式的错误
+func writeServiceError(w http.ResponseWriter, err error) {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		writeUpstreamError(w, statusErr.status, statusErr.body)
+		return
+	}
+	log.Printf("请求失败: %v", err)
+	switch {
+	case errors.Is(err, errCircuitOpen), errors.Is(err, errNoUpstreamKey):
+		writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", err.Error())
+	case errors.Is(err, errTooManyTasks):
+		writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+	case strings.Contains(err.Error(), "timeout"):
+		writeOpenAIError(w, http.StatusGatewayTimeout, "timeout_error", "请求超时，请稍后重试")
+	default:
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "无法连接到阿里云百炼API: "+err.Error())
+	}
+}
+
+// writeUpstreamError 把服务类接口的上游错误响应转换为OpenAI格式返回
+func writeUpstreamError(w http.ResponseWriter, statusCode int, body []byte) {
+	log.Printf("上游返回错误: HTTP %d %s", statusCode, body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(upstreamErrorToOpenAI(body, statusCode))
+}
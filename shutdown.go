@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 优雅关闭状态
+var (
+	// draining 收到关闭信号后置为true，健康检查据此返回未就绪
+	draining atomic.Bool
+	// drainExpired 排空时间到期后关闭，通知仍在进行的请求发送错误事件并结束
+	drainExpired = make(chan struct{})
+)
+
+// isDraining 服务器是否正在排空连接
+func isDraining() bool {
+	return draining.Load()
+}
+
+// runServer 启动HTTP服务，并在收到SIGTERM/SIGINT时优雅关闭
+// 关闭流程：标记为未就绪（可选等待 SHUTDOWN_DELAY 秒让负载均衡摘除实例）-> 停止接受新连接
+// -> 等待进行中的请求完成（最长 SHUTDOWN_TIMEOUT 秒）-> 向仍未结束的流发送错误事件 -> 退出
+func runServer(srv *http.Server) {
+	errCh := make(chan error, 1)
+	cfg := currentConfig()
+	if cfg.TLSCertFile != "" {
+		// 启用HTTPS，证书文件变化时自动重新加载
+		cr, err := newCertReloader(cfg)
+		if err != nil {
+			log.Fatalf("服务器启动失败: %v", err)
+		}
+		cr.watch(time.Duration(cfg.TLSReloadInterval) * time.Second)
+		srv.TLSConfig = cr.tlsConfig()
+		log.Printf("已启用HTTPS，客户端证书校验: %s", cr.clientAuth)
+		go func() {
+			errCh <- srv.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			errCh <- srv.ListenAndServe()
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("服务器启动失败: %v", err)
+		}
+		return
+	case sig := <-sigCh:
+		log.Printf("收到信号 %v，开始优雅关闭，最长等待 %ds", sig, currentConfig().ShutdownTimeout)
+	}
+
+	// 使用收到信号时的配置（可能已被热加载更新）
+	cfg = currentConfig()
+
+	draining.Store(true)
+
+	// 再次收到信号时立即退出
+	go func() {
+		sig := <-sigCh
+		log.Printf("再次收到信号 %v，立即退出", sig)
+		os.Exit(1)
+	}()
+
+	// 监听器关闭后健康检查也无法访问，先保持服务一段时间，让编排系统看到未就绪状态
+	if cfg.ShutdownDelay > 0 {
+		log.Printf("已标记为未就绪，%ds后停止接受新连接", cfg.ShutdownDelay)
+		time.Sleep(time.Duration(cfg.ShutdownDelay) * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		log.Printf("所有请求已完成，服务器已关闭")
+		return
+	}
+
+	// 排空超时：通知剩余请求发送错误事件后结束，再给它们一点时间写完
+	log.Printf("排空超时，强制结束仍在进行的请求")
+	close(drainExpired)
+	finalCtx, finalCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer finalCancel()
+	if err := srv.Shutdown(finalCtx); err != nil {
+		log.Printf("关闭剩余连接: %v", err)
+		srv.Close()
+	}
+	log.Printf("服务器已关闭")
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageRetentionDays 按天保存的用量保留天数，覆盖按月配额的统计周期
+const usageRetentionDays = 62
+
+// KeyQuota 客户端Key的用量配额，0表示不限制
+type KeyQuota struct {
+	RequestsPerDay int64 `yaml:"requests_per_day" json:"requests_per_day,omitempty"`
+	TokensPerDay   int64 `yaml:"tokens_per_day" json:"tokens_per_day,omitempty"`
+	TokensPerMonth int64 `yaml:"tokens_per_month" json:"tokens_per_month,omitempty"`
+}
+
+// usageCounter 用量计数
+type usageCounter struct {
+	Requests     int64   `json:"requests"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Cost         float64 `json:"cost"` // 按价格表估算的费用
+}
+
+// add 累加另一份用量
+func (u *usageCounter) add(other usageCounter) {
+	u.Requests += other.Requests
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.Cost += other.Cost
+}
+
+// managedKey 通过管理接口创建的客户端Key，只保存Key的SHA-256摘要
+type managedKey struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	KeyHash    string      `json:"key_hash"`
+	KeyPrefix  string      `json:"key_prefix"` // Key的前几位，便于识别
+	Tenant     string      `json:"tenant,omitempty"`
+	KeyScopes              // 权限范围，字段直接展开在Key对象中
+	Quota      KeyQuota    `json:"quota"`
+	Budget     SpendBudget `json:"budget"`
+	CreatedAt  time.Time   `json:"created_at"`
+	ExpiresAt  *time.Time  `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time  `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time  `json:"last_used_at,omitempty"`
+}
+
+// storeData 持久化到 store_file 的数据
+type storeData struct {
+	Keys    map[string]*managedKey              `json:"keys"`
+	Tenants map[string]TenantConfig             `json:"tenants"`
+	Usage   map[string]map[string]*usageCounter `json:"usage"` // Key ID -> 日期 -> 用量
+}
+
+// keyStore 管理接口创建的客户端Key、租户和用量，保存在本地JSON文件中
+// 管理操作立即写入文件；用量在内存中累计，定期写入
+type keyStore struct {
+	mu     sync.Mutex
+	path   string
+	data   storeData
+	byHash map[string]*managedKey
+	dirty  bool
+}
+
+// clientStore 全局存储
+var clientStore = &keyStore{}
+
+// Open 加载存储文件，文件不存在时创建空存储
+func (s *keyStore) Open(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+	s.data = storeData{}
+	if raw, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(raw, &s.data); err != nil {
+			return fmt.Errorf("解析存储文件 %s 失败: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("读取存储文件失败: %v", err)
+	}
+	if s.data.Keys == nil {
+		s.data.Keys = make(map[string]*managedKey)
+	}
+	if s.data.Tenants == nil {
+		s.data.Tenants = make(map[string]TenantConfig)
+	}
+	if s.data.Usage == nil {
+		s.data.Usage = make(map[string]map[string]*usageCounter)
+	}
+	s.byHash = make(map[string]*managedKey, len(s.data.Keys))
+	for _, k := range s.data.Keys {
+		s.byHash[k.KeyHash] = k
+	}
+	return nil
+}
+
+// saveLocked 写入存储文件（先写临时文件再重命名，避免写到一半时崩溃损坏文件），调用方需持有锁
+func (s *keyStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	s.pruneUsageLocked()
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o700)
+	}
+	tmp := s.path + ".tmp"
+	if err == nil {
+		err = os.WriteFile(tmp, raw, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errStoreWrite, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// pruneUsageLocked 删除超过保留期的按天用量
+func (s *keyStore) pruneUsageLocked() {
+	cutoff := time.Now().AddDate(0, 0, -usageRetentionDays).Format("2006-01-02")
+	for id, days := range s.data.Usage {
+		for day := range days {
+			if day < cutoff {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(s.data.Usage, id)
+		}
+	}
+}
+
+// Flush 把内存中的用量写入文件
+func (s *keyStore) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// StartFlusher 定期把用量写入文件
+func (s *keyStore) StartFlusher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.Flush()
+		}
+	}()
+}
+
+// HasKeys 是否有通过管理接口创建的Key
+func (s *keyStore) HasKeys() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data.Keys) > 0
+}
+
+// Authenticate 按Key查找管理接口创建的客户端Key；Key不存在、已吊销或已过期时返回错误
+func (s *keyStore) Authenticate(secret string) (*clientKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[hashClientKey(secret)]
+	if !ok {
+		return nil, nil
+	}
+	if k.RevokedAt != nil {
+		return nil, errors.New("API Key已被吊销")
+	}
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return nil, errors.New("API Key已过期")
+	}
+	return k.clientKey(), nil
+}
+
+// clientKey 转换为请求处理使用的客户端Key
+func (k *managedKey) clientKey() *clientKey {
+	return &clientKey{
+		ID:        k.ID,
+		Name:      k.Name,
+		Tenant:    k.Tenant,
+		KeyScopes: k.KeyScopes,
+		Quota:     k.Quota,
+		Budget:    k.Budget,
+	}
+}
+
+// Tenant 查找管理接口创建的租户
+func (s *keyStore) Tenant(name string) (TenantConfig, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.data.Tenants[name]
+	return t, ok
+}
+
+// RecordUsage 记录一次请求的用量
+func (s *keyStore) RecordUsage(keyID string, usage usageCounter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	days := s.data.Usage[keyID]
+	if days == nil {
+		days = make(map[string]*usageCounter)
+		s.data.Usage[keyID] = days
+	}
+	if days[day] == nil {
+		days[day] = &usageCounter{}
+	}
+	days[day].add(usage)
+	if k, ok := s.data.Keys[keyID]; ok {
+		k.LastUsedAt = &now
+	}
+	s.dirty = true
+}
+
+// UsageSummary 返回Key当天和当月的用量
+func (s *keyStore) UsageSummary(keyID string) (today, month usageCounter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	monthPrefix := now.Format("2006-01-")
+	for d, u := range s.data.Usage[keyID] {
+		if d == day {
+			today.add(*u)
+		}
+		if len(d) >= len(monthPrefix) && d[:len(monthPrefix)] == monthPrefix {
+			month.add(*u)
+		}
+	}
+	return today, month
+}
+
+// DailyUsage 返回Key最近若干天的用量，按日期倒序
+func (s *keyStore) DailyUsage(keyID string, days int) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dates := make([]string, 0, len(s.data.Usage[keyID]))
+	for d := range s.data.Usage[keyID] {
+		dates = append(dates, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	if len(dates) > days {
+		dates = dates[:days]
+	}
+	result := make([]map[string]interface{}, 0, len(dates))
+	for _, d := range dates {
+		u := s.data.Usage[keyID][d]
+		result = append(result, map[string]interface{}{
+			"date":          d,
+			"requests":      u.Requests,
+			"input_tokens":  u.InputTokens,
+			"output_tokens": u.OutputTokens,
+		})
+	}
+	return result
+}
+
+// QuotaExceeded 检查Key是否已用完配额，返回说明；未超出时返回空字符串
+func (s *keyStore) QuotaExceeded(k *clientKey) string {
+	q := k.Quota
+	if q.RequestsPerDay == 0 && q.TokensPerDay == 0 && q.TokensPerMonth == 0 {
+		return ""
+	}
+	today, month := s.UsageSummary(k.ID)
+	switch {
+	case q.RequestsPerDay > 0 && today.Requests >= q.RequestsPerDay:
+		return fmt.Sprintf("已达到每日请求次数配额（%d）", q.RequestsPerDay)
+	case q.TokensPerDay > 0 && today.InputTokens+today.OutputTokens >= q.TokensPerDay:
+		return fmt.Sprintf("已达到每日token配额（%d）", q.TokensPerDay)
+	case q.TokensPerMonth > 0 && month.InputTokens+month.OutputTokens >= q.TokensPerMonth:
+		return fmt.Sprintf("已达到每月token配额（%d）", q.TokensPerMonth)
+	}
+	return ""
+}
+
+// newClientKeySecret 生成新的客户端Key
+func newClientKeySecret() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return "sk-bl-" + hex.EncodeToString(buf)
+}
+
+// newKeyID 生成Key的ID
+func newKeyID() string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return "key_" + hex.EncodeToString(buf)
+}
+
+// hashClientKey 计算客户端Key的SHA-256摘要
+func hashClientKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyUpdate 创建或修改Key时提交的字段，未提交的字段保持不变
+type keyUpdate struct {
+	Name            *string      `json:"name"`
+	Tenant          *string      `json:"tenant"`
+	AllowedModels   *[]string    `json:"allowed_models"`
+	DisableStream   *bool        `json:"disable_stream"`
+	DisableThoughts *bool        `json:"disable_thoughts"`
+	MaxTokens       *int         `json:"max_tokens"`
+	MaxTokensAction *string      `json:"max_tokens_action"`
+	Quota           *KeyQuota    `json:"quota"`
+	Budget          *SpendBudget `json:"budget"`
+	ExpiresAt       *string      `json:"expires_at"`      // RFC3339时间，空字符串表示永不过期
+	ExpiresInDays   *int         `json:"expires_in_days"` // 从现在起多少天后过期
+}
+
+// applyTo 把修改应用到Key上
+func (u keyUpdate) applyTo(k *managedKey) error {
+	if u.Name != nil {
+		k.Name = *u.Name
+	}
+	if u.Tenant != nil {
+		k.Tenant = *u.Tenant
+	}
+	if u.AllowedModels != nil {
+		k.AllowedModels = *u.AllowedModels
+	}
+	if u.DisableStream != nil {
+		k.DisableStream = *u.DisableStream
+	}
+	if u.DisableThoughts != nil {
+		k.DisableThoughts = *u.DisableThoughts
+	}
+	if u.MaxTokens != nil {
+		if *u.MaxTokens < 0 {
+			return errors.New("max_tokens 不能为负数")
+		}
+		k.MaxTokens = *u.MaxTokens
+	}
+	if u.MaxTokensAction != nil {
+		if !validMaxTokensAction(*u.MaxTokensAction) {
+			return fmt.Errorf("max_tokens_action 只能是 clamp 或 reject: %q", *u.MaxTokensAction)
+		}
+		k.MaxTokensAction = *u.MaxTokensAction
+	}
+	if u.Quota != nil {
+		if u.Quota.RequestsPerDay < 0 || u.Quota.TokensPerDay < 0 || u.Quota.TokensPerMonth < 0 {
+			return errors.New("quota 不能为负数")
+		}
+		k.Quota = *u.Quota
+	}
+	if u.Budget != nil {
+		if u.Budget.Daily < 0 || u.Budget.Monthly < 0 {
+			return errors.New("budget 不能为负数")
+		}
+		k.Budget = *u.Budget
+	}
+	switch {
+	case u.ExpiresInDays != nil:
+		if *u.ExpiresInDays <= 0 {
+			return errors.New("expires_in_days 必须大于0")
+		}
+		t := time.Now().AddDate(0, 0, *u.ExpiresInDays)
+		k.ExpiresAt = &t
+	case u.ExpiresAt != nil && *u.ExpiresAt == "":
+		k.ExpiresAt = nil
+	case u.ExpiresAt != nil:
+		t, err := time.Parse(time.RFC3339, *u.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("expires_at 格式错误（需要RFC3339格式）: %v", err)
+		}
+		k.ExpiresAt = &t
+	}
+	return nil
+}
+
+// CreateKey 创建客户端Key，返回Key信息和Key明文（明文只在创建和轮换时返回一次）
+func (s *keyStore) CreateKey(u keyUpdate) (managedKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret := newClientKeySecret()
+	k := &managedKey{
+		ID:        newKeyID(),
+		KeyHash:   hashClientKey(secret),
+		KeyPrefix: secret[:10],
+		CreatedAt: time.Now(),
+	}
+	if err := u.applyTo(k); err != nil {
+		return managedKey{}, "", err
+	}
+	s.data.Keys[k.ID] = k
+	s.byHash[k.KeyHash] = k
+	if err := s.saveLocked(); err != nil {
+		// 写入失败时撤销修改，否则Key在内存中生效，重启后却不存在
+		delete(s.data.Keys, k.ID)
+		delete(s.byHash, k.KeyHash)
+		return managedKey{}, "", err
+	}
+	return *k, secret, nil
+}
+
+// UpdateKey 修改Key的名称、租户、允许的模型、配额或有效期
+func (s *keyStore) UpdateKey(id string, u keyUpdate) (managedKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.data.Keys[id]
+	if !ok {
+		return managedKey{}, errKeyNotFound
+	}
+	original, updated := *k, *k
+	if err := u.applyTo(&updated); err != nil {
+		return managedKey{}, err
+	}
+	*k = updated
+	if err := s.saveLocked(); err != nil {
+		*k = original
+		return managedKey{}, err
+	}
+	return *k, nil
+}
+
+// RotateKey 生成新的Key明文，旧Key立即失效
+func (s *keyStore) RotateKey(id string) (managedKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.data.Keys[id]
+	if !ok {
+		return managedKey{}, "", errKeyNotFound
+	}
+	if k.RevokedAt != nil {
+		return managedKey{}, "", errors.New("已吊销的Key不能轮换")
+	}
+	secret := newClientKeySecret()
+	oldHash, oldPrefix := k.KeyHash, k.KeyPrefix
+	delete(s.byHash, oldHash)
+	k.KeyHash = hashClientKey(secret)
+	k.KeyPrefix = secret[:10]
+	s.byHash[k.KeyHash] = k
+	if err := s.saveLocked(); err != nil {
+		// 写入失败时旧Key继续有效，新Key不生效
+		delete(s.byHash, k.KeyHash)
+		k.KeyHash, k.KeyPrefix = oldHash, oldPrefix
+		s.byHash[oldHash] = k
+		return managedKey{}, "", err
+	}
+	return *k, secret, nil
+}
+
+// RevokeKey 吊销Key，吊销后不能恢复
+func (s *keyStore) RevokeKey(id string) (managedKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.data.Keys[id]
+	if !ok {
+		return managedKey{}, errKeyNotFound
+	}
+	if k.RevokedAt != nil {
+		return *k, nil
+	}
+	now := time.Now()
+	k.RevokedAt = &now
+	if err := s.saveLocked(); err != nil {
+		k.RevokedAt = nil
+		return managedKey{}, err
+	}
+	return *k, nil
+}
+
+// Keys 返回所有Key，按创建时间排序
+func (s *keyStore) Keys() []managedKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]managedKey, 0, len(s.data.Keys))
+	for _, k := range s.data.Keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Key 按ID查找Key
+func (s *keyStore) Key(id string) (managedKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.data.Keys[id]
+	if !ok {
+		return managedKey{}, false
+	}
+	return *k, true
+}
+
+// Tenants 返回管理接口创建的所有租户
+func (s *keyStore) Tenants() map[string]TenantConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenants := make(map[string]TenantConfig, len(s.data.Tenants))
+	for name, t := range s.data.Tenants {
+		tenants[name] = t
+	}
+	return tenants
+}
+
+// PutTenant 创建或替换租户，返回是否为新建
+func (s *keyStore) PutTenant(name string, t TenantConfig) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, exists := s.data.Tenants[name]
+	s.data.Tenants[name] = t
+	if err := s.saveLocked(); err != nil {
+		if exists {
+			s.data.Tenants[name] = previous
+		} else {
+			delete(s.data.Tenants, name)
+		}
+		return false, err
+	}
+	return !exists, nil
+}
+
+// DeleteTenant 删除租户，仍有未吊销的Key属于该租户时拒绝删除
+func (s *keyStore) DeleteTenant(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Tenants[name]; !ok {
+		return errTenantNotFound
+	}
+	for _, k := range s.data.Keys {
+		if k.Tenant == name && k.RevokedAt == nil {
+			return fmt.Errorf("Key %s 仍属于该租户，请先吊销或修改", k.ID)
+		}
+	}
+	previous := s.data.Tenants[name]
+	delete(s.data.Tenants, name)
+	if err := s.saveLocked(); err != nil {
+		s.data.Tenants[name] = previous
+		return err
+	}
+	return nil
+}
+
+var (
+	errKeyNotFound    = errors.New("Key不存在")
+	errTenantNotFound = errors.New("租户不存在")
+	errStoreWrite     = errors.New("写入存储文件失败")
+)
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errStreamFirstTokenTimeout 上游迟迟没有返回第一个事件
+	errStreamFirstTokenTimeout = errors.New("等待上游首个事件超时")
+	// errStreamIdleTimeout 上游流式响应空闲超时
+	errStreamIdleTimeout = errors.New("上游流式响应空闲超时")
+	// errStreamMaxDuration 超过流式请求的最长持续时间
+	errStreamMaxDuration = errors.New("流式请求超过最长持续时间")
+	// errServerShutdown 服务器关闭时排空时间已到，请求被强制结束
+	errServerShutdown = errors.New("服务器正在关闭")
+	// errSSEWriterClosed 写入器已关闭，handler可能已经返回
+	errSSEWriterClosed = errors.New("SSE写入器已关闭")
+)
+
+// streamWatchdog 流式请求看门狗
+// 分别控制首个事件的等待时间、事件之间的最大空闲间隔和总时长上限，
+// 任一条件触发都会取消请求上下文。超时为0表示不限制该项
+type streamWatchdog struct {
+	mu           sync.Mutex
+	idleTimer    *time.Timer
+	maxTimer     *time.Timer
+	firstTimeout time.Duration
+	idleTimeout  time.Duration
+	started      bool
+	reason       error
+	cancel       context.CancelCauseFunc
+}
+
+// newStreamWatchdog 创建并启动看门狗，返回受其控制的上下文
+func newStreamWatchdog(parent context.Context, firstTimeout, idleTimeout, maxDuration time.Duration) (*streamWatchdog, context.Context) {
+	// 以触发原因作为取消的cause，熔断器据此区分看门狗超时和客户端断开
+	ctx, cancel := context.WithCancelCause(parent)
+	wd := &streamWatchdog{
+		firstTimeout: firstTimeout,
+		idleTimeout:  idleTimeout,
+		cancel:       cancel,
+	}
+	if firstTimeout > 0 {
+		wd.idleTimer = time.AfterFunc(firstTimeout, func() { wd.fire(errStreamFirstTokenTimeout) })
+	}
+	if maxDuration > 0 {
+		wd.maxTimer = time.AfterFunc(maxDuration, func() { wd.fire(errStreamMaxDuration) })
+	}
+	// 优雅关闭的排空时间到了之后强制结束仍在进行的请求
+	go func() {
+		select {
+		case <-drainExpired:
+			wd.fire(errServerShutdown)
+		case <-ctx.Done():
+		}
+	}()
+	return wd, ctx
+}
+
+// newStreamWatchdogFromConfig 按当前配置创建看门狗
+func newStreamWatchdogFromConfig(parent context.Context) (*streamWatchdog, context.Context) {
+	cfg := currentConfig()
+	return newStreamWatchdog(parent,
+		time.Duration(cfg.StreamFirstTokenTimeout)*time.Second,
+		time.Duration(cfg.StreamIdleTimeout)*time.Second,
+		time.Duration(cfg.StreamTimeout)*time.Second)
+}
+
+func (wd *streamWatchdog) fire(reason error) {
+	wd.mu.Lock()
+	if wd.reason == nil {
+		wd.reason = reason
+	}
+	wd.mu.Unlock()
+	wd.cancel(reason)
+}
+
+// Reset 收到数据后重置空闲计时，第一次调用时从首包超时切换为空闲超时
+func (wd *streamWatchdog) Reset() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.reason != nil {
+		return
+	}
+	if wd.started {
+		if wd.idleTimer != nil {
+			wd.idleTimer.Reset(wd.idleTimeout)
+		}
+		return
+	}
+	wd.started = true
+	if wd.idleTimer != nil {
+		wd.idleTimer.Stop()
+		wd.idleTimer = nil
+	}
+	if wd.idleTimeout > 0 {
+		wd.idleTimer = time.AfterFunc(wd.idleTimeout, func() { wd.fire(errStreamIdleTimeout) })
+	}
+}
+
+// Stop 停止看门狗并释放上下文
+func (wd *streamWatchdog) Stop() {
+	wd.mu.Lock()
+	if wd.idleTimer != nil {
+		wd.idleTimer.Stop()
+	}
+	if wd.maxTimer != nil {
+		wd.maxTimer.Stop()
+	}
+	wd.mu.Unlock()
+	wd.cancel(nil)
+}
+
+// Reason 返回触发取消的原因，未触发时返回nil
+func (wd *streamWatchdog) Reason() error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	return wd.reason
+}
+
+// watchdogReader 每次读到数据都会重置看门狗的Reader
+type watchdogReader struct {
+	r  io.Reader
+	wd *streamWatchdog
+}
+
+func (wr *watchdogReader) Read(p []byte) (int, error) {
+	n, err := wr.r.Read(p)
+	if n > 0 {
+		wr.wd.Reset()
+	}
+	return n, err
+}
+
+// sseWriter 串行化写入客户端的SSE流，并在空闲时发送心跳注释
+// 心跳（": ping"）可以防止负载均衡和nginx在智能体思考期间关闭安静的连接
+type sseWriter struct {
+	mu        sync.Mutex
+	w         http.ResponseWriter
+	started   bool // 是否已向客户端写入过数据（响应头已发送）
+	closed    bool // Close之后拒绝一切写入，handler返回后不能再碰ResponseWriter
+	lastWrite time.Time
+	stop      chan struct{}
+	stopOnce  sync.Once
+	hbDone    sync.WaitGroup
+}
+
+// newSSEWriter 设置流式响应头并创建写入器
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	setSSEHeaders(w)
+	return &sseWriter{w: w, lastWrite: time.Now(), stop: make(chan struct{})}
+}
+
+// setSSEHeaders 设置流式响应头
+func setSSEHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // 禁用nginx缓冲
+}
+
+// Write 写入原始数据并立即刷新
+func (s *sseWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(p)
+}
+
+func (s *sseWriter) writeLocked(p []byte) (int, error) {
+	if s.closed {
+		return 0, errSSEWriterClosed
+	}
+	s.started = true
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	s.lastWrite = time.Now()
+	return n, nil
+}
+
+// Started 是否已向客户端写入过数据
+func (s *sseWriter) Started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+// WriteError 写入错误
+// 尚未向客户端输出任何数据时，返回带正确状态码的JSON错误；否则以SSE事件发送。
+// 返回值表示错误是否以SSE事件的形式发送
+func (s *sseWriter) WriteError(statusCode int, errorJSON []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "application/json")
+		s.w.WriteHeader(statusCode)
+		s.w.Write(errorJSON)
+		return false
+	}
+	s.writeLocked([]byte(fmt.Sprintf("data: %s\n\n", errorJSON)))
+	return true
+}
+
+// WriteData 写入一条 data: 事件
+func (s *sseWriter) WriteData(data []byte) error {
+	_, err := s.Write([]byte(fmt.Sprintf("data: %s\n\n", data)))
+	return err
+}
+
+// StartHeartbeat 启动心跳，距离上次写入超过interval时发送一条SSE注释
+func (s *sseWriter) StartHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.hbDone.Add(1)
+	go func() {
+		defer s.hbDone.Done()
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				idle := time.Since(s.lastWrite)
+				s.mu.Unlock()
+				if idle < interval {
+					continue
+				}
+				if _, err := s.Write([]byte(": ping\n\n")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Close 停止心跳并等待心跳协程退出，之后的写入都会被拒绝
+func (s *sseWriter) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.hbDone.Wait()
+}
+
+// failStream 流式请求失败时的统一处理
+// 尚未向客户端输出任何数据时返回带正确状态码的JSON错误；流已开始时依次发送
+// OpenAI格式的错误事件、finish_reason为"error"的结束chunk和[DONE]，
+// 让客户端能够区分被截断的流和正常结束的流
+func failStream(sw *sseWriter, statusCode int, errorJSON []byte, id, model string, created int64) {
+	if !sw.WriteError(statusCode, errorJSON) {
+		return
+	}
+	terminalChunk := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"delta":         map[string]interface{}{},
+				"finish_reason": "error",
+			},
+		},
+	}
+	terminalJSON, _ := json.Marshal(terminalChunk)
+	sw.WriteData(terminalJSON)
+	sw.Write([]byte("data: [DONE]\n\n"))
+}
+
+// classifyStreamError 根据中断原因确定返回给客户端的状态码、错误类型、提示信息和截断原因
+// parent 为客户端请求的上下文，用于识别客户端主动断开
+func classifyStreamError(parent context.Context, wd *streamWatchdog, err error) (statusCode int, errType, message, reason string) {
+	switch wd.Reason() {
+	case errStreamFirstTokenTimeout:
+		return http.StatusGatewayTimeout, "timeout_error", "等待上游首个事件超时，请稍后重试", truncateFirstTokenTimeout
+	case errStreamIdleTimeout:
+		return http.StatusGatewayTimeout, "timeout_error", "上游响应停滞，请稍后重试", truncateIdleTimeout
+	case errStreamMaxDuration:
+		return http.StatusGatewayTimeout, "timeout_error", "流式请求超过最长持续时间", truncateMaxDuration
+	case errServerShutdown:
+		return http.StatusServiceUnavailable, "server_error", "服务器正在重启，请重试", truncateServerShutdown
+	}
+	if parent.Err() != nil {
+		return 499, "", "", truncateClientDisconnect
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return http.StatusServiceUnavailable, "server_error", errCircuitOpen.Error(), truncateUpstreamRead
+	}
+	if errors.Is(err, errNoUpstreamKey) {
+		return http.StatusServiceUnavailable, "server_error", errNoUpstreamKey.Error(), truncateUpstreamRead
+	}
+	if err == nil {
+		return http.StatusBadGateway, "server_error", "上游流式响应意外结束", truncateUpstreamEOF
+	}
+	return http.StatusBadGateway, "server_error", "读取上游流式响应失败: " + err.Error(), truncateUpstreamRead
+}
+
+// readNativeStream 逐条解析原生API的SSE流，每解析出一个事件调用一次fn
+// fn返回false时停止读取
+func readNativeStream(body io.Reader, fn func(nativeResp AliyunNativeResponse) bool) error {
+	scanner := bufio.NewScanner(body)
+	// 原生API返回的是累计全文，长回答的单行数据可能超过默认的64KB
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		jsonStr := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if jsonStr == "" || !strings.HasPrefix(jsonStr, "{") {
+			continue
+		}
+
+		var nativeResp AliyunNativeResponse
+		if err := json.Unmarshal([]byte(jsonStr), &nativeResp); err != nil {
+			log.Printf("解析SSE数据失败: %v, 数据: %s", err, jsonStr[:min(100, len(jsonStr))])
+			continue
+		}
+
+		if !fn(nativeResp) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DashScope异步任务（图片生成、录音文件识别等）：提交时带 X-DashScope-Async: enable，
+// 上游返回task_id后通过 GET /api/v1/tasks/{task_id} 查询状态和结果
+
+const (
+	maxTaskPollInterval = 10 * time.Second // 轮询间隔退避的上限
+	taskRetention       = 24 * time.Hour   // 上游保存任务结果的时间，之后不能再查询
+	maxTasksPerScope    = 1000             // 每个客户端在保存期内最多保存的任务数
+	maxTasks            = 100000           // 所有客户端合计最多保存的任务数
+)
+
+// errTooManyTasks 保存的异步任务已达上限，拒绝提交新任务
+var errTooManyTasks = errors.New("异步任务过多，请等待已提交的任务过期后再试")
+
+// dashscopeTask 异步任务的状态，各类任务的结果由调用方从 body 中按任务类型解析
+type dashscopeTask struct {
+	Output struct {
+		TaskID     string `json:"task_id"`
+		TaskStatus string `json:"task_status"` // PENDING / RUNNING / SUCCEEDED / FAILED / CANCELED / UNKNOWN
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+	} `json:"output"`
+	RequestID string `json:"request_id"`
+	body      []byte
+}
+
+// Finished 任务是否已结束（成功或失败）
+func (t *dashscopeTask) Finished() bool {
+	switch t.Output.TaskStatus {
+	case "PENDING", "RUNNING":
+		return false
+	}
+	return true
+}
+
+// Succeeded 任务是否已成功
+func (t *dashscopeTask) Succeeded() bool {
+	return t.Output.TaskStatus == "SUCCEEDED"
+}
+
+// getTaskEndpoint 获取查询异步任务的接口地址
+func getTaskEndpoint(cfg *Config, taskID string) string {
+	return cfg.BaseURL + "/api/v1/tasks/" + url.PathEscape(taskID)
+}
+
+// parseTask 解析任务接口的响应
+func parseTask(status int, body []byte) (*dashscopeTask, error) {
+	if status != http.StatusOK {
+		return nil, &upstreamStatusError{status: status, body: body}
+	}
+	task := &dashscopeTask{body: body}
+	if err := json.Unmarshal(body, task); err != nil || task.Output.TaskID == "" {
+		return nil, fmt.Errorf("上游任务响应格式错误: %s", body)
+	}
+	return task, nil
+}
+
+// submitTask 提交异步任务，返回任务和提交时上游实际使用的凭证（查询结果时需要使用同一个Key）
+// header 为额外的请求头，可以为nil
+func submitTask(ctx context.Context, client *http.Client, route upstreamRoute, endpoint string, body []byte, header http.Header) (*dashscopeTask, upstreamRoute, error) {
+	req, err := newServiceRequest(ctx, route, http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, route, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-DashScope-Async", "enable")
+	status, respBody, authorization, err := doService(client, req)
+	if err != nil {
+		return nil, route, err
+	}
+	task, err := parseTask(status, respBody)
+	if err != nil {
+		return nil, route, err
+	}
+	if route.APIKey == "" && authorization != "" {
+		route.APIKey = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	log.Printf("已提交异步任务 %s，状态 %s", task.Output.TaskID, task.Output.TaskStatus)
+	return task, route, nil
+}
+
+// pollTask 查询一次任务状态
+func pollTask(ctx context.Context, client *http.Client, route upstreamRoute, endpoint string) (*dashscopeTask, error) {
+	status, body, err := callService(ctx, client, route, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseTask(status, body)
+}
+
+// waitTask 轮询任务直到结束或超时，轮询间隔从interval开始逐次增加到 maxTaskPollInterval
+// 超时时返回最后一次查询到的（未结束的）任务，由调用方决定如何响应
+func waitTask(ctx context.Context, client *http.Client, route upstreamRoute, endpoint string, interval, timeout time.Duration) (*dashscopeTask, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		task, err := pollTask(ctx, client, route, endpoint)
+		if err != nil || task.Finished() {
+			return task, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return task, nil
+		}
+		wait := interval
+		if wait > remaining {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if interval = interval * 3 / 2; interval > maxTaskPollInterval {
+			interval = maxTaskPollInterval
+		}
+	}
+}
+
+// writeTaskFailure 返回任务失败的错误：内容审核不通过、参数错误等属于请求的问题，返回400
+func writeTaskFailure(w http.ResponseWriter, taskID, code, message string) {
+	log.Printf("异步任务 %s 失败: %s %s", taskID, code, message)
+	if message == "" {
+		message = "任务失败"
+	}
+	status, errType := http.StatusBadGateway, "server_error"
+	if code == "DataInspectionFailed" || code == "IPInfringementSuspect" || strings.HasPrefix(code, "InvalidParameter") {
+		status, errType = http.StatusBadRequest, "invalid_request_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(openAIErrorJSON(errType, code, message))
+}
+
+// asyncTask 代理提交的异步任务，客户端可以通过任务ID查询结果
+type asyncTask struct {
+	Kind          string        // 任务类型：image / transcription
+	Scope         string        // 提交任务的客户端，只有同一个客户端可以查询
+	Route         upstreamRoute // 提交时使用的凭证和业务空间
+	Model         string        // 请求的模型名
+	UpstreamModel string        // 上游模型
+	Format        string        // 结果的返回格式
+	Language      string        // 语音识别：请求中指定的语言
+	Words         bool          // 语音识别：verbose_json中是否返回词级时间戳
+	Created       time.Time
+	reported      bool // 用量已计入
+}
+
+// taskStore 按任务ID保存代理提交的异步任务，保存时间与上游一致，按客户端和总量限制条数
+type taskStore struct {
+	mu      sync.Mutex
+	tasks   map[string]*asyncTask
+	byScope map[string]int // 每个客户端保存的任务数
+}
+
+// asyncTasks 全局的异步任务表
+var asyncTasks = &taskStore{tasks: make(map[string]*asyncTask), byScope: make(map[string]int)}
+
+// CheckCapacity 提交上游任务前检查是否还能保存，避免任务提交后无法查询
+// 并发提交时可能略微超出上限
+func (s *taskStore) CheckCapacity(scope string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tasks) >= maxTasks || s.byScope[scope] >= maxTasksPerScope {
+		return errTooManyTasks
+	}
+	return nil
+}
+
+// Add 保存任务
+func (s *taskStore) Add(id string, task *asyncTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.tasks[id]; ok {
+		s.byScope[old.Scope]--
+	}
+	s.tasks[id] = task
+	s.byScope[task.Scope]++
+}
+
+// expire 清理超过保存时间的任务
+func (s *taskStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, task := range s.tasks {
+		if now.Sub(task.Created) <= taskRetention {
+			continue
+		}
+		delete(s.tasks, id)
+		if s.byScope[task.Scope]--; s.byScope[task.Scope] <= 0 {
+			delete(s.byScope, task.Scope)
+		}
+	}
+}
+
+// StartExpirer 定期清理过期的任务，提交任务时不再扫描整个表
+func (s *taskStore) StartExpirer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.expire()
+		}
+	}()
+}
+
+// Get 查找客户端自己提交的指定类型的任务
+func (s *taskStore) Get(id, kind, scope string) (*asyncTask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok || task.Kind != kind || task.Scope != scope || time.Since(task.Created) > taskRetention {
+		return nil, false
+	}
+	return task, true
+}
+
+// MarkReported 标记任务的用量已计入，只有第一次调用返回true，避免多次查询结果时重复计费
+func (s *taskStore) MarkReported(task *asyncTask) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if task.reported {
+		return false
+	}
+	task.reported = true
+	return true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// TenantConfig 租户配置：租户使用自己的百炼业务空间和API Key，费用与其他租户隔离
+// 也可以通过管理接口创建，保存在 store_file 中
+type TenantConfig struct {
+	APIKey      string                 `yaml:"api_key" json:"api_key,omitempty"`           // 租户自己的DashScope API Key，为空时使用全局Key池
+	Workspace   string                 `yaml:"workspace" json:"workspace,omitempty"`       // 业务空间ID，通过 X-DashScope-WorkSpace 请求头传给上游
+	AppID       string                 `yaml:"app_id" json:"app_id,omitempty"`             // 默认应用，请求的模型未匹配到应用时使用
+	Apps        map[string]AppConfig   `yaml:"apps" json:"apps,omitempty"`                 // 租户自己的模型名 -> 应用映射，优先于全局apps
+	AllowedApps []string               `yaml:"allowed_apps" json:"allowed_apps,omitempty"` // 允许使用的模型名，为空表示不限制
+	Parameters  map[string]interface{} `yaml:"parameters" json:"parameters,omitempty"`     // 默认请求参数（如temperature），请求中未设置时使用
+	Budget      SpendBudget            `yaml:"budget" json:"budget"`                       // 租户所有请求的费用预算
+}
+
+// ClientKeyConfig 配置文件中的客户端Key（通过管理接口创建的Key保存在 store_file 中）
+type ClientKeyConfig struct {
+	Name   string      `yaml:"name"`   // 显示名称，用于日志
+	Key    string      `yaml:"key"`    // 客户端请求时携带的Key（Authorization: Bearer <key>）
+	Tenant string      `yaml:"tenant"` // 所属租户，为空时使用全局配置
+	Quota  KeyQuota    `yaml:"quota"`  // 用量配额
+	Budget SpendBudget `yaml:"budget"` // 费用预算
+
+	// 权限范围：allowed_models、disable_stream、disable_thoughts、max_tokens、max_tokens_action
+	KeyScopes `yaml:",inline"`
+}
+
+// clientKey 已认证的客户端Key，配置文件和管理接口创建的Key统一为这个结构
+type clientKey struct {
+	ID     string // 用量统计使用的标识，配置文件中的Key为 config:名称
+	Name   string
+	Tenant string
+	KeyScopes
+	Quota  KeyQuota
+	Budget SpendBudget
+}
+
+// clientKeyKey 请求上下文中保存已认证的客户端Key的键
+type clientKeyKey struct{}
+
+// requestClientKey 返回请求使用的客户端Key，未认证时返回nil
+func requestClientKey(r *http.Request) *clientKey {
+	ck, _ := r.Context().Value(clientKeyKey{}).(*clientKey)
+	return ck
+}
+
+// authenticateClientKey 依次在配置文件和管理接口创建的Key中查找
+// 返回nil且err不为nil表示Key存在但已吊销或过期
+func authenticateClientKey(cfg *Config, provided string) (*clientKey, error) {
+	if provided == "" {
+		return nil, nil
+	}
+	for _, ck := range cfg.ClientKeys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(ck.Key)) == 1 {
+			name := ck.Name
+			if name == "" {
+				name = maskAPIKey(ck.Key)
+			}
+			return &clientKey{
+				ID:        "config:" + name,
+				Name:      name,
+				Tenant:    ck.Tenant,
+				KeyScopes: ck.KeyScopes,
+				Quota:     ck.Quota,
+				Budget:    ck.Budget,
+			}, nil
+		}
+	}
+	return clientStore.Authenticate(provided)
+}
+
+// requireClientKey 客户端认证：配置了客户端Key（配置文件或管理接口）时，请求必须携带有效的Key
+// 已通过客户端证书识别出租户的请求（mTLS）不需要再携带Key。请求结束后把用量计入Key和租户
+func requireClientKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		if tenant := requestTenant(r); tenant != "" {
+			meterRequest(w, r, cfg, nil, tenant, next)
+			return
+		}
+		if len(cfg.ClientKeys) == 0 && !clientStore.HasKeys() {
+			next(w, r)
+			return
+		}
+
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if provided == "" {
+			// Anthropic SDK 通过 x-api-key 请求头携带Key
+			provided = r.Header.Get("X-Api-Key")
+		}
+		ck, err := authenticateClientKey(cfg, provided)
+		if ck == nil {
+			message := "无效的API Key"
+			if err != nil {
+				message = err.Error()
+			}
+			log.Printf("客户端认证失败: %s %s，来源 %s，%s", r.Method, r.URL.Path, r.RemoteAddr, message)
+			writeOpenAIError(w, http.StatusUnauthorized, "authentication_error", message)
+			return
+		}
+
+		if reason := clientStore.QuotaExceeded(ck); reason != "" && !isTaskPoll(r) {
+			log.Printf("客户端Key %s 配额不足: %s", ck.Name, reason)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write(openAIErrorJSON("insufficient_quota", "quota_exceeded", reason))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), clientKeyKey{}, ck)
+		if ck.Tenant != "" {
+			ctx = context.WithValue(ctx, clientIdentityKey{}, ck.Tenant)
+		}
+		meterRequest(w, r.WithContext(ctx), cfg, ck, ck.Tenant, next)
+	}
+}
+
+// taskPollKey 请求上下文中标记查询异步任务的请求
+type taskPollKey struct{}
+
+// requireTaskPollKey 查询异步任务（GET /v1/images/generations/{任务ID} 等）的客户端认证
+// 任务提交时已经计入一次请求，查询不再计入请求次数，也不受配额和费用预算限制，
+// 否则轮询会耗尽配额，已经计费的任务结果也拿不到；结果产生的用量仍在第一次拿到结果时计入
+func requireTaskPollKey(next http.HandlerFunc) http.HandlerFunc {
+	auth := requireClientKey(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth(w, r.WithContext(context.WithValue(r.Context(), taskPollKey{}, true)))
+	}
+}
+
+// isTaskPoll 请求是否是查询异步任务的请求
+func isTaskPoll(r *http.Request) bool {
+	poll, _ := r.Context().Value(taskPollKey{}).(bool)
+	return poll
+}
+
+// lookupTenant 查找租户，配置文件中的租户优先于管理接口创建的租户
+func lookupTenant(cfg *Config, name string) (TenantConfig, bool) {
+	if tenant, ok := cfg.Tenants[name]; ok {
+		return tenant, true
+	}
+	return clientStore.Tenant(name)
+}
+
+// upstreamRoute 一次请求转发到上游所需的应用和凭证
+type upstreamRoute struct {
+	AppID      string
+	APIKey     string // 为空时由Key池分配
+	Workspace  string
+	Parameters map[string]interface{}
+}
+
+// resolveRoute 根据租户和请求的模型名确定上游应用和凭证
+// 租户的apps优先于全局apps；租户有自己的API Key时只能使用自己业务空间的应用
+func resolveRoute(cfg *Config, tenantName, model string) (upstreamRoute, error) {
+	tenant, ok := lookupTenant(cfg, tenantName)
+	if !ok {
+		// 未配置租户（或证书映射的租户没有单独配置）时使用全局配置
+		return upstreamRoute{AppID: resolveAppID(cfg, model)}, nil
+	}
+
+	if len(tenant.AllowedApps) > 0 && !containsString(tenant.AllowedApps, model) {
+		return upstreamRoute{}, fmt.Errorf("租户 %s 无权使用模型 %q", tenantName, model)
+	}
+
+	route := upstreamRoute{
+		APIKey:     tenant.APIKey,
+		Workspace:  tenant.Workspace,
+		Parameters: tenant.Parameters,
+	}
+	switch app, ok := tenant.Apps[model]; {
+	case ok:
+		route.AppID = app.AppID
+	case tenant.APIKey != "":
+		route.AppID = tenant.AppID
+	default:
+		route.AppID = resolveAppID(cfg, model)
+		if _, global := cfg.Apps[model]; !global && tenant.AppID != "" {
+			route.AppID = tenant.AppID
+		}
+	}
+	return route, nil
+}
+
+// resolveCredentials 确定服务类接口（文本向量等，不经过百炼应用）使用的凭证和业务空间
+// 租户有自己的API Key时使用租户的Key，否则由Key池分配
+func resolveCredentials(cfg *Config, tenantName string) upstreamRoute {
+	tenant, ok := lookupTenant(cfg, tenantName)
+	if !ok {
+		return upstreamRoute{}
+	}
+	return upstreamRoute{APIKey: tenant.APIKey, Workspace: tenant.Workspace}
+}
+
+// apply 设置上游请求的凭证和业务空间请求头
+func (rt upstreamRoute) apply(req *http.Request) {
+	if rt.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+rt.APIKey)
+	}
+	if rt.Workspace != "" {
+		req.Header.Set("X-DashScope-WorkSpace", rt.Workspace)
+	}
+}
+
+// applyDefaultParameters 把租户的默认参数补充到原生请求中，请求中已设置的参数不覆盖
+func (rt upstreamRoute) applyDefaultParameters(nativeReq *AliyunNativeRequest) {
+	for name, value := range rt.Parameters {
+		if _, ok := nativeReq.Parameters[name]; !ok {
+			nativeReq.Parameters[name] = value
+		}
+	}
+}
+
+// containsString 判断切片中是否包含指定字符串
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClientKeysEnv 解析 CLIENT_KEYS 环境变量，格式：Key[=租户],Key[=租户]
+func parseClientKeysEnv(value string) []ClientKeyConfig {
+	var keys []ClientKeyConfig
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, tenant, _ := strings.Cut(item, "=")
+		keys = append(keys, ClientKeyConfig{Name: maskAPIKey(key), Key: key, Tenant: tenant})
+	}
+	return keys
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxTranscriptDownload 下载识别结果的大小上限
+const maxTranscriptDownload = 64 * 1024 * 1024
+
+// dashscopeUploadPolicy DashScope临时存储的上传凭证，上传的文件保存48小时，只能由同一个账号使用
+type dashscopeUploadPolicy struct {
+	Data struct {
+		Policy          string `json:"policy"`
+		Signature       string `json:"signature"`
+		UploadDir       string `json:"upload_dir"`
+		UploadHost      string `json:"upload_host"`
+		MaxFileSizeMB   int    `json:"max_file_size_mb"`
+		OSSAccessKeyID  string `json:"oss_access_key_id"`
+		ObjectACL       string `json:"x_oss_object_acl"`
+		ForbidOverwrite string `json:"x_oss_forbid_overwrite"`
+	} `json:"data"`
+}
+
+// dashscopeTranscriptionOutput 录音文件识别任务的结果，每个文件一个子任务
+type dashscopeTranscriptionOutput struct {
+	Output struct {
+		Results []struct {
+			TranscriptionURL string `json:"transcription_url"`
+			SubtaskStatus    string `json:"subtask_status"`
+			Code             string `json:"code"`
+			Message          string `json:"message"`
+		} `json:"results"`
+	} `json:"output"`
+	Usage struct {
+		Duration int `json:"duration"` // 计费的音频时长（秒）
+	} `json:"usage"`
+}
+
+// paraformerTranscript 识别结果文件，多声道录音每个声道一份
+type paraformerTranscript struct {
+	Properties struct {
+		OriginalDurationInMilliseconds int `json:"original_duration_in_milliseconds"`
+	} `json:"properties"`
+	Transcripts []struct {
+		ChannelID int                  `json:"channel_id"`
+		Text      string               `json:"text"`
+		Sentences []paraformerSentence `json:"sentences"`
+	} `json:"transcripts"`
+}
+
+// paraformerSentence 识别出的一句话，时间单位为毫秒
+type paraformerSentence struct {
+	BeginTime int    `json:"begin_time"`
+	EndTime   int    `json:"end_time"`
+	Text      string `json:"text"`
+	Words     []struct {
+		BeginTime   int    `json:"begin_time"`
+		EndTime     int    `json:"end_time"`
+		Text        string `json:"text"`
+		Punctuation string `json:"punctuation"`
+	} `json:"words"`
+	channel int
+}
+
+// transcriptionFormats 支持的 response_format
+var transcriptionFormats = []string{"json", "text", "verbose_json", "srt", "vtt"}
+
+// getUploadPolicyEndpoint 获取DashScope临时存储上传凭证的接口地址
+func getUploadPolicyEndpoint(cfg *Config, model string) string {
+	return cfg.BaseURL + "/api/v1/uploads?action=getPolicy&model=" + url.QueryEscape(model)
+}
+
+// getTranscriptionEndpoint 获取DashScope录音文件识别接口地址
+func getTranscriptionEndpoint(cfg *Config) string {
+	return cfg.BaseURL + "/api/v1/services/audio/asr/transcription"
+}
+
+// handleTranscriptions 处理OpenAI格式的语音转写请求（multipart上传音频文件）
+// 录音文件识别只接受文件地址：代理先把文件上传到DashScope临时存储，再提交Paraformer异步任务并轮询到完成
+func handleTranscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "只支持POST请求")
+		return
+	}
+	cfg := currentConfig()
+	clients := currentClients()
+
+	maxBytes := int64(cfg.TranscriptionMaxUploadMB) * 1024 * 1024
+	r.Body = http.MaxBytesReader(w, r.Body, transcriptionBodyLimit())
+	// 超过1MB的音频文件暂存到磁盘，上传时从磁盘读取
+	if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", fmt.Sprintf("音频文件超过 %d MB", cfg.TranscriptionMaxUploadMB))
+			return
+		}
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "请求格式错误，需要multipart/form-data: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "缺少音频文件（file字段）")
+		return
+	}
+	defer file.Close()
+	if header.Size > maxBytes {
+		writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", fmt.Sprintf("音频文件超过 %d MB", cfg.TranscriptionMaxUploadMB))
+		return
+	}
+	requestModel := r.FormValue("model")
+	format := r.FormValue("response_format")
+	if format == "" {
+		format = "json"
+	}
+	if !containsString(transcriptionFormats, format) {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error",
+			fmt.Sprintf("无效的 response_format %q（可选 %s）", format, strings.Join(transcriptionFormats, "、")))
+		return
+	}
+
+	reportModel(r.Context(), requestModel)
+	if err := checkModelScope(r, requestModel); err != nil {
+		writeScopeError(w, err)
+		return
+	}
+	model := resolveServiceModel(cfg.TranscriptionModels, cfg.TranscriptionModel, requestModel)
+
+	if err := asyncTasks.CheckCapacity(requestScope(r)); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	fileURL, route, err := uploadTemporaryFile(r.Context(), cfg, clients, resolveCredentials(cfg, requestTenant(r)), model, header.Filename, file, header.Size)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	parameters := map[string]interface{}{}
+	language := r.FormValue("language")
+	if language != "" {
+		parameters["language_hints"] = []string{language}
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      model,
+		"input":      map[string]interface{}{"file_urls": []string{fileURL}},
+		"parameters": parameters,
+	})
+	endpoint := getTranscriptionEndpoint(cfg)
+	log.Printf("提交录音文件识别任务到阿里云百炼: %s，模型 %s，文件 %s（%d 字节）", endpoint, model, header.Filename, header.Size)
+
+	// 临时存储中的文件以 oss:// 地址提交，需要上游解析
+	ossHeader := http.Header{}
+	ossHeader.Set("X-DashScope-OssResourceResolve", "enable")
+	task, route, err := submitTask(r.Context(), clients.client, route, endpoint, body, ossHeader)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	taskID := task.Output.TaskID
+	at := &asyncTask{
+		Kind:          "transcription",
+		Scope:         requestScope(r),
+		Route:         route,
+		Model:         requestModel,
+		UpstreamModel: model,
+		Format:        format,
+		Language:      language,
+		Words:         containsString(r.MultipartForm.Value["timestamp_granularities[]"], "word"),
+		Created:       time.Now(),
+	}
+	asyncTasks.Add(taskID, at)
+
+	timeout := time.Duration(cfg.TranscriptionTaskTimeout) * time.Second
+	interval := time.Duration(cfg.TaskPollInterval) * time.Second
+	task, err = waitTask(r.Context(), clients.client, route, getTaskEndpoint(cfg, taskID), interval, timeout)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if !task.Finished() {
+		// 任务已经提交并计费，返回202和任务ID，幂等重试时重放这个响应而不是再提交一次
+		log.Printf("录音文件识别任务 %s 在 %d 秒内未完成，返回任务ID", taskID, cfg.TranscriptionTaskTimeout)
+		writeTranscriptionTaskStatus(w, taskID, at, task)
+		return
+	}
+	writeTranscriptionResult(w, r, taskID, at, task)
+}
+
+// handleTranscriptionTask 查询未完成的识别任务（GET /v1/audio/transcriptions/{任务ID}），只能查询自己提交的任务
+func handleTranscriptionTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "只支持GET请求")
+		return
+	}
+	taskID := strings.TrimPrefix(r.URL.Path, "/v1/audio/transcriptions/")
+	at, ok := asyncTasks.Get(taskID, "transcription", requestScope(r))
+	if !ok {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("录音文件识别任务 %s 不存在或已过期", taskID))
+		return
+	}
+	reportModel(r.Context(), at.Model)
+
+	cfg := currentConfig()
+	task, err := pollTask(r.Context(), currentClients().client, at.Route, getTaskEndpoint(cfg, taskID))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if !task.Finished() {
+		writeTranscriptionTaskStatus(w, taskID, at, task)
+		return
+	}
+	writeTranscriptionResult(w, r, taskID, at, task)
+}
+
+// writeTranscriptionTaskStatus 返回未完成的识别任务的状态
+func writeTranscriptionTaskStatus(w http.ResponseWriter, taskID string, at *asyncTask, task *dashscopeTask) {
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"id":      taskID,
+		"object":  "audio.transcription.task",
+		"created": at.Created.Unix(),
+		"status":  strings.ToLower(task.Output.TaskStatus),
+	})
+}
+
+// uploadTemporaryFile 把文件上传到DashScope临时存储，返回 oss:// 地址和获取上传凭证时使用的凭证
+// 文件属于获取凭证的账号，之后提交任务时必须使用同一个Key。文件内容边读边上传，不在内存中再保存一份
+func uploadTemporaryFile(ctx context.Context, cfg *Config, clients *upstreamClients, route upstreamRoute, model, filename string, file io.Reader, size int64) (string, upstreamRoute, error) {
+	req, err := newServiceRequest(ctx, route, http.MethodGet, getUploadPolicyEndpoint(cfg, model), nil)
+	if err != nil {
+		return "", route, err
+	}
+	status, body, authorization, err := doService(clients.client, req)
+	if err != nil {
+		return "", route, err
+	}
+	if status != http.StatusOK {
+		return "", route, &upstreamStatusError{status: status, body: body}
+	}
+	if route.APIKey == "" && authorization != "" {
+		route.APIKey = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	var policy dashscopeUploadPolicy
+	if err := json.Unmarshal(body, &policy); err != nil || policy.Data.UploadHost == "" {
+		return "", route, fmt.Errorf("上游上传凭证格式错误: %s", body)
+	}
+	if limit := policy.Data.MaxFileSizeMB; limit > 0 && size > int64(limit)*1024*1024 {
+		return "", route, &upstreamStatusError{
+			status: http.StatusRequestEntityTooLarge,
+			body:   openAIErrorJSON("invalid_request_error", "file_too_large", fmt.Sprintf("音频文件超过上游临时存储的上限 %d MB", limit)),
+		}
+	}
+
+	name := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "audio"
+	}
+	key := policy.Data.UploadDir + "/" + name
+
+	// OSS表单上传，file必须是最后一个字段
+	fields := [][2]string{
+		{"OSSAccessKeyId", policy.Data.OSSAccessKeyID},
+		{"Signature", policy.Data.Signature},
+		{"policy", policy.Data.Policy},
+		{"x-oss-object-acl", policy.Data.ObjectACL},
+		{"x-oss-forbid-overwrite", policy.Data.ForbidOverwrite},
+		{"key", key},
+		{"success_action_status", "200"},
+	}
+	writeForm := func(mw *multipart.Writer, content io.Reader) error {
+		for _, field := range fields {
+			if err := mw.WriteField(field[0], field[1]); err != nil {
+				return err
+			}
+		}
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, content); err != nil {
+			return err
+		}
+		return mw.Close()
+	}
+
+	// 先用相同的分隔符写一遍不含文件内容的表单，得到请求体长度，OSS表单上传需要 Content-Length
+	var envelope bytes.Buffer
+	sizing := multipart.NewWriter(&envelope)
+	if err := writeForm(sizing, strings.NewReader("")); err != nil {
+		return "", route, err
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	mw.SetBoundary(sizing.Boundary())
+	go func() {
+		pw.CloseWithError(writeForm(mw, io.LimitReader(file, size)))
+	}()
+
+	uploadReq, err := http.NewRequestWithContext(ctx, http.MethodPost, policy.Data.UploadHost, pr)
+	if err != nil {
+		return "", route, err
+	}
+	uploadReq.ContentLength = int64(envelope.Len()) + size
+	uploadReq.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := directClient(cfg, clients).Do(uploadReq)
+	if err != nil {
+		return "", route, fmt.Errorf("上传音频文件失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		log.Printf("上传音频文件到临时存储失败: HTTP %d %s", resp.StatusCode, respBody)
+		return "", route, fmt.Errorf("上传音频文件失败: HTTP %d", resp.StatusCode)
+	}
+	log.Printf("音频文件已上传到临时存储: %s", key)
+	return "oss://" + key, route, nil
+}
+
+// writeTranscriptionResult 下载识别结果并按请求的格式返回，第一次拿到成功结果时计入用量
+func writeTranscriptionResult(w http.ResponseWriter, r *http.Request, taskID string, at *asyncTask, task *dashscopeTask) {
+	if !task.Succeeded() {
+		writeTaskFailure(w, taskID, task.Output.Code, task.Output.Message)
+		return
+	}
+	var output dashscopeTranscriptionOutput
+	if err := json.Unmarshal(task.body, &output); err != nil || len(output.Output.Results) == 0 {
+		log.Printf("解析录音文件识别结果失败: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "上游响应格式错误")
+		return
+	}
+	result := output.Output.Results[0]
+	if result.SubtaskStatus != "SUCCEEDED" || result.TranscriptionURL == "" {
+		writeTaskFailure(w, taskID, result.Code, result.Message)
+		return
+	}
+
+	transcript, err := downloadTranscript(r.Context(), directClient(currentConfig(), currentClients()), result.TranscriptionURL)
+	if err != nil {
+		log.Printf("下载识别结果失败: %v", err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "下载识别结果失败: "+err.Error())
+		return
+	}
+
+	if asyncTasks.MarkReported(at) {
+		seconds := output.Usage.Duration
+		if seconds == 0 {
+			seconds = (transcript.Properties.OriginalDurationInMilliseconds + 999) / 1000
+		}
+		reportTokens(r.Context(), modelTokens{ModelID: at.UpstreamModel, AudioSeconds: seconds})
+	}
+
+	sentences := transcript.sentences()
+	switch at.Format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, transcript.text(sentences)+"\n")
+	case "srt", "vtt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, formatSubtitles(sentences, at.Format))
+	case "verbose_json":
+		writeJSON(w, http.StatusOK, transcript.verbose(sentences, at.Language, at.Words))
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"text": transcript.text(sentences)})
+	}
+}
+
+// downloadTranscript 下载识别结果文件
+func downloadTranscript(ctx context.Context, client *http.Client, transcriptionURL string) (*paraformerTranscript, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, transcriptionURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var transcript paraformerTranscript
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTranscriptDownload)).Decode(&transcript); err != nil {
+		return nil, err
+	}
+	return &transcript, nil
+}
+
+// sentences 所有声道的句子按开始时间排序，双声道的通话录音按对话顺序排列
+func (t *paraformerTranscript) sentences() []paraformerSentence {
+	var sentences []paraformerSentence
+	for _, channel := range t.Transcripts {
+		for _, s := range channel.Sentences {
+			s.channel = channel.ChannelID
+			sentences = append(sentences, s)
+		}
+	}
+	sort.SliceStable(sentences, func(i, j int) bool {
+		return sentences[i].BeginTime < sentences[j].BeginTime
+	})
+	return sentences
+}
+
+// text 完整的识别文本：单声道使用上游的全文，多声道按句子的时间顺序拼接
+func (t *paraformerTranscript) text(sentences []paraformerSentence) string {
+	if len(t.Transcripts) == 1 {
+		return t.Transcripts[0].Text
+	}
+	texts := make([]string, 0, len(sentences))
+	for _, s := range sentences {
+		texts = append(texts, s.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// verbose 构建OpenAI verbose_json格式的结果，时间单位为秒；多声道录音的segment中带有channel
+func (t *paraformerTranscript) verbose(sentences []paraformerSentence, language string, words bool) map[string]interface{} {
+	segments := make([]map[string]interface{}, 0, len(sentences))
+	var wordList []map[string]interface{}
+	for i, s := range sentences {
+		segment := map[string]interface{}{
+			"id":    i,
+			"start": float64(s.BeginTime) / 1000,
+			"end":   float64(s.EndTime) / 1000,
+			"text":  s.Text,
+		}
+		if len(t.Transcripts) > 1 {
+			segment["channel"] = s.channel
+		}
+		segments = append(segments, segment)
+		if words {
+			for _, word := range s.Words {
+				wordList = append(wordList, map[string]interface{}{
+					"word":  word.Text,
+					"start": float64(word.BeginTime) / 1000,
+					"end":   float64(word.EndTime) / 1000,
+				})
+			}
+		}
+	}
+	result := map[string]interface{}{
+		"task":     "transcribe",
+		"language": language,
+		"duration": float64(t.Properties.OriginalDurationInMilliseconds) / 1000,
+		"text":     t.text(sentences),
+		"segments": segments,
+	}
+	if words {
+		if wordList == nil {
+			wordList = []map[string]interface{}{}
+		}
+		result["words"] = wordList
+	}
+	return result
+}
+
+// formatSubtitles 把句子转换为SRT或WebVTT字幕
+func formatSubtitles(sentences []paraformerSentence, format string) string {
+	var b strings.Builder
+	separator := ","
+	if format == "vtt" {
+		b.WriteString("WEBVTT\n\n")
+		separator = "."
+	}
+	for i, s := range sentences {
+		if format == "srt" {
+			fmt.Fprintf(&b, "%d\n", i+1)
+		}
+		fmt.Fprintf(&b, "%s --> %s\n%s\n\n", subtitleTime(s.BeginTime, separator), subtitleTime(s.EndTime, separator), s.Text)
+	}
+	return b.String()
+}
+
+// subtitleTime 毫秒转换为字幕时间 00:00:00,000（WebVTT使用点号分隔毫秒）
+func subtitleTime(ms int, separator string) string {
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubtitleTime(t *testing.T) {
+	tests := []struct {
+		ms        int
+		separator string
+		want      string
+	}{
+		{0, ",", "00:00:00,000"},
+		{1234, ",", "00:00:01,234"},
+		{61005, ".", "00:01:01.005"},
+		{3599999, ",", "00:59:59,999"},
+		{3600000, ".", "01:00:00.000"},
+		{36610500, ",", "10:10:10,500"},
+	}
+	for _, tt := range tests {
+		if got := subtitleTime(tt.ms, tt.separator); got != tt.want {
+			t.Errorf("subtitleTime(%d, %q) = %q，期望 %q", tt.ms, tt.separator, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSubtitles(t *testing.T) {
+	sentences := []paraformerSentence{
+		{BeginTime: 0, EndTime: 1500, Text: "你好。"},
+		{BeginTime: 1500, EndTime: 62250, Text: "今天天气不错。"},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"srt", "1\n00:00:00,000 --> 00:00:01,500\n你好。\n\n2\n00:00:01,500 --> 00:01:02,250\n今天天气不错。\n\n"},
+		{"vtt", "WEBVTT\n\n00:00:00.000 --> 00:00:01.500\n你好。\n\n00:00:01.500 --> 00:01:02.250\n今天天气不错。\n\n"},
+	}
+	for _, tt := range tests {
+		if got := formatSubtitles(sentences, tt.format); got != tt.want {
+			t.Errorf("%s:\n%q\n期望\n%q", tt.format, got, tt.want)
+		}
+	}
+	if got := formatSubtitles(nil, "vtt"); got != "WEBVTT\n\n" {
+		t.Errorf("没有句子时得到 %q", got)
+	}
+}
+
+// stereoTranscript 双声道通话录音的识别结果
+const stereoTranscript = `{
+  "properties": {"original_duration_in_milliseconds": 5200},
+  "transcripts": [
+    {"channel_id": 0, "text": "您好，请问有什么可以帮您？好的，马上处理。", "sentences": [
+      {"begin_time": 0, "end_time": 1800, "text": "您好，请问有什么可以帮您？",
+       "words": [{"begin_time": 0, "end_time": 400, "text": "您好", "punctuation": "，"}]},
+      {"begin_time": 4000, "end_time": 5200, "text": "好的，马上处理。"}
+    ]},
+    {"channel_id": 1, "text": "我的订单还没发货。", "sentences": [
+      {"begin_time": 2000, "end_time": 3500, "text": "我的订单还没发货。"}
+    ]}
+  ]
+}`
+
+func TestParaformerTranscript(t *testing.T) {
+	var transcript paraformerTranscript
+	if err := json.Unmarshal([]byte(stereoTranscript), &transcript); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个声道按开始时间交错排列
+	sentences := transcript.sentences()
+	wantOrder := []struct {
+		begin, channel int
+	}{{0, 0}, {2000, 1}, {4000, 0}}
+	if len(sentences) != len(wantOrder) {
+		t.Fatalf("得到 %d 句，期望 %d 句", len(sentences), len(wantOrder))
+	}
+	for i, want := range wantOrder {
+		if sentences[i].BeginTime != want.begin || sentences[i].channel != want.channel {
+			t.Errorf("第%d句 begin=%d channel=%d，期望 begin=%d channel=%d", i, sentences[i].BeginTime, sentences[i].channel, want.begin, want.channel)
+		}
+	}
+
+	wantText := "您好，请问有什么可以帮您？\n我的订单还没发货。\n好的，马上处理。"
+	if got := transcript.text(sentences); got != wantText {
+		t.Errorf("全文 %q，期望 %q", got, wantText)
+	}
+
+	verbose := transcript.verbose(sentences, "zh", true)
+	if verbose["duration"] != 5.2 || verbose["language"] != "zh" || verbose["text"] != wantText {
+		t.Errorf("verbose_json %v", verbose)
+	}
+	segments := verbose["segments"].([]map[string]interface{})
+	if segments[1]["channel"] != 1 || segments[1]["start"] != 2.0 || segments[1]["end"] != 3.5 {
+		t.Errorf("第2个segment %v", segments[1])
+	}
+	words := verbose["words"].([]map[string]interface{})
+	if len(words) != 1 || words[0]["word"] != "您好" || words[0]["end"] != 0.4 {
+		t.Errorf("words %v", words)
+	}
+	if _, ok := transcript.verbose(sentences, "zh", false)["words"]; ok {
+		t.Error("没有请求word时间戳时不应返回words")
+	}
+}
+
+func TestParaformerTranscriptMono(t *testing.T) {
+	var transcript paraformerTranscript
+	mono := `{"transcripts": [{"channel_id": 0, "text": "全文。", "sentences": [{"begin_time": 0, "end_time": 900, "text": "全文。"}]}]}`
+	if err := json.Unmarshal([]byte(mono), &transcript); err != nil {
+		t.Fatal(err)
+	}
+	sentences := transcript.sentences()
+	if got := transcript.text(sentences); got != "全文。" {
+		t.Errorf("单声道全文 %q", got)
+	}
+	segments := transcript.verbose(sentences, "", false)["segments"].([]map[string]interface{})
+	if _, ok := segments[0]["channel"]; ok {
+		t.Error("单声道的segment不应带channel")
+	}
+}
+
+func TestUploadTemporaryFile(t *testing.T) {
+	type upload struct {
+		contentLength int64
+		fields        map[string]string
+		filename      string
+		content       string
+	}
+	uploads := make(chan upload, 1)
+	oss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1024); err != nil {
+			t.Errorf("解析上传表单失败: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("缺少文件: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(file)
+		fields := map[string]string{}
+		for name, values := range r.MultipartForm.Value {
+			fields[name] = values[0]
+		}
+		uploads <- upload{r.ContentLength, fields, header.Filename, string(content)}
+	}))
+	defer oss.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-tenant" {
+			t.Errorf("获取上传凭证时 Authorization 为 %q", r.Header.Get("Authorization"))
+		}
+		fmt.Fprintf(w, `{"data":{"upload_host":%q,"upload_dir":"dashscope/tmp","policy":"p","signature":"s","oss_access_key_id":"id","max_file_size_mb":1}}`, oss.URL)
+	}))
+	defer api.Close()
+
+	cfg := &Config{BaseURL: api.URL, RequestTimeout: 5}
+	clients := &upstreamClients{client: http.DefaultClient, transport: http.DefaultTransport.(*http.Transport)}
+	route := upstreamRoute{APIKey: "sk-tenant"}
+	audio := strings.Repeat("音频", 20000)
+	fileURL, _, err := uploadTemporaryFile(context.Background(), cfg, clients, route, "paraformer-v2", `C:\录音\call.mp3`, strings.NewReader(audio), int64(len(audio)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileURL != "oss://dashscope/tmp/call.mp3" {
+		t.Errorf("文件地址 %q", fileURL)
+	}
+	got := <-uploads
+	if got.content != audio || got.filename != "call.mp3" || got.fields["key"] != "dashscope/tmp/call.mp3" || got.fields["OSSAccessKeyId"] != "id" {
+		t.Errorf("上传的表单 filename=%q fields=%v（%d 字节）", got.filename, got.fields, len(got.content))
+	}
+	if got.contentLength <= int64(len(audio)) {
+		t.Errorf("上传请求的 Content-Length 为 %d", got.contentLength)
+	}
+
+	// 超过上游临时存储的上限时不上传
+	big := int64(2 * 1024 * 1024)
+	_, _, err = uploadTemporaryFile(context.Background(), cfg, clients, route, "paraformer-v2", "big.wav", strings.NewReader(strings.Repeat("x", int(big))), big)
+	if statusErr, ok := err.(*upstreamStatusError); !ok || statusErr.status != http.StatusRequestEntityTooLarge {
+		t.Errorf("超过上限时得到 %v，期望413", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// openAIChunk OpenAI格式的流式chunk
+type openAIChunk struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// chatTranslator 把 serveChatCompletion 输出的OpenAI格式响应转换为其他API格式，每个请求一个实例
+type chatTranslator interface {
+	// ContentType 返回响应的Content-Type
+	ContentType(stream bool) string
+	// Response 转换非流式的成功响应
+	Response(resp OpenAIResponse) []byte
+	// Error 转换错误响应，返回新的状态码和响应体
+	Error(statusCode int, errResp OpenAIErrorResponse) (int, []byte)
+	// Chunk 转换一个流式chunk，返回要写给客户端的数据（可以为空）
+	Chunk(chunk openAIChunk) []byte
+	// StreamError 转换流中途的错误事件
+	StreamError(errResp OpenAIErrorResponse) []byte
+	// StreamDone 流正常结束（[DONE]）
+	StreamDone() []byte
+	// Heartbeat 转换SSE心跳注释，不支持时返回nil
+	Heartbeat() []byte
+}
+
+// translatingWriter 作为 serveChatCompletion 的ResponseWriter，把OpenAI格式的输出转换为其他API格式
+// 流式响应逐个事件转换；非流式响应在 Finish 时整体转换。无法解析的内容原样返回
+type translatingWriter struct {
+	w          http.ResponseWriter
+	t          chatTranslator
+	status     int
+	stream     bool
+	buf        bytes.Buffer
+	streamDone bool
+}
+
+// newTranslatingWriter 创建转换响应格式的ResponseWriter
+func newTranslatingWriter(w http.ResponseWriter, t chatTranslator) *translatingWriter {
+	return &translatingWriter{w: w, t: t}
+}
+
+func (tw *translatingWriter) Header() http.Header {
+	return tw.w.Header()
+}
+
+func (tw *translatingWriter) WriteHeader(code int) {
+	if tw.status != 0 {
+		return
+	}
+	tw.status = code
+	tw.stream = strings.HasPrefix(tw.w.Header().Get("Content-Type"), "text/event-stream")
+	if tw.stream {
+		tw.w.Header().Set("Content-Type", tw.t.ContentType(true))
+		tw.w.WriteHeader(code)
+	}
+}
+
+func (tw *translatingWriter) Write(p []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	tw.buf.Write(p)
+	if !tw.stream {
+		return len(p), nil
+	}
+
+	// 按SSE事件（空行分隔）逐个转换
+	for {
+		data := tw.buf.Bytes()
+		end := bytes.Index(data, []byte("\n\n"))
+		if end < 0 {
+			return len(p), nil
+		}
+		event := string(data[:end])
+		tw.buf.Next(end + 2)
+		if out := tw.translateEvent(event); len(out) > 0 {
+			if _, err := tw.w.Write(out); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// translateEvent 转换一个SSE事件
+func (tw *translatingWriter) translateEvent(event string) []byte {
+	if strings.HasPrefix(event, ":") {
+		return tw.t.Heartbeat()
+	}
+	payload := strings.TrimSpace(strings.TrimPrefix(event, "data:"))
+	if payload == "[DONE]" {
+		if tw.streamDone {
+			return nil
+		}
+		tw.streamDone = true
+		return tw.t.StreamDone()
+	}
+	var errResp OpenAIErrorResponse
+	if json.Unmarshal([]byte(payload), &errResp) == nil && errResp.Error.Message != "" {
+		return tw.t.StreamError(errResp)
+	}
+	var chunk openAIChunk
+	if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+		return nil
+	}
+	return tw.t.Chunk(chunk)
+}
+
+// Flush 流式响应需要逐条刷新
+func (tw *translatingWriter) Flush() {
+	if !tw.stream {
+		return
+	}
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Finish 处理结束后调用，转换并写出非流式响应
+func (tw *translatingWriter) Finish() {
+	if tw.stream || tw.status == 0 {
+		return
+	}
+	body := tw.buf.Bytes()
+	status := tw.status
+
+	var errResp OpenAIErrorResponse
+	var resp OpenAIResponse
+	switch {
+	case status < http.StatusBadRequest && json.Unmarshal(body, &resp) == nil && len(resp.Choices) > 0:
+		body = tw.t.Response(resp)
+		tw.w.Header().Set("Content-Type", tw.t.ContentType(false))
+	case status >= http.StatusBadRequest:
+		if json.Unmarshal(body, &errResp) != nil || errResp.Error.Message == "" {
+			// http.Error 输出的纯文本错误
+			errResp.Error.Message = strings.TrimSpace(string(body))
+			errResp.Error.Type = "invalid_request_error"
+			if status >= http.StatusInternalServerError {
+				errResp.Error.Type = "server_error"
+			}
+		}
+		status, body = tw.t.Error(status, errResp)
+		tw.w.Header().Set("Content-Type", "application/json")
+	}
+	tw.w.Header().Del("Content-Length")
+	tw.w.WriteHeader(status)
+	tw.w.Write(body)
+}
+
+// serveTranslated 以OpenAI格式处理请求，并用translator把响应转换为其他API格式
+func serveTranslated(w http.ResponseWriter, r *http.Request, openAIReq OpenAIRequest, t chatTranslator) {
+	tw := newTranslatingWriter(w, t)
+	serveChatCompletion(tw, r, openAIReq)
+	tw.Finish()
+}
+
+// decodeJSONBody 解析请求体，失败时以翻译后的错误格式返回400
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, t chatTranslator, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		status, body := t.Error(http.StatusMethodNotAllowed, openAIError("invalid_request_error", "只支持POST请求"))
+		writeTranslatedError(w, status, body)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		status, body := t.Error(http.StatusBadRequest, openAIError("invalid_request_error", "请求格式错误: "+err.Error()))
+		writeTranslatedError(w, status, body)
+		return false
+	}
+	return true
+}
+
+// rejectTranslated 以翻译后的错误格式返回400
+func rejectTranslated(w http.ResponseWriter, t chatTranslator, message string) {
+	status, body := t.Error(http.StatusBadRequest, openAIError("invalid_request_error", message))
+	writeTranslatedError(w, status, body)
+}
+
+func writeTranslatedError(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// openAIError 构建OpenAI格式的错误
+func openAIError(errType, message string) OpenAIErrorResponse {
+	var errResp OpenAIErrorResponse
+	errResp.Error.Type = errType
+	errResp.Error.Message = message
+	return errResp
+}
+
+// newRandomID 生成随机ID，用于上游没有返回request_id时
+func newRandomID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// translateStream 把OpenAI格式的SSE事件依次交给translatingWriter，返回转换后的输出
+func translateStream(t *testing.T, tr chatTranslator, events ...string) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	tw := newTranslatingWriter(rec, tr)
+	tw.Header().Set("Content-Type", "text/event-stream")
+	tw.WriteHeader(http.StatusOK)
+	for _, event := range events {
+		if _, err := tw.Write([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Finish()
+	return rec.Body.String()
+}
+
+// translateResponse 把OpenAI格式的非流式响应交给translatingWriter，返回转换后的响应
+func translateResponse(t *testing.T, tr chatTranslator, status int, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	tw := newTranslatingWriter(rec, tr)
+	tw.Header().Set("Content-Type", "application/json")
+	tw.WriteHeader(status)
+	tw.Write([]byte(body))
+	tw.Finish()
+	return rec
+}
+
+// chunkEvent 构建OpenAI格式的流式chunk事件，finishReason为空表示还没结束
+func chunkEvent(content, finishReason string, usage *Usage) string {
+	var finish interface{}
+	if finishReason != "" {
+		finish = finishReason
+	}
+	chunk := answerChunkMap("req-1", "qwen", 1718000000, map[string]interface{}{"content": content}, finish)
+	if usage != nil {
+		chunk["usage"] = usage
+	}
+	data, _ := json.Marshal(chunk)
+	return "data: " + string(data) + "\n\n"
+}
+
+// chatResponse 构建OpenAI格式的非流式响应
+func chatResponse(content, finishReason string) string {
+	data, _ := json.Marshal(OpenAIResponse{
+		ID:      "req-1",
+		Object:  "chat.completion",
+		Choices: []Choice{{Message: Message{Role: "assistant", Content: content}, FinishReason: finishReason}},
+		Usage:   Usage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17},
+	})
+	return string(data)
+}
+
+// decodeJSON 解析JSON响应
+func decodeJSON(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("响应不是JSON: %v\n%s", err, body)
+	}
+	return v
+}
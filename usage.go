@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// requestUsage 一次请求消耗的token，由各处理函数在拿到上游usage时更新，请求结束后计入客户端Key的用量
+type requestUsage struct {
+	mu     sync.Mutex
+	Model  string        // 请求的模型名
+	Models []modelTokens // 上游返回的各模型用量
+}
+
+// modelTokens 上游一个模型的token用量
+type modelTokens struct {
+	ModelID      string
+	InputTokens  int
+	OutputTokens int
+	Images       int // 生成的图片数，按张计价
+	AudioSeconds int // 识别的音频时长（秒），按秒计价
+}
+
+// requestUsageKey 请求上下文中保存用量的键
+type requestUsageKey struct{}
+
+// withRequestUsage 在请求上下文中创建用量记录
+func withRequestUsage(r *http.Request) (*http.Request, *requestUsage) {
+	usage := &requestUsage{}
+	return r.WithContext(context.WithValue(r.Context(), requestUsageKey{}, usage)), usage
+}
+
+// reportModel 记录请求的模型名，上游model_id没有配置价格时按模型名计价
+func reportModel(ctx context.Context, model string) {
+	usage, _ := ctx.Value(requestUsageKey{}).(*requestUsage)
+	if usage == nil {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.Model = model
+}
+
+// reportUsage 记录上游返回的token用量；流式事件中的usage是累计值，以最后一次为准
+func reportUsage(ctx context.Context, nativeResp AliyunNativeResponse) {
+	if len(nativeResp.Usage.Models) == 0 {
+		return
+	}
+	models := make([]modelTokens, 0, len(nativeResp.Usage.Models))
+	for _, m := range nativeResp.Usage.Models {
+		models = append(models, modelTokens{ModelID: m.ModelID, InputTokens: m.InputTokens, OutputTokens: m.OutputTokens})
+	}
+	reportTokens(ctx, models...)
+}
+
+// reportTokens 记录请求的token用量，替换之前记录的值；供不返回原生应用格式的接口（如文本向量）使用
+func reportTokens(ctx context.Context, models ...modelTokens) {
+	usage, _ := ctx.Value(requestUsageKey{}).(*requestUsage)
+	if usage == nil {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	usage.Models = append(usage.Models[:0], models...)
+}
+
+// Tokens 返回输入和输出token数
+func (u *requestUsage) Tokens() (input, output int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, m := range u.Models {
+		input += m.InputTokens
+		output += m.OutputTokens
+	}
+	return input, output
+}
+
+// Cost 按价格表估算费用：优先使用上游model_id的价格，没有时使用请求的模型名的价格，都没有时不计费
+func (u *requestUsage) Cost(prices map[string]PriceConfig) float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var cost float64
+	for _, m := range u.Models {
+		price, ok := prices[m.ModelID]
+		if !ok {
+			price = prices[u.Model]
+		}
+		cost += float64(m.InputTokens)/1000*price.Input + float64(m.OutputTokens)/1000*price.Output +
+			float64(m.Images)*price.Image + float64(m.AudioSeconds)*price.AudioSecond
+	}
+	return cost
+}
+
+// statusRecorder 记录响应状态码，用于判断请求是否应计入用量
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush 流式响应需要逐条刷新
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Status 返回响应状态码，未写入响应时返回0
+func (s *statusRecorder) Status() int {
+	return s.status
+}